@@ -1,6 +1,7 @@
 package es
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"github.com/elastic/go-elasticsearch/v7"
@@ -102,3 +103,63 @@ func (a *aliasClient) DeleteAlias(index string, alias string) bool {
 
 	return true
 }
+
+// Swap 通过 _aliases 接口在一个请求中将别名从from切换到to，from为空时只添加别名
+func (a *aliasClient) Swap(alias string, from string, to string) bool {
+	return a.SwapWithWriteIndex(alias, from, to, false)
+}
+
+// SwapWithWriteIndex 原子切换别名，isWriteIndex为true时将to设置为别名的写索引
+func (a *aliasClient) SwapWithWriteIndex(alias string, from string, to string, isWriteIndex bool) bool {
+
+	if alias == "" || to == "" {
+		return false
+	}
+
+	var actions []map[string]interface{}
+	if from != "" && from != to {
+		actions = append(actions, map[string]interface{}{
+			"remove": map[string]interface{}{
+				"index": from,
+				"alias": alias,
+			},
+		})
+	}
+
+	add := map[string]interface{}{
+		"index": to,
+		"alias": alias,
+	}
+	if isWriteIndex {
+		add["is_write_index"] = true
+	}
+	actions = append(actions, map[string]interface{}{
+		"add": add,
+	})
+
+	data, err := json.Marshal(map[string]interface{}{
+		"actions": actions,
+	})
+	if err != nil {
+		log.Printf("Error marshaling alias actions: %s", err)
+		return false
+	}
+
+	req := esapi.IndicesUpdateAliasesRequest{
+		Body: bytes.NewReader(data),
+	}
+
+	res, err := req.Do(context.Background(), a.es)
+	if err != nil {
+		log.Printf("Error getting response: %s", err)
+		return false
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		log.Printf("Error response: %s", res.String())
+		return false
+	}
+
+	return true
+}
@@ -1,6 +1,7 @@
 package es
 
 import (
+	"elasticsearch-data-import-go/metrics"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esutil"
@@ -28,12 +29,15 @@ func init() {
 		NumWorkers:    runtime.NumCPU(),    // The number of worker goroutines
 		FlushBytes:    int(5e+6),           // The flush threshold in bytes
 		FlushInterval: 30 * time.Second,    // The periodic flush interval
+		OnFlushStart:  onFlushStart,        // Called when the flush starts
+		OnFlushEnd:    onFlushEnd,          // Called when the flush ends
 	})
 
 	if err != nil {
 		panic(fmt.Sprintf("Error creating the indexer: %s", err))
 	}
 	Document = documentClient{bi, elasticsearchClient}
+	metrics.MustRegister(bulkIndexerCollector{bi})
 
 	//初始化索引操作
 	Index = indexClient{
@@ -3,18 +3,41 @@ package es
 import (
 	"bytes"
 	"context"
+	"elasticsearch-data-import-go/metrics"
 	"encoding/json"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/elastic/go-elasticsearch/v7/esutil"
 	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// VersionExternal 外部版本号，版本号大于索引中的版本时写入
+	VersionExternal = "external"
+	// VersionExternalGte 外部版本号，版本号大于等于索引中的版本时写入，重复回放同一版本的数据时不会冲突
+	VersionExternalGte = "external_gte"
+)
+
 type DocumentEntity struct {
 	Id   string
 	Data *map[string]interface{}
+	// Version 外部版本号，大于0时使用外部版本控制，旧版本的数据不会覆盖新版本的数据
+	Version int64
+	// VersionType 版本类型，默认为VersionExternalGte
+	VersionType string
+}
+
+// versionType 文档的版本类型
+func (doc *DocumentEntity) versionType() string {
+	if doc.VersionType == "" {
+		return VersionExternalGte
+	}
+	return doc.VersionType
 }
 
 type Pager struct {
@@ -45,43 +68,126 @@ type documentClient struct {
 	es *elasticsearch.Client
 }
 
+const (
+	// bulkMaxRetries 可重试的批量写入失败的最大重试次数
+	bulkMaxRetries = 3
+	// bulkRetryBackoff 第一次重试的等待时间，之后每次翻倍
+	bulkRetryBackoff = time.Second
+)
+
+// BatchResult 批量写入结果
+type BatchResult struct {
+	// Index 批次写入的索引
+	Index   string
+	Success int64
+	Fail    int64
+	// Conflict 版本冲突跳过的文档数量
+	Conflict int64
+	// Errors 按错误类型统计的失败数量
+	Errors map[string]int64
+	// Failed 重试后仍然失败的文档
+	Failed []*FailedItem
+
+	mu sync.Mutex
+}
+
+// FailedItem 批量写入失败的文档
+type FailedItem struct {
+	Index     string `json:"index"`
+	Id        string `json:"id"`
+	Action    string `json:"action"`
+	Status    int    `json:"status"`
+	ErrorType string `json:"errorType"`
+	Reason    string `json:"reason"`
+	Payload   string `json:"payload,omitempty"`
+	Attempts  int    `json:"attempts"`
+}
+
+// addFailure 记录失败的文档
+func (r *BatchResult) addFailure(item *FailedItem) {
+	atomic.AddInt64(&r.Fail, 1)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Errors == nil {
+		r.Errors = make(map[string]int64)
+	}
+	r.Errors[item.ErrorType]++
+	r.Failed = append(r.Failed, item)
+}
+
+// BatchCallback 批量写入回调，当批次内所有文档都已刷入ES（成功或失败）后调用
+type BatchCallback func(result *BatchResult)
+
 func (d *documentClient) BatchSave(index string, docs []*DocumentEntity) error {
+	return d.BatchSaveWithCallback(context.Background(), index, docs, nil)
+}
 
-	for _, doc := range docs {
+// BatchSaveWithCallback 批量写入，批次内所有文档刷入ES后调用callback，ctx取消后不再接收新的文档
+func (d *documentClient) BatchSaveWithCallback(ctx context.Context, index string, docs []*DocumentEntity, callback BatchCallback) error {
+	return d.bulk(ctx, "index", index, docs, callback)
+}
 
-		data, err := json.Marshal(doc.Data)
-		if err != nil {
-			log.Printf("Cannot encode doc %s: %s", doc.Id, err)
+// BulkDelete 批量删除，文档不存在时视为成功，批次内所有文档处理完成后调用callback
+func (d *documentClient) BulkDelete(ctx context.Context, index string, docs []*DocumentEntity, callback BatchCallback) error {
+	return d.bulk(ctx, "delete", index, docs, callback)
+}
+
+// bulk 通过BulkIndexer批量执行action，action为index或delete
+// 429和503的失败按指数退避重试bulkMaxRetries次，仍然失败的文档记录在BatchResult.Failed中
+func (d *documentClient) bulk(ctx context.Context, action string, index string, docs []*DocumentEntity, callback BatchCallback) error {
+
+	result := &BatchResult{Index: index}
+	metrics.BulkBatchDocs.WithLabelValues(index).Observe(float64(len(docs)))
+	var size int
+	defer func() {
+		if size > 0 {
+			metrics.BulkBatchBytes.WithLabelValues(index).Observe(float64(size))
 		}
+	}()
+	//批次内未完成的文档数量，归零时触发回调
+	remaining := int64(len(docs))
+	done := func() {
+		if atomic.AddInt64(&remaining, -1) == 0 && callback != nil {
+			callback(result)
+		}
+	}
 
-		err = d.bi.Add(
-			context.Background(),
-			esutil.BulkIndexerItem{
-				Index: index,
-				// Action field configures the operation to perform (index, create, delete, update)
-				Action: "index",
-				// DocumentID is the (optional) document ID
-				DocumentID: doc.Id,
-				// Body is an `io.Reader` with the payload
-				Body: bytes.NewReader(data),
-				// OnSuccess is called for each successful operation
-				OnSuccess: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
-					log.Printf("batch save success! index:%s, id:%s", res.Index, res.DocumentID)
-				},
-
-				// OnFailure is called for each failed operation
-				OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
-					info, _ := json.Marshal(res)
-					if err != nil {
-						log.Printf("batch save has fail! info:%s ERROR: %v", info, err)
-					} else {
-						log.Printf("batch save has fail! info:%s ERROR: %s: %s", info, res.Error.Type, res.Error.Reason)
-					}
-				},
-			},
-		)
+	if remaining == 0 {
+		if callback != nil {
+			callback(result)
+		}
+		return nil
+	}
+
+	for i, doc := range docs {
+
+		var data []byte
+		if action != "delete" {
+			var err error
+			data, err = json.Marshal(doc.Data)
+			if err != nil {
+				log.Printf("Cannot encode doc %s: %s", doc.Id, err)
+				result.addFailure(&FailedItem{Index: index, Id: doc.Id, Action: action, ErrorType: "encode_exception", Reason: err.Error()})
+				done()
+				continue
+			}
+			size += len(data)
+		}
+
+		err := d.bi.Add(ctx, d.bulkItem(ctx, action, index, doc, data, 0, result, done))
 
 		if err != nil {
+			//未加入批量写入的文档逐条记为失败，进入死信队列，避免位点提交后丢失
+			for _, notAdded := range docs[i:] {
+				var payload []byte
+				if action != "delete" {
+					payload, _ = json.Marshal(notAdded.Data)
+				}
+				result.addFailure(&FailedItem{Index: index, Id: notAdded.Id, Action: action, ErrorType: "not_added",
+					Reason: err.Error(), Payload: string(payload)})
+				done()
+			}
 			return fmt.Errorf("batch save has fail! index:%s Unexpected error: %v", index, err)
 		}
 	}
@@ -89,6 +195,86 @@ func (d *documentClient) BatchSave(index string, docs []*DocumentEntity) error {
 	return nil
 }
 
+// bulkItem 创建批量写入的文档，attempt为已经重试的次数
+func (d *documentClient) bulkItem(ctx context.Context, action string, index string, doc *DocumentEntity, data []byte,
+	attempt int, result *BatchResult, done func()) esutil.BulkIndexerItem {
+
+	item := esutil.BulkIndexerItem{
+		Index: index,
+		// Action field configures the operation to perform (index, create, delete, update)
+		Action: action,
+		// DocumentID is the (optional) document ID
+		DocumentID: doc.Id,
+		// OnSuccess is called for each successful operation
+		OnSuccess: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
+			flushedIndex(ctx, index)
+			atomic.AddInt64(&result.Success, 1)
+			done()
+		},
+
+		// OnFailure is called for each failed operation
+		OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+			flushedIndex(ctx, index)
+			//删除的文档不存在，视为成功
+			if err == nil && action == "delete" && res.Result == "not_found" {
+				atomic.AddInt64(&result.Success, 1)
+				done()
+				return
+			}
+			//索引中已有更新的版本，跳过
+			if err == nil && isVersionConflict(res.Status, res.Error.Type) {
+				log.Printf("batch save skip! version conflict! index:%s, id:%s", res.Index, res.DocumentID)
+				atomic.AddInt64(&result.Conflict, 1)
+				done()
+				return
+			}
+
+			//ES繁忙，退避后重试，重新加入时不能阻塞BulkIndexer的worker
+			if err == nil && res.Status == http.StatusTooManyRequests {
+				notifyRejected(index)
+			}
+			if err == nil && isRetryable(res.Status) && attempt < bulkMaxRetries {
+				backoff := bulkRetryBackoff << attempt
+				log.Printf("batch save retry! index:%s, id:%s, status:%d, attempt:%d, backoff:%v", index, doc.Id, res.Status, attempt+1, backoff)
+				go func() {
+					time.Sleep(backoff)
+					retry := d.bulkItem(ctx, action, index, doc, data, attempt+1, result, done)
+					if err := d.bi.Add(ctx, retry); err != nil {
+						log.Printf("batch save retry fail! index:%s, id:%s, error:%v", index, doc.Id, err)
+						result.addFailure(&FailedItem{Index: index, Id: doc.Id, Action: action, Status: res.Status,
+							ErrorType: res.Error.Type, Reason: err.Error(), Payload: string(data), Attempts: attempt + 1})
+						done()
+					}
+				}()
+				return
+			}
+
+			failed := &FailedItem{Index: index, Id: doc.Id, Action: action, Status: res.Status,
+				ErrorType: res.Error.Type, Reason: res.Error.Reason, Payload: string(data), Attempts: attempt + 1}
+			info, _ := json.Marshal(res)
+			if err != nil {
+				log.Printf("batch save has fail! info:%s ERROR: %v", info, err)
+				failed.ErrorType = "request_exception"
+				failed.Reason = err.Error()
+			} else {
+				log.Printf("batch save has fail! info:%s ERROR: %s: %s", info, res.Error.Type, res.Error.Reason)
+			}
+			result.addFailure(failed)
+			done()
+		},
+	}
+	if doc.Version > 0 {
+		version := doc.Version
+		item.Version = &version
+		item.VersionType = doc.versionType()
+	}
+	if data != nil {
+		// Body is an `io.Reader` with the payload
+		item.Body = bytes.NewReader(data)
+	}
+	return item
+}
+
 func (d *documentClient) Save(index string, doc DocumentEntity) error {
 
 	if index == "" {
@@ -110,6 +296,11 @@ func (d *documentClient) Save(index string, doc DocumentEntity) error {
 		Body:       bytes.NewReader(data),
 		Timeout:    30 * time.Second,
 	}
+	if doc.Version > 0 {
+		version := int(doc.Version)
+		req.Version = &version
+		req.VersionType = doc.versionType()
+	}
 
 	res, err := req.Do(context.Background(), d.es)
 	if err != nil {
@@ -117,7 +308,11 @@ func (d *documentClient) Save(index string, doc DocumentEntity) error {
 	}
 	defer res.Body.Close()
 
-	if res.IsError() {
+	if res.StatusCode == http.StatusConflict && doc.Version > 0 {
+		//索引中已有更新的版本，跳过
+		log.Printf("document save skip! version conflict! index:%s, id:%s, version:%d", index, doc.Id, doc.Version)
+		return nil
+	} else if res.IsError() {
 		return fmt.Errorf("[%s] Error indexing document ID=%s, Index=%v", res.Status(), req.DocumentID, req.Index)
 	} else {
 		// Deserialize the response into a map.
@@ -126,13 +321,149 @@ func (d *documentClient) Save(index string, doc DocumentEntity) error {
 			return fmt.Errorf("error parsing the response body: %v", err)
 		} else {
 			// Print the response status and indexed document version.
-			return fmt.Errorf("[%s] %s; version=%d", res.Status(), r["result"], int(r["_version"].(float64)))
+			log.Printf("[%s] %s; version=%d", res.Status(), r["result"], int(r["_version"].(float64)))
 		}
 	}
 
 	return nil
 }
 
+// Update 局部更新文档，upsert为true时文档不存在则以Data创建文档
+// 更新接口不支持外部版本号，Version大于0时读取文档合并后按外部版本号写入，索引中已有更新的版本时跳过
+func (d *documentClient) Update(index string, doc DocumentEntity, upsert bool) error {
+
+	if index == "" {
+		return fmt.Errorf("document update fail, index can not be empty")
+	}
+
+	if doc.Id == "" || doc.Data == nil || len(*doc.Data) == 0 {
+		return fmt.Errorf("document update fail, param doc invalid. index:%s", index)
+	}
+
+	if doc.Version > 0 {
+		return d.versionedUpdate(index, doc, upsert)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"doc":           doc.Data,
+		"doc_as_upsert": upsert,
+	})
+	if err != nil {
+		return fmt.Errorf("document update fail, error marshaling document, index:%s, error:%s", index, err)
+	}
+
+	req := esapi.UpdateRequest{
+		Index:      index,
+		DocumentID: doc.Id,
+		Body:       bytes.NewReader(data),
+		Timeout:    30 * time.Second,
+	}
+
+	res, err := req.Do(context.Background(), d.es)
+	if err != nil {
+		return fmt.Errorf("error getting response: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("[%s] Error updating document ID=%s, Index=%v", res.Status(), req.DocumentID, req.Index)
+	}
+
+	log.Printf("document update success! index:%s, id:%s", index, doc.Id)
+	return nil
+}
+
+// versionedUpdate 读取文档合并局部更新的字段，按外部版本号整体写入
+// 读取和写入之间有更新版本的数据写入时，由Save的版本冲突跳过
+func (d *documentClient) versionedUpdate(index string, doc DocumentEntity, upsert bool) error {
+
+	req := esapi.GetRequest{
+		Index:      index,
+		DocumentID: doc.Id,
+	}
+
+	res, err := req.Do(context.Background(), d.es)
+	if err != nil {
+		return fmt.Errorf("error getting response: %v", err)
+	}
+	defer res.Body.Close()
+
+	var r struct {
+		Found   bool                   `json:"found"`
+		Version int64                  `json:"_version"`
+		Source  map[string]interface{} `json:"_source"`
+	}
+	if res.StatusCode != http.StatusNotFound && res.IsError() {
+		return fmt.Errorf("[%s] Error getting document ID=%s, Index=%v", res.Status(), req.DocumentID, req.Index)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return fmt.Errorf("error parsing the response body: %v", err)
+	}
+
+	if !r.Found {
+		if !upsert {
+			return fmt.Errorf("[%s] Error updating document ID=%s, Index=%v, document missing", res.Status(), req.DocumentID, req.Index)
+		}
+		r.Source = make(map[string]interface{})
+	} else if r.Version > doc.Version {
+		log.Printf("document update skip! version conflict! index:%s, id:%s, version:%d, current:%d", index, doc.Id, doc.Version, r.Version)
+		return nil
+	}
+
+	for field, value := range *doc.Data {
+		r.Source[field] = value
+	}
+	doc.Data = &r.Source
+	return d.Save(index, doc)
+}
+
+// Delete 删除文档，文档不存在或索引中已有更新的版本时视为成功
+func (d *documentClient) Delete(index string, doc DocumentEntity) error {
+
+	if index == "" {
+		return fmt.Errorf("document delete fail, index can not be empty")
+	}
+
+	if doc.Id == "" {
+		return fmt.Errorf("document delete fail, id can not be empty. index:%s", index)
+	}
+
+	req := esapi.DeleteRequest{
+		Index:      index,
+		DocumentID: doc.Id,
+		Timeout:    30 * time.Second,
+	}
+	if doc.Version > 0 {
+		version := int(doc.Version)
+		req.Version = &version
+		req.VersionType = doc.versionType()
+	}
+
+	res, err := req.Do(context.Background(), d.es)
+	if err != nil {
+		return fmt.Errorf("error getting response: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		//区分文档不存在和索引不存在
+		var r map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&r); err == nil && r["result"] == "not_found" {
+			log.Printf("document delete skip! not found! index:%s, id:%s", index, doc.Id)
+			return nil
+		}
+		return fmt.Errorf("[%s] Error deleting document ID=%s, Index=%v", res.Status(), req.DocumentID, req.Index)
+	} else if res.StatusCode == http.StatusConflict && doc.Version > 0 {
+		log.Printf("document delete skip! version conflict! index:%s, id:%s, version:%d", index, doc.Id, doc.Version)
+		return nil
+	} else if res.IsError() {
+		return fmt.Errorf("[%s] Error deleting document ID=%s, Index=%v", res.Status(), req.DocumentID, req.Index)
+	}
+
+	log.Printf("document delete success! index:%s, id:%s", index, doc.Id)
+	return nil
+}
+
 func (d *documentClient) Find(req esapi.SearchRequest) *Pager {
 
 	var p = Pager{
@@ -194,3 +525,54 @@ func (d *documentClient) Find(req esapi.SearchRequest) *Pager {
 
 	return &p
 }
+
+// SearchIds 执行查询，按命中顺序返回文档id，body中的size决定返回数量
+func (d *documentClient) SearchIds(index string, body map[string]interface{}) ([]string, error) {
+
+	query, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("SearchIds error encoding query: %w", err)
+	}
+
+	req := esapi.SearchRequest{
+		Index: []string{index},
+		Body:  bytes.NewReader(query),
+	}
+
+	res, err := req.Do(context.Background(), d.es)
+	if err != nil {
+		return nil, fmt.Errorf("SearchIds error getting response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("SearchIds error response: %s", res.String())
+	}
+
+	var data struct {
+		Hits struct {
+			Hits []struct {
+				Id string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("SearchIds error parsing the response body: %w", err)
+	}
+
+	ids := make([]string, 0, len(data.Hits.Hits))
+	for _, hit := range data.Hits.Hits {
+		ids = append(ids, hit.Id)
+	}
+	return ids, nil
+}
+
+// isRetryable 是否是可以重试的失败，ES拒绝执行或暂时不可用
+func isRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// isVersionConflict 是否是版本冲突
+func isVersionConflict(status int, errorType string) bool {
+	return status == http.StatusConflict && errorType == "version_conflict_engine_exception"
+}
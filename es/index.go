@@ -41,6 +41,32 @@ func (i *indexClient) Close(index string) bool {
 	return true
 }
 
+// Open 打开已关闭的索引
+func (i *indexClient) Open(index string) bool {
+
+	if index == "" {
+		return false
+	}
+
+	req := esapi.IndicesOpenRequest{
+		Index: []string{index},
+	}
+
+	res, err := req.Do(context.Background(), i.es)
+	if err != nil {
+		log.Printf("Error getting response: %s", err)
+		return false
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		log.Printf("Error response: %s", res.String())
+		return false
+	}
+
+	return true
+}
+
 func (i *indexClient) Exists(index string) bool {
 
 	req := esapi.IndicesExistsRequest{
@@ -90,7 +116,7 @@ func (i *indexClient) Create(index string, info map[string]interface{}) error {
 			return fmt.Errorf("error parsing the response body: %v", err)
 		} else {
 			// Print the response status and indexed document version.
-			return fmt.Errorf("[%s] %s", res.Status(), r["result"])
+			log.Printf("[%s] %s", res.Status(), r["acknowledged"])
 		}
 	}
 
@@ -179,3 +205,205 @@ func (i *indexClient) ForceMerge(index string) error {
 
 	return nil
 }
+
+// FindByPattern 按照通配符查询索引名称，包含已关闭的索引
+func (i *indexClient) FindByPattern(pattern string) []string {
+
+	req := esapi.CatIndicesRequest{
+		Index:  []string{pattern},
+		Format: "json",
+		H:      []string{"index", "status"},
+	}
+
+	res, err := req.Do(context.Background(), i.es)
+	if err != nil {
+		log.Printf("Error getting response: %s", err)
+		return nil
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		log.Printf("Error response: %s", res.String())
+		return nil
+	}
+
+	var data []map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	if err != nil {
+		log.Printf("Error parsing the response: %s\n", err)
+		return nil
+	}
+
+	var indexes []string
+	for _, d := range data {
+		if index, ok := d["index"].(string); ok {
+			indexes = append(indexes, index)
+		}
+	}
+
+	return indexes
+}
+
+// Refresh 刷新索引，使写入的文档可以被搜索
+func (i *indexClient) Refresh(index string) error {
+
+	req := esapi.IndicesRefreshRequest{
+		Index: []string{index},
+	}
+
+	res, err := req.Do(context.Background(), i.es)
+	if err != nil {
+		return fmt.Errorf("Refresh error getting response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("Refresh error response: %s", res.String())
+	}
+
+	return nil
+}
+
+// Count 获取索引的文档数量
+func (i *indexClient) Count(index string) (int64, error) {
+
+	req := esapi.CountRequest{
+		Index: []string{index},
+	}
+
+	res, err := req.Do(context.Background(), i.es)
+	if err != nil {
+		return 0, fmt.Errorf("Count error getting response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, fmt.Errorf("Count error response: %s", res.String())
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return 0, fmt.Errorf("Count error parsing the response body: %w", err)
+	}
+
+	count, ok := data["count"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("Count error response has no count! index:%s", index)
+	}
+
+	return int64(count), nil
+}
+
+// GetMapping 获取索引的mapping，返回索引mappings下的内容
+func (i *indexClient) GetMapping(index string) (map[string]interface{}, error) {
+
+	req := esapi.IndicesGetMappingRequest{
+		Index: []string{index},
+	}
+
+	res, err := req.Do(context.Background(), i.es)
+	if err != nil {
+		return nil, fmt.Errorf("GetMapping error getting response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("GetMapping error response: %s", res.String())
+	}
+
+	var data map[string]map[string]map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("GetMapping error parsing the response body: %w", err)
+	}
+
+	//请求的是别名时，返回的key是实际的索引名称
+	for _, v := range data {
+		return v["mappings"], nil
+	}
+	return nil, fmt.Errorf("GetMapping error response has no mapping! index:%s", index)
+}
+
+// GetSettings 获取索引的设置，key为扁平格式，例如 index.refresh_interval
+func (i *indexClient) GetSettings(index string) (map[string]interface{}, error) {
+
+	req := esapi.IndicesGetSettingsRequest{
+		Index:        []string{index},
+		FlatSettings: esapi.BoolPtr(true),
+	}
+
+	res, err := req.Do(context.Background(), i.es)
+	if err != nil {
+		return nil, fmt.Errorf("GetSettings error getting response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("GetSettings error response: %s", res.String())
+	}
+
+	var data map[string]map[string]map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("GetSettings error parsing the response body: %w", err)
+	}
+
+	for _, v := range data {
+		return v["settings"], nil
+	}
+	return nil, fmt.Errorf("GetSettings error response has no settings! index:%s", index)
+}
+
+// PutSettings 更新索引的动态设置，值为nil时恢复默认值
+func (i *indexClient) PutSettings(index string, settings map[string]interface{}) error {
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("PutSettings error marshaling settings, index:%s, error:%w", index, err)
+	}
+
+	req := esapi.IndicesPutSettingsRequest{
+		Index: []string{index},
+		Body:  bytes.NewReader(data),
+	}
+
+	res, err := req.Do(context.Background(), i.es)
+	if err != nil {
+		return fmt.Errorf("PutSettings error getting response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("PutSettings error response: %s", res.String())
+	}
+
+	return nil
+}
+
+// WaitForStatus 等待索引的健康状态达到status（green/yellow），超时返回错误
+func (i *indexClient) WaitForStatus(index string, status string, timeout time.Duration) error {
+
+	req := esapi.ClusterHealthRequest{
+		Index:         []string{index},
+		WaitForStatus: status,
+		Timeout:       timeout,
+	}
+
+	res, err := req.Do(context.Background(), i.es)
+	if err != nil {
+		return fmt.Errorf("WaitForStatus error getting response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("WaitForStatus error response: %s", res.String())
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return fmt.Errorf("WaitForStatus error parsing the response body: %w", err)
+	}
+
+	if timedOut, _ := data["timed_out"].(bool); timedOut {
+		return fmt.Errorf("WaitForStatus timeout! index:%s, expect:%s, actual:%v", index, status, data["status"])
+	}
+	return nil
+}
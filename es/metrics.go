@@ -0,0 +1,40 @@
+package es
+
+import (
+	"elasticsearch-data-import-go/metrics"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	bulkIndexerStatsDesc = metrics.NewDesc("bulk_indexer_items_total",
+		"BulkIndexer cumulative item counters by stat (added, flushed, failed, indexed, created, updated, deleted).", "stat")
+	bulkIndexerRequestsDesc = metrics.NewDesc("bulk_indexer_requests_total",
+		"Bulk requests sent by the BulkIndexer.")
+)
+
+// bulkIndexerCollector 采集时读取BulkIndexer的累计统计
+type bulkIndexerCollector struct {
+	bi esutil.BulkIndexer
+}
+
+func (c bulkIndexerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bulkIndexerStatsDesc
+	ch <- bulkIndexerRequestsDesc
+}
+
+func (c bulkIndexerCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.bi.Stats()
+	for stat, value := range map[string]uint64{
+		"added":   stats.NumAdded,
+		"flushed": stats.NumFlushed,
+		"failed":  stats.NumFailed,
+		"indexed": stats.NumIndexed,
+		"created": stats.NumCreated,
+		"updated": stats.NumUpdated,
+		"deleted": stats.NumDeleted,
+	} {
+		ch <- prometheus.MustNewConstMetric(bulkIndexerStatsDesc, prometheus.CounterValue, float64(value), stat)
+	}
+	ch <- prometheus.MustNewConstMetric(bulkIndexerRequestsDesc, prometheus.CounterValue, float64(stats.NumRequests))
+}
@@ -0,0 +1,88 @@
+package es
+
+import (
+	"context"
+	"elasticsearch-data-import-go/metrics"
+	"sync"
+	"time"
+)
+
+// BulkObserver 批量写入的观察者，用于根据ES的反馈调整写入速度
+type BulkObserver interface {
+	// OnFlush 一次批量请求结束，indexes为请求中包含的索引，latency为请求耗时
+	// BulkIndexer是进程共用的，一次请求可能包含多个别名的索引
+	OnFlush(indexes []string, latency time.Duration)
+	// OnRejected 文档因ES繁忙被拒绝（429）
+	OnRejected(index string)
+}
+
+var (
+	observerLock sync.RWMutex
+	observers    []BulkObserver
+)
+
+// flushKey 批量请求信息在ctx中的key
+type flushKey struct{}
+
+// flushInfo 批量请求的开始时间和包含的索引，文档的回调与请求结束在不同的协程中
+type flushInfo struct {
+	start   time.Time
+	mu      sync.Mutex
+	indexes map[string]struct{}
+}
+
+// AddBulkObserver 添加批量写入的观察者
+func AddBulkObserver(observer BulkObserver) {
+	observerLock.Lock()
+	defer observerLock.Unlock()
+	observers = append(observers, observer)
+}
+
+// onFlushStart 记录批量请求开始时间
+func onFlushStart(ctx context.Context) context.Context {
+	return context.WithValue(ctx, flushKey{}, &flushInfo{start: time.Now(), indexes: make(map[string]struct{})})
+}
+
+// flushedIndex 记录批量请求包含的索引，由文档的OnSuccess和OnFailure回调调用，ctx为批量请求的ctx
+func flushedIndex(ctx context.Context, index string) {
+	info, ok := ctx.Value(flushKey{}).(*flushInfo)
+	if !ok {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.indexes[index] = struct{}{}
+}
+
+// onFlushEnd 统计批量请求耗时并通知观察者
+func onFlushEnd(ctx context.Context) {
+	info, ok := ctx.Value(flushKey{}).(*flushInfo)
+	if !ok {
+		return
+	}
+	latency := time.Since(info.start)
+	metrics.BulkLatency.Observe(latency.Seconds())
+
+	info.mu.Lock()
+	indexes := make([]string, 0, len(info.indexes))
+	for index := range info.indexes {
+		indexes = append(indexes, index)
+	}
+	info.mu.Unlock()
+
+	observerLock.RLock()
+	defer observerLock.RUnlock()
+	for _, observer := range observers {
+		observer.OnFlush(indexes, latency)
+	}
+}
+
+// notifyRejected 统计被拒绝的文档并通知观察者
+func notifyRejected(index string) {
+	metrics.BulkRejected.WithLabelValues(index).Inc()
+	observerLock.RLock()
+	defer observerLock.RUnlock()
+	for _, observer := range observers {
+		observer.OnRejected(index)
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
-	userRebuildController "elasticsearch-data-import-go/web/controller/rebuild/user"
+	"elasticsearch-data-import-go/metrics"
+	"elasticsearch-data-import-go/rebuild"
+	_ "elasticsearch-data-import-go/rebuild/user"
+	rebuildController "elasticsearch-data-import-go/web/controller/rebuild"
 	userController "elasticsearch-data-import-go/web/controller/user"
 	"net/http"
 )
 
+// dispatcherWorkers 每个节点同时执行的分片数量
+const dispatcherWorkers = 4
+
 func main() {
 
 	server := http.Server{
@@ -14,16 +20,23 @@ func main() {
 	}
 
 	//用户信息维护
-	http.HandleFunc("/user/create", userController.Create)
-	http.HandleFunc("/user/batchCreate", userController.BatchCreate)
-	http.HandleFunc("/user/update", userController.Update)
-	http.HandleFunc("/user/search", userController.Search)
-	http.HandleFunc("/user/searchById", userController.SearchById)
-
-	http.HandleFunc("/user/rebuild/fullRebuild", userRebuildController.FullRebuild)
-	http.HandleFunc("/user/rebuild/partRebuild", userRebuildController.PartRebuild)
-	http.HandleFunc("/user/rebuild/partReload", userRebuildController.PartReload)
-	http.HandleFunc("/user/rebuild/partImport", userRebuildController.PartImport)
+	http.HandleFunc("/user/create", metrics.Instrument("/user/create", userController.Create))
+	http.HandleFunc("/user/batchCreate", metrics.Instrument("/user/batchCreate", userController.BatchCreate))
+	http.HandleFunc("/user/update", metrics.Instrument("/user/update", userController.Update))
+	http.HandleFunc("/user/search", metrics.Instrument("/user/search", userController.Search))
+	http.HandleFunc("/user/searchById", metrics.Instrument("/user/searchById", userController.SearchById))
+
+	//全量索引，按照别名分发到注册的Rebuild实现
+	http.HandleFunc(rebuildController.RoutePath, metrics.Instrument(rebuildController.RoutePath, rebuildController.List))
+	http.HandleFunc(rebuildController.RoutePrefix, rebuildController.Route)
+
+	//Prometheus指标
+	http.Handle("/metrics", metrics.Handler())
+
+	//领取分片任务的worker
+	rebuild.Dispatcher.Run(dispatcherWorkers)
+	//定时任务，同一次触发只在一个节点执行
+	rebuild.Scheduler.Run()
 
 	server.ListenAndServe()
 
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// namespace 所有指标的前缀
+	namespace = "data_import"
+
+	// DocSuccess 文档写入成功
+	DocSuccess = "success"
+	// DocFailed 文档写入失败
+	DocFailed = "failed"
+	// DocConflict 文档版本冲突跳过
+	DocConflict = "conflict"
+)
+
+var (
+	// DocsIndexed 按别名、索引、结果统计的文档数量
+	DocsIndexed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "docs_indexed_total",
+		Help:      "Documents written by alias, index and result (success, failed, conflict).",
+	}, []string{"alias", "index", "result"})
+
+	// BulkLatency BulkIndexer每次批量请求的耗时
+	BulkLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bulk_request_duration_seconds",
+		Help:      "Latency of bulk requests flushed by the BulkIndexer.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	// BulkBatchDocs 每次提交给BulkIndexer的批次文档数量
+	BulkBatchDocs = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bulk_batch_docs",
+		Help:      "Number of documents per batch handed to the BulkIndexer.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"index"})
+
+	// BulkBatchBytes 每次提交给BulkIndexer的批次字节数
+	BulkBatchBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bulk_batch_bytes",
+		Help:      "Encoded size in bytes of batches handed to the BulkIndexer.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"index"})
+
+	// BulkRejected 被ES拒绝（429）的文档数量
+	BulkRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bulk_rejected_total",
+		Help:      "Bulk items rejected by Elasticsearch with 429.",
+	}, []string{"index"})
+
+	// LockAttempts 获取分布式锁的次数
+	LockAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lock_attempts_total",
+		Help:      "Redis lock acquire attempts by lock name.",
+	}, []string{"lock"})
+
+	// LockFailures 获取分布式锁失败的次数
+	LockFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lock_failures_total",
+		Help:      "Redis lock acquire failures by lock name.",
+	}, []string{"lock"})
+
+	// LockWait 获取分布式锁的耗时
+	LockWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent acquiring a Redis lock, successful or not.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+	}, []string{"lock"})
+
+	// SliceDuration 分片的执行耗时
+	SliceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "slice_duration_seconds",
+		Help:      "Duration of rebuild slices by alias and status (succeeded, failed, reassigned).",
+		Buckets:   prometheus.ExponentialBuckets(1, 3, 10),
+	}, []string{"alias", "status"})
+
+	// RecordsBuffered 全量期间缓存的增量数据数量
+	RecordsBuffered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_buffered_total",
+		Help:      "Incremental records buffered while a rebuild is running.",
+	}, []string{"alias"})
+
+	// HttpLatency 按路由统计的接口耗时
+	HttpLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(DocsIndexed, BulkLatency, BulkBatchDocs, BulkBatchBytes, BulkRejected,
+		LockAttempts, LockFailures, LockWait, SliceDuration, RecordsBuffered, HttpLatency)
+}
+
+// MustRegister 注册自定义的采集器，如在采集时读取的统计
+func MustRegister(collectors ...prometheus.Collector) {
+	prometheus.MustRegister(collectors...)
+}
+
+// NewDesc 创建自定义采集器的指标描述，自动加上统一的前缀
+func NewDesc(name string, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+}
+
+// Handler /metrics接口
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// LockName 锁的指标名称，去掉key中#分隔的分片等细节，避免标签过多
+func LockName(key string) string {
+	if i := strings.Index(key, "#"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// statusWriter 记录响应码的ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Instrument 统计接口耗时，route为指标中的路由名称
+func Instrument(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+		HttpLatency.WithLabelValues(route, r.Method, strconv.Itoa(sw.status)).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,159 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"strings"
+)
+
+const (
+	// recordField 增量数据在stream消息中的字段
+	recordField = "record"
+	// recordGroup 回放增量数据的消费组
+	recordGroup = "replay"
+	// replayRetries 回放失败的增量数据重试次数
+	replayRetries = 3
+)
+
+var (
+	RecordBuffer = recordBuffer{client.RedisClient}
+)
+
+// dropEmptyScript 回放结束后缓存为空时删除，回放期间追加的数据保留到过期
+var dropEmptyScript = redis.NewScript(`
+if redis.call('xlen', KEYS[1]) == 0 then
+	return redis.call('del', KEYS[1])
+end
+return 0
+`)
+
+// recordBuffer 全量索引期间的增量数据缓存
+// 以别名和任务为维度保存在redis stream中，任意节点都可以写入，切换别名后由执行切换的节点通过消费组回放并确认
+type recordBuffer struct {
+	rdb *redis.Client
+}
+
+// Append 缓存增量数据
+func (b recordBuffer) Append(alias string, jobId string, record *Record) error {
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("record buffer append fail! alias:%s, id:%s, error:%v", alias, record.Id, err)
+	}
+
+	ctx := context.Background()
+	bufferKey := key.RecordBufferRedisKey.MakeRedisKey(alias, jobId)
+	_, err = b.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: bufferKey,
+			Values: map[string]interface{}{recordField: string(data)},
+		})
+		pipe.Expire(ctx, bufferKey, key.RecordBufferRedisKey.GetExpire())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("record buffer append fail! alias:%s, id:%s, error:%v", alias, record.Id, err)
+	}
+	return nil
+}
+
+// Size 缓存的增量数据数量
+func (b recordBuffer) Size(alias string, jobId string) (int64, error) {
+	return b.rdb.XLen(context.Background(), key.RecordBufferRedisKey.MakeRedisKey(alias, jobId)).Result()
+}
+
+// Clear 删除缓存的增量数据
+func (b recordBuffer) Clear(alias string, jobId string) error {
+	return b.rdb.Del(context.Background(), key.RecordBufferRedisKey.MakeRedisKey(alias, jobId)).Err()
+}
+
+// Drain 回放缓存的增量数据，handle成功后确认并删除消息，失败的消息重试replayRetries次
+// 任务结束后调用，读取到空为止；任务结束后写入的增量数据由PartImport直接写入新索引，
+// 因此只删除已确认的消息，不删除整个缓存，返回成功和失败的数量
+func (b recordBuffer) Drain(alias string, jobId string, batch int64, handle func(record Record) error) (handled int, failed int, err error) {
+
+	ctx := context.Background()
+	bufferKey := key.RecordBufferRedisKey.MakeRedisKey(alias, jobId)
+
+	err = b.rdb.XGroupCreateMkStream(ctx, bufferKey, recordGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return 0, 0, fmt.Errorf("record buffer drain fail! alias:%s, jobId:%s, error:%v", alias, jobId, err)
+	}
+
+	//先读取未投递的消息，再重试本节点未确认的消息
+	for round := 0; round <= replayRetries; round++ {
+		start := ">"
+		if round > 0 {
+			start = "0"
+		}
+
+		failed = 0
+		for {
+			streams, err := b.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    recordGroup,
+				Consumer: nodeId,
+				Streams:  []string{bufferKey, start},
+				Count:    batch,
+				Block:    -1,
+			}).Result()
+			if err == redis.Nil {
+				break
+			} else if err != nil {
+				return handled, failed, fmt.Errorf("record buffer drain fail! alias:%s, jobId:%s, error:%v", alias, jobId, err)
+			}
+
+			messages := streams[0].Messages
+			if len(messages) == 0 {
+				break
+			}
+
+			var lastId string
+			for _, message := range messages {
+				lastId = message.ID
+				if b.replay(alias, message, handle) {
+					b.rdb.XAck(ctx, bufferKey, recordGroup, message.ID)
+					b.rdb.XDel(ctx, bufferKey, message.ID)
+					handled++
+				} else {
+					failed++
+				}
+			}
+
+			//重试时按id向后读取本节点未确认的消息
+			if start != ">" {
+				start = lastId
+			}
+		}
+
+		if failed == 0 {
+			break
+		}
+	}
+
+	if failed == 0 {
+		dropEmptyScript.Run(ctx, b.rdb, []string{bufferKey})
+	}
+	return handled, failed, nil
+}
+
+// replay 回放一条增量数据，无法解析的消息直接确认
+func (b recordBuffer) replay(alias string, message redis.XMessage, handle func(record Record) error) bool {
+
+	value, _ := message.Values[recordField].(string)
+	var record Record
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		log.Printf("record buffer replay skip! can not parse record! alias:%s, messageId:%s, error:%v", alias, message.ID, err)
+		return true
+	}
+
+	if err := handle(record); err != nil {
+		log.Printf("record buffer replay fail! alias:%s, id:%s, error:%v", alias, record.Id, err)
+		return false
+	}
+	return true
+}
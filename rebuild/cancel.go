@@ -0,0 +1,183 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"fmt"
+	uuid "github.com/satori/go.uuid"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// cancelWaitTimeout 取消后等待所有分片停止的超时时间
+	cancelWaitTimeout = 30 * time.Second
+)
+
+// runningSlice 当前节点运行中的分片
+type runningSlice struct {
+	jobId  string
+	slice  int
+	ctx    context.Context
+	cancel context.CancelFunc
+	//分片本次运行的持有者标识
+	owner string
+	//分片是否已被重新分配给其他节点
+	reassigned int32
+	//分片开始运行的时间
+	start time.Time
+}
+
+// startSlice 记录分片开始运行并定时上报心跳，返回分片运行的上下文，分片结束时调用stopSlice
+func (r *RebuildHandler) startSlice(jobId string, slice int) *runningSlice {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	running := &runningSlice{
+		jobId:  jobId,
+		slice:  slice,
+		ctx:    ctx,
+		cancel: cancel,
+		owner:  nodeId + "#" + strings.ReplaceAll(uuid.NewV4().String(), "-", ""),
+		start:  time.Now(),
+	}
+
+	r.runningLock.Lock()
+	r.running[running] = struct{}{}
+	r.runningLock.Unlock()
+
+	Jobs.SliceRunning(jobId, slice)
+	if err := Jobs.ClaimSlice(jobId, slice, running.owner); err != nil {
+		log.Printf("startSlice claim slice fail! %v", err)
+	}
+	go r.heartbeat(running)
+
+	return running
+}
+
+// stopSlice 分片结束，停止心跳并取消上下文
+func (r *RebuildHandler) stopSlice(running *runningSlice) {
+	r.runningLock.Lock()
+	delete(r.running, running)
+	r.runningLock.Unlock()
+	running.cancel()
+}
+
+// cancelLocal 取消当前节点上该任务的所有分片
+func (r *RebuildHandler) cancelLocal(jobId string) {
+	r.runningLock.Lock()
+	defer r.runningLock.Unlock()
+
+	for running := range r.running {
+		if running.jobId == jobId {
+			log.Printf("cancel slice! alias:%s, jobId:%s, slice:%d", r.alias(), jobId, running.slice)
+			running.cancel()
+		}
+	}
+}
+
+// listenCancel 订阅别名的取消广播
+func (r *RebuildHandler) listenCancel() {
+
+	alias := r.alias()
+	pubsub := client.RedisClient.Subscribe(context.Background(), key.CancelChannelRedisKey.MakeRedisKey(alias))
+	defer pubsub.Close()
+
+	for message := range pubsub.Channel() {
+		r.cancelLocal(message.Payload)
+	}
+	log.Printf("listenCancel stop! alias:%s", alias)
+}
+
+// Cancel 取消别名下运行中的全量任务
+// 广播取消到所有节点，等待分片停止后删除未完成的新索引并重置分片计数，别名保持不变
+func Cancel(alias string) (*Job, error) {
+
+	job, err := Jobs.Current(alias)
+	if err != nil {
+		return nil, fmt.Errorf("cancel fail! alias:%s, error:%v", alias, err)
+	}
+	if job == nil {
+		return nil, fmt.Errorf("cancel fail! alias:%s, no running job", alias)
+	}
+
+	ctx := context.Background()
+	//设置取消标识，晚于广播开始的分片和后置处理依赖该标识
+	cancelKey := key.CancelFlagRedisKey.MakeRedisKey(job.JobId)
+	if err := client.RedisClient.Set(ctx, cancelKey, 1, key.CancelFlagRedisKey.GetExpire()).Err(); err != nil {
+		return nil, fmt.Errorf("cancel fail! alias:%s, jobId:%s, error:%v", alias, job.JobId, err)
+	}
+	Jobs.Finish(job.JobId, JobCancelled, fmt.Errorf("cancelled"))
+
+	//广播取消
+	channel := key.CancelChannelRedisKey.MakeRedisKey(alias)
+	if err := client.RedisClient.Publish(ctx, channel, job.JobId).Err(); err != nil {
+		log.Printf("cancel publish fail! alias:%s, jobId:%s, error:%v", alias, job.JobId, err)
+	}
+
+	//等待分片停止
+	if !waitSlicesStop(job.JobId, cancelWaitTimeout) {
+		log.Printf("cancel wait slices stop timeout! alias:%s, jobId:%s", alias, job.JobId)
+	}
+
+	cleanCancelledJob(job)
+	return Jobs.Get(job.JobId)
+}
+
+// IsCancelled 任务是否已经被取消
+func IsCancelled(jobId string) bool {
+	count, err := client.RedisClient.Exists(context.Background(), key.CancelFlagRedisKey.MakeRedisKey(jobId)).Result()
+	if err != nil {
+		log.Printf("IsCancelled fail! jobId:%s, error:%v", jobId, err)
+		return false
+	}
+	return count > 0
+}
+
+// waitSlicesStop 等待任务的所有分片停止，分片不再是运行状态或心跳已超时时认为已经停止
+// 以任务中的分片状态为准，全量、PartRebuild和重新分配的分片都会更新分片状态
+func waitSlicesStop(jobId string, timeout time.Duration) bool {
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		job, err := Jobs.Get(jobId)
+		if err != nil {
+			log.Printf("waitSlicesStop get job fail! jobId:%s, error:%v", jobId, err)
+		} else if job == nil || !job.hasAliveSlice(time.Now()) {
+			return true
+		}
+		time.Sleep(time.Second)
+	}
+	return false
+}
+
+// cleanCancelledJob 清理被取消的任务，删除未挂载别名的新索引，清除位点和缓存的增量数据，分片计数已由Jobs.Finish删除
+func cleanCancelledJob(job *Job) {
+
+	for i := 0; i < job.TotalSlice; i++ {
+		if err := Checkpoint.Clear(job.Alias, job.JobId, i, job.TotalSlice); err != nil {
+			log.Printf("cleanCancelledJob clear checkpoint fail! %v", err)
+		}
+	}
+	var cache RecordCache = streamRecordCache{job.Alias}
+	if handler, ok := Registry.Get(job.Alias); ok {
+		cache = handler.recordCache()
+	}
+	if err := cache.ClearRecords(job.JobId); err != nil {
+		log.Printf("cleanCancelledJob clear record buffer fail! alias:%s, error:%v", job.Alias, err)
+	}
+
+	//新索引已经挂载别名时不删除
+	for _, index := range es.Alias.FindIndexNameByAlias(job.Alias) {
+		if index == job.IndexName {
+			log.Printf("cleanCancelledJob skip delete index, index is serving! alias:%s, index:%s", job.Alias, index)
+			return
+		}
+	}
+
+	if es.Index.Exists(job.IndexName) && !es.Index.Delete(job.IndexName) {
+		log.Printf("cleanCancelledJob delete index fail! alias:%s, index:%s", job.Alias, job.IndexName)
+	}
+}
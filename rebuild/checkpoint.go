@@ -0,0 +1,210 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"sync"
+)
+
+const (
+	// checkpointerParam args中保存分片位点提交器的参数名
+	checkpointerParam = "checkpointer"
+)
+
+var (
+	Checkpoint = checkpointStore{client.RedisClient}
+)
+
+// checkpointStore 分片位点存储，保存每个分片最后一次成功刷入ES的位点
+type checkpointStore struct {
+	rdb *redis.Client
+}
+
+// commitScript 分片仍由owner持有时提交位点，owner为空或分片没有持有者时不检查，持有者不一致返回0
+var commitScript = redis.NewScript(`
+if ARGV[1] ~= '' then
+	local current = redis.call('hget', KEYS[2], ARGV[2])
+	if current and current ~= ARGV[1] then
+		return 0
+	end
+end
+redis.call('set', KEYS[1], ARGV[3], 'px', ARGV[4])
+return 1
+`)
+
+// Commit 提交分片位点，owner为分片本次运行的持有者，分片已被重新分配时不提交并返回错误
+func (c checkpointStore) Commit(alias string, job string, currentSlice int, totalSlice int, owner string, position string) error {
+	keys := []string{key.CheckpointRedisKey.MakeRedisKey(alias, job, currentSlice, totalSlice), key.JobRedisKey.MakeRedisKey(job)}
+	expire := key.CheckpointRedisKey.GetExpire().Milliseconds()
+	committed, err := commitScript.Run(context.Background(), c.rdb, keys, owner, sliceStatsField(currentSlice, sliceOwnerField), position, expire).Int()
+	if err != nil {
+		return fmt.Errorf("checkpoint commit fail! alias:%s, job:%s, currentSlice:%d, totalSlice:%d, error:%v",
+			alias, job, currentSlice, totalSlice, err)
+	}
+	if committed == 0 {
+		return fmt.Errorf("checkpoint commit fail! slice is reassigned! alias:%s, job:%s, currentSlice:%d, totalSlice:%d, owner:%s",
+			alias, job, currentSlice, totalSlice, owner)
+	}
+	return nil
+}
+
+// Get 获取分片位点，不存在时返回空字符串
+func (c checkpointStore) Get(alias string, job string, currentSlice int, totalSlice int) (string, error) {
+	checkpointKey := key.CheckpointRedisKey.MakeRedisKey(alias, job, currentSlice, totalSlice)
+	position, err := c.rdb.Get(context.Background(), checkpointKey).Result()
+	if err == redis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("checkpoint get fail! alias:%s, job:%s, currentSlice:%d, totalSlice:%d, error:%v",
+			alias, job, currentSlice, totalSlice, err)
+	}
+	return position, nil
+}
+
+// Clear 清除分片位点
+func (c checkpointStore) Clear(alias string, job string, currentSlice int, totalSlice int) error {
+	checkpointKey := key.CheckpointRedisKey.MakeRedisKey(alias, job, currentSlice, totalSlice)
+	err := c.rdb.Del(context.Background(), checkpointKey).Err()
+	if err != nil {
+		return fmt.Errorf("checkpoint clear fail! alias:%s, job:%s, currentSlice:%d, totalSlice:%d, error:%v",
+			alias, job, currentSlice, totalSlice, err)
+	}
+	return nil
+}
+
+// Checkpointer 分片位点提交器，同时负责上报分片的文档统计
+// 批量写入是异步刷入ES的，后提交的批次可能先完成，这里只提交已经连续完成的最大位点，保证续跑时不会漏数据
+type Checkpointer struct {
+	alias        string
+	job          string
+	currentSlice int
+	totalSlice   int
+	position     string
+	// owner 分片本次运行的持有者，分片被重新分配后不再提交位点
+	owner string
+	// dryRun 试运行统计，不为空时表示试运行
+	dryRun *dryRun
+
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	next     int64
+	commit   int64
+	finished map[int64]string
+}
+
+// NewCheckpointer 创建分片位点提交器，position为续跑的起始位点
+func NewCheckpointer(alias string, job string, currentSlice int, totalSlice int, position string) *Checkpointer {
+	return &Checkpointer{
+		alias:        alias,
+		job:          job,
+		currentSlice: currentSlice,
+		totalSlice:   totalSlice,
+		position:     position,
+		finished:     make(map[int64]string),
+	}
+}
+
+// Position 获取当前位点，为空表示从头开始
+func (c *Checkpointer) Position() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.position
+}
+
+// Read 上报从数据源读取的数据条数，Pipeline每读取一页调用一次，自定义Handle的数据源读取后调用
+func (c *Checkpointer) Read(rows int) {
+	Jobs.AddRead(c.job, c.currentSlice, rows)
+}
+
+// Track 登记一个批次，返回值作为es.Document.BatchSaveWithCallback的回调，批次刷入ES后提交位点
+// position为该批次最后一条数据的位点
+func (c *Checkpointer) Track(position string) es.BatchCallback {
+	callback, _ := c.track(position)
+	return callback
+}
+
+// track 登记一个批次，返回批次完成的回调和放弃该批次的函数，两者只能调用其中一个
+// 放弃的批次不会提交位点，之后的批次也不会越过它提交
+func (c *Checkpointer) track(position string) (es.BatchCallback, func()) {
+	c.mu.Lock()
+	sequence := c.next
+	c.next++
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+	callback := func(result *es.BatchResult) {
+		defer c.wg.Done()
+		//累加任务统计
+		Jobs.AddStats(c.job, c.currentSlice, result)
+		if c.dryRun != nil {
+			c.dryRun.written(result)
+		}
+		//重试后仍然失败的文档保存为死信，位点照常提交
+		if c.alias != "" {
+			recordDocs(c.alias, result)
+			if err := DeadLetters.Add(c.alias, c.job, result.Failed); err != nil {
+				log.Printf("Checkpointer add dead letters fail! %v", err)
+			}
+		}
+		c.finish(sequence, position)
+	}
+	return callback, c.wg.Done
+}
+
+// Wait 等待所有已登记的批次刷入ES
+func (c *Checkpointer) Wait() {
+	c.wg.Wait()
+}
+
+// finish 批次完成，提交连续完成的最大位点
+func (c *Checkpointer) finish(sequence int64, position string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.finished[sequence] = position
+	var last string
+	for {
+		p, ok := c.finished[c.commit]
+		if !ok {
+			break
+		}
+		delete(c.finished, c.commit)
+		c.commit++
+		last = p
+	}
+
+	if last == "" {
+		return
+	}
+
+	c.position = last
+	if c.alias == "" {
+		return
+	}
+	if err := Checkpoint.Commit(c.alias, c.job, c.currentSlice, c.totalSlice, c.owner, last); err != nil {
+		log.Printf("Checkpointer finish fail! %v", err)
+	}
+}
+
+// GetCheckpointer 从args中获取RebuildHandler创建的分片位点提交器，不存在时返回一个不续跑的提交器
+func GetCheckpointer(args map[string]interface{}) *Checkpointer {
+	if checkpointer, ok := args[checkpointerParam].(*Checkpointer); ok {
+		return checkpointer
+	}
+	return NewCheckpointer("", "", 0, 0, "")
+}
+
+// withCheckpointer 复制args并写入分片位点提交器
+func withCheckpointer(args map[string]interface{}, checkpointer *Checkpointer) map[string]interface{} {
+	newArgs := make(map[string]interface{}, len(args)+1)
+	for k, v := range args {
+		newArgs[k] = v
+	}
+	newArgs[checkpointerParam] = checkpointer
+	return newArgs
+}
@@ -0,0 +1,184 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// maxDeadLetters 每个别名最多保存的死信数量
+	maxDeadLetters = 10000
+)
+
+var (
+	DeadLetters = deadLetterStore{client.RedisClient}
+)
+
+// DeadLetter 重试后仍然写入失败的文档
+type DeadLetter struct {
+	es.FailedItem
+	Alias string `json:"alias"`
+	JobId string `json:"jobId"`
+	Time  int64  `json:"time"`
+}
+
+// RedriveResult 死信重新导入的结果
+type RedriveResult struct {
+	Redriven int               `json:"redriven"`
+	Failed   map[string]string `json:"failed"`
+}
+
+// deadLetterStore 死信保存在以别名为key的hash中，field为文档id，同一文档只保留最后一次失败
+type deadLetterStore struct {
+	rdb *redis.Client
+}
+
+// Add 保存死信，超过maxDeadLetters时丢弃
+func (s deadLetterStore) Add(alias string, jobId string, items []*es.FailedItem) error {
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	deadLetterKey := key.DeadLetterRedisKey.MakeRedisKey(alias)
+	size, err := s.rdb.HLen(ctx, deadLetterKey).Result()
+	if err != nil {
+		return fmt.Errorf("dead letter add fail! alias:%s, error:%v", alias, err)
+	}
+	if size >= maxDeadLetters {
+		log.Printf("dead letter add skip! too many dead letters! alias:%s, size:%d, dropped:%d", alias, size, len(items))
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	values := make(map[string]interface{}, len(items))
+	for _, item := range items {
+		data, err := json.Marshal(&DeadLetter{FailedItem: *item, Alias: alias, JobId: jobId, Time: now})
+		if err != nil {
+			return fmt.Errorf("dead letter add fail! alias:%s, id:%s, error:%v", alias, item.Id, err)
+		}
+		values[item.Id] = string(data)
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, deadLetterKey, values)
+		pipe.Expire(ctx, deadLetterKey, key.DeadLetterRedisKey.GetExpire())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("dead letter add fail! alias:%s, error:%v", alias, err)
+	}
+	return nil
+}
+
+// Get 获取文档的死信，不存在时返回nil
+func (s deadLetterStore) Get(alias string, id string) (*DeadLetter, error) {
+
+	data, err := s.rdb.HGet(context.Background(), key.DeadLetterRedisKey.MakeRedisKey(alias), id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("dead letter get fail! alias:%s, id:%s, error:%v", alias, id, err)
+	}
+
+	var letter DeadLetter
+	if err := json.Unmarshal([]byte(data), &letter); err != nil {
+		return nil, fmt.Errorf("dead letter get fail! alias:%s, id:%s, error:%v", alias, id, err)
+	}
+	return &letter, nil
+}
+
+// List 获取别名的死信，按失败时间倒序，limit不大于0时返回全部
+func (s deadLetterStore) List(alias string, limit int) ([]*DeadLetter, error) {
+
+	values, err := s.rdb.HGetAll(context.Background(), key.DeadLetterRedisKey.MakeRedisKey(alias)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("dead letter list fail! alias:%s, error:%v", alias, err)
+	}
+
+	letters := make([]*DeadLetter, 0, len(values))
+	for id, data := range values {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(data), &letter); err != nil {
+			log.Printf("dead letter list skip! alias:%s, id:%s, error:%v", alias, id, err)
+			continue
+		}
+		letters = append(letters, &letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].Time != letters[j].Time {
+			return letters[i].Time > letters[j].Time
+		}
+		return letters[i].Id < letters[j].Id
+	})
+	if limit > 0 && len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+// Remove 删除死信
+func (s deadLetterStore) Remove(alias string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.rdb.HDel(context.Background(), key.DeadLetterRedisKey.MakeRedisKey(alias), ids...).Err()
+}
+
+// Redrive 通过PartImport重新导入死信，成功后删除死信，ids为空时重新导入全部死信
+func Redrive(alias string, ids []string) (*RedriveResult, error) {
+
+	handler, ok := Registry.Get(alias)
+	if !ok {
+		return nil, fmt.Errorf("redrive fail! alias %s is not registered", alias)
+	}
+
+	var letters []*DeadLetter
+	if len(ids) == 0 {
+		all, err := DeadLetters.List(alias, 0)
+		if err != nil {
+			return nil, err
+		}
+		letters = all
+	} else {
+		for _, id := range ids {
+			letter, err := DeadLetters.Get(alias, id)
+			if err != nil {
+				return nil, err
+			}
+			if letter != nil {
+				letters = append(letters, letter)
+			}
+		}
+	}
+
+	result := &RedriveResult{Failed: make(map[string]string)}
+	for _, letter := range letters {
+		record := Record{Id: letter.Id, Op: OpIndex}
+		if letter.Action == "delete" {
+			record.Op = OpDelete
+		}
+
+		if err := handler.PartImport(record, make(map[string]interface{})); err != nil {
+			result.Failed[letter.Id] = err.Error()
+			continue
+		}
+		if err := DeadLetters.Remove(alias, letter.Id); err != nil {
+			log.Printf("redrive remove dead letter fail! alias:%s, id:%s, error:%v", alias, letter.Id, err)
+		}
+		result.Redriven++
+	}
+
+	log.Printf("redrive finish! alias:%s, redriven:%d, failed:%d", alias, result.Redriven, len(result.Failed))
+	return result, nil
+}
@@ -0,0 +1,216 @@
+package rebuild
+
+import (
+	"crypto/sha256"
+	"elasticsearch-data-import-go/es"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// definitionMetaVersion 索引_meta中记录的定义版本
+	definitionMetaVersion = "definition_version"
+	// definitionMetaHash 索引_meta中记录的定义摘要
+	definitionMetaHash = "definition_hash"
+)
+
+var (
+	// DefinitionDir 索引定义文件目录，相对于工作目录，文件名为 {alias}.json
+	DefinitionDir = "definitions"
+)
+
+// Definition 索引定义，包括settings（含analysis）和mappings
+type Definition struct {
+	Alias    string                 `json:"-"`
+	Version  int                    `json:"version"`
+	Settings map[string]interface{} `json:"settings"`
+	Mappings map[string]interface{} `json:"mappings"`
+}
+
+// LoadDefinition 从DefinitionDir加载别名的索引定义
+func LoadDefinition(alias string) (*Definition, error) {
+	return LoadDefinitionFile(alias, filepath.Join(DefinitionDir, alias+".json"))
+}
+
+// LoadDefinitionFile 从指定文件加载索引定义
+func LoadDefinitionFile(alias string, path string) (*Definition, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load definition fail! alias:%s, path:%s, error:%v", alias, path, err)
+	}
+
+	var definition Definition
+	if err := json.Unmarshal(data, &definition); err != nil {
+		return nil, fmt.Errorf("load definition fail! alias:%s, path:%s, error:%v", alias, path, err)
+	}
+	if definition.Version <= 0 {
+		return nil, fmt.Errorf("load definition fail! alias:%s, path:%s, version must be positive", alias, path)
+	}
+	if definition.Mappings == nil {
+		return nil, fmt.Errorf("load definition fail! alias:%s, path:%s, mappings is empty", alias, path)
+	}
+
+	definition.Alias = alias
+	return &definition, nil
+}
+
+// Hash 索引定义的摘要，settings或mappings变化时摘要变化
+func (d *Definition) Hash() string {
+	//map序列化时按key排序，相同的定义得到相同的摘要
+	data, _ := json.Marshal(map[string]interface{}{
+		"settings": d.Settings,
+		"mappings": d.Mappings,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Body 创建索引的请求体，mappings的_meta中记录定义的版本和摘要
+func (d *Definition) Body() map[string]interface{} {
+
+	mappings := make(map[string]interface{}, len(d.Mappings)+1)
+	for k, v := range d.Mappings {
+		mappings[k] = v
+	}
+	mappings["_meta"] = map[string]interface{}{
+		definitionMetaVersion: d.Version,
+		definitionMetaHash:    d.Hash(),
+	}
+
+	body := map[string]interface{}{
+		"mappings": mappings,
+	}
+	if d.Settings != nil {
+		body["settings"] = d.Settings
+	}
+	return body
+}
+
+// Drift 线上索引与索引定义的差异
+type Drift struct {
+	Alias             string `json:"alias"`
+	IndexName         string `json:"indexName"`
+	DefinitionVersion int    `json:"definitionVersion"`
+	IndexVersion      int    `json:"indexVersion"`
+	// DefinitionChanged 索引不是由当前的定义创建的，需要重建索引
+	DefinitionChanged bool `json:"definitionChanged"`
+	// Missing 定义中有，索引中没有的字段
+	Missing []string `json:"missing"`
+	// Changed 类型不一致的字段
+	Changed []string `json:"changed"`
+	// Undeclared 索引中有，定义中没有的字段，通常由动态mapping产生
+	Undeclared []string `json:"undeclared"`
+}
+
+// HasDrift 是否存在差异
+func (d *Drift) HasDrift() bool {
+	return d.DefinitionChanged || len(d.Missing) > 0 || len(d.Changed) > 0 || len(d.Undeclared) > 0
+}
+
+// CheckDrift 比较别名当前索引的mapping与索引定义
+// 索引不是由当前定义创建时，在别名上标记需要重建
+func CheckDrift(alias string) (*Drift, error) {
+
+	definition, err := LoadDefinition(alias)
+	if err != nil {
+		return nil, err
+	}
+
+	indexName := currentIndex(alias)
+	if indexName == "" {
+		return nil, fmt.Errorf("check drift fail! alias:%s, alias has no index", alias)
+	}
+
+	mapping, err := es.Index.GetMapping(indexName)
+	if err != nil {
+		return nil, fmt.Errorf("check drift fail! alias:%s, index:%s, error:%v", alias, indexName, err)
+	}
+
+	drift := &Drift{
+		Alias:             alias,
+		IndexName:         indexName,
+		DefinitionVersion: definition.Version,
+	}
+
+	var indexHash string
+	if meta, ok := mapping["_meta"].(map[string]interface{}); ok {
+		if version, ok := meta[definitionMetaVersion].(float64); ok {
+			drift.IndexVersion = int(version)
+		}
+		indexHash, _ = meta[definitionMetaHash].(string)
+	}
+	drift.DefinitionChanged = indexHash != definition.Hash()
+	drift.Missing, drift.Changed, drift.Undeclared = CompareMappings(definition.Mappings, mapping)
+
+	if drift.DefinitionChanged {
+		reason := fmt.Sprintf("definition changed! index %s version %d, definition version %d",
+			indexName, drift.IndexVersion, drift.DefinitionVersion)
+		if err := Jobs.MarkRebuildRequired(alias, reason); err != nil {
+			return drift, err
+		}
+	}
+
+	return drift, nil
+}
+
+// CompareMappings 比较定义的mapping与线上索引的mapping，字段名使用点号连接的完整路径
+func CompareMappings(declared map[string]interface{}, actual map[string]interface{}) (missing []string, changed []string, undeclared []string) {
+
+	declaredFields := make(map[string]string)
+	flattenProperties("", declared, declaredFields)
+	actualFields := make(map[string]string)
+	flattenProperties("", actual, actualFields)
+
+	for field, declaredType := range declaredFields {
+		actualType, ok := actualFields[field]
+		if !ok {
+			missing = append(missing, field)
+		} else if actualType != declaredType {
+			changed = append(changed, fmt.Sprintf("%s: declared %s, actual %s", field, declaredType, actualType))
+		}
+	}
+	for field := range actualFields {
+		if _, ok := declaredFields[field]; !ok {
+			undeclared = append(undeclared, field)
+		}
+	}
+
+	sort.Strings(missing)
+	sort.Strings(changed)
+	sort.Strings(undeclared)
+	return missing, changed, undeclared
+}
+
+// flattenProperties 展开mapping的properties和fields，记录字段的类型
+func flattenProperties(prefix string, mapping map[string]interface{}, fields map[string]string) {
+
+	properties, _ := mapping["properties"].(map[string]interface{})
+	for name, value := range properties {
+		field, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		fieldType, _ := field["type"].(string)
+		if fieldType == "" {
+			fieldType = "object"
+		}
+		fields[path] = fieldType
+
+		flattenProperties(path, field, fields)
+		//多字段，例如 name.keyword
+		if multiFields, ok := field["fields"].(map[string]interface{}); ok {
+			flattenProperties(path, map[string]interface{}{"properties": multiFields}, fields)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"elasticsearch-data-import-go/redis/lock"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	uuid "github.com/satori/go.uuid"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TaskFullRebuild 分片任务类型，执行FullRebuild
+	TaskFullRebuild = "fullRebuild"
+	// TaskPartRebuild 分片任务类型，执行PartRebuild，从分片位点继续处理
+	TaskPartRebuild = "partRebuild"
+
+	// claimTimeout 领取分片任务的阻塞时间
+	claimTimeout = 5 * time.Second
+	// heartbeatInterval 续租间隔，小于租约时间
+	heartbeatInterval = 10 * time.Second
+	// reapInterval 检查租约过期的间隔
+	reapInterval = 15 * time.Second
+)
+
+var (
+	// nodeId 当前节点标识
+	nodeId = strings.ReplaceAll(uuid.NewV4().String(), "-", "")
+
+	Dispatcher = &dispatcher{
+		rdb: client.RedisClient,
+	}
+)
+
+// SliceTask 分片任务
+type SliceTask struct {
+	TaskId       string                 `json:"taskId"`
+	Type         string                 `json:"type"`
+	Alias        string                 `json:"alias"`
+	CurrentSlice int                    `json:"currentSlice"`
+	TotalSlice   int                    `json:"totalSlice"`
+	Args         map[string]interface{} `json:"args"`
+	Attempts     int                    `json:"attempts"`
+	SubmitTime   int64                  `json:"submitTime"`
+}
+
+// dispatcher 分片任务调度
+// 分片任务保存在redis队列中，每个节点的worker领取任务后移动到处理中队列并持有租约，
+// 节点宕机后租约过期，任务重新入队，由其他节点以PartRebuild的方式继续处理
+type dispatcher struct {
+	rdb  *redis.Client
+	once sync.Once
+}
+
+// Submit 提交一次分布式全量索引，每个分片生成一个任务放入队列
+func (d *dispatcher) Submit(alias string, totalSlice int, args map[string]interface{}) ([]*SliceTask, error) {
+
+	if _, ok := Registry.Get(alias); !ok {
+		return nil, fmt.Errorf("dispatcher submit fail! alias %s is not registered", alias)
+	}
+
+	if totalSlice <= 0 {
+		return nil, fmt.Errorf("dispatcher submit fail! alias:%s, invalid totalSlice:%d", alias, totalSlice)
+	}
+
+	//任务由第一个开始的分片创建，提交后到任务创建前持有提交锁，防止同一别名重复提交
+	lockKey := key.SubmitLockRedisKey.MakeRedisKey(alias)
+	if !lock.RedisLockHandler.Lock(lockKey, lock.RedisLockHandler.GetRequestId(), key.SubmitLockRedisKey.GetExpire()) {
+		return nil, fmt.Errorf("dispatcher submit fail! alias:%s, submitted tasks are waiting to start", alias)
+	}
+
+	if job, err := Jobs.Current(alias); err != nil {
+		d.release(alias)
+		return nil, fmt.Errorf("dispatcher submit fail! alias:%s, error:%v", alias, err)
+	} else if job != nil {
+		d.release(alias)
+		return nil, fmt.Errorf("dispatcher submit fail! alias:%s, job %s is running", alias, job.JobId)
+	}
+
+	now := time.Now().UnixMilli()
+	tasks := make([]*SliceTask, 0, totalSlice)
+	values := make([]interface{}, 0, totalSlice)
+	for i := 0; i < totalSlice; i++ {
+		task := &SliceTask{
+			TaskId:       strings.ReplaceAll(uuid.NewV4().String(), "-", ""),
+			Type:         TaskFullRebuild,
+			Alias:        alias,
+			CurrentSlice: i,
+			TotalSlice:   totalSlice,
+			Args:         args,
+			SubmitTime:   now,
+		}
+		data, err := json.Marshal(task)
+		if err != nil {
+			d.release(alias)
+			return nil, fmt.Errorf("dispatcher submit fail! alias:%s, error:%v", alias, err)
+		}
+		tasks = append(tasks, task)
+		values = append(values, string(data))
+	}
+
+	if err := d.rdb.LPush(context.Background(), key.SliceQueueRedisKey.GetKey(), values...).Err(); err != nil {
+		d.release(alias)
+		return nil, fmt.Errorf("dispatcher submit fail! alias:%s, error:%v", alias, err)
+	}
+
+	log.Printf("dispatcher submit success! alias:%s, totalSlice:%d", alias, totalSlice)
+	return tasks, nil
+}
+
+// release 释放别名的提交锁，任务创建后或提交失败时调用
+func (d *dispatcher) release(alias string) {
+	if err := d.rdb.Del(context.Background(), key.SubmitLockRedisKey.MakeRedisKey(alias)).Err(); err != nil {
+		log.Printf("dispatcher release submit lock fail! alias:%s, error:%v", alias, err)
+	}
+}
+
+// Requeue 将分片任务重新放入队列
+func (d *dispatcher) Requeue(task *SliceTask) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("dispatcher requeue fail! alias:%s, slice:%d, error:%v", task.Alias, task.CurrentSlice, err)
+	}
+	if err := d.rdb.LPush(context.Background(), key.SliceQueueRedisKey.GetKey(), string(data)).Err(); err != nil {
+		return fmt.Errorf("dispatcher requeue fail! alias:%s, slice:%d, error:%v", task.Alias, task.CurrentSlice, err)
+	}
+	return nil
+}
+
+// Run 启动当前节点的worker，每个节点只启动一次
+func (d *dispatcher) Run(workers int) {
+	d.once.Do(func() {
+		for i := 0; i < workers; i++ {
+			go d.work()
+		}
+		go d.reap()
+		log.Printf("dispatcher run! nodeId:%s, workers:%d", nodeId, workers)
+	})
+}
+
+// work 循环领取并执行分片任务
+func (d *dispatcher) work() {
+
+	ctx := context.Background()
+	queueKey := key.SliceQueueRedisKey.GetKey()
+	processingKey := key.SliceProcessingRedisKey.GetKey()
+
+	for {
+		data, err := d.rdb.BRPopLPush(ctx, queueKey, processingKey, claimTimeout).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			log.Printf("dispatcher claim task fail! error:%v", err)
+			time.Sleep(claimTimeout)
+			continue
+		}
+
+		d.execute(data)
+	}
+}
+
+// execute 执行分片任务，执行期间定时续租
+func (d *dispatcher) execute(data string) {
+
+	ctx := context.Background()
+	processingKey := key.SliceProcessingRedisKey.GetKey()
+	defer d.rdb.LRem(ctx, processingKey, 1, data)
+
+	var task SliceTask
+	if err := json.Unmarshal([]byte(data), &task); err != nil {
+		log.Printf("dispatcher parse task fail! data:%s, error:%v", data, err)
+		return
+	}
+
+	leaseKey := key.SliceLeaseRedisKey.MakeRedisKey(task.TaskId)
+	d.rdb.Set(ctx, leaseKey, nodeId, key.SliceLeaseRedisKey.GetExpire())
+	defer d.rdb.Del(ctx, leaseKey)
+
+	//定时续租
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.rdb.Expire(ctx, leaseKey, key.SliceLeaseRedisKey.GetExpire())
+			}
+		}
+	}()
+
+	handler, ok := Registry.Get(task.Alias)
+	if !ok {
+		log.Printf("dispatcher execute fail! alias %s is not registered on node %s", task.Alias, nodeId)
+		return
+	}
+
+	log.Printf("dispatcher execute task! alias:%s, type:%s, slice:%d/%d, attempts:%d",
+		task.Alias, task.Type, task.CurrentSlice, task.TotalSlice, task.Attempts)
+
+	var err error
+	switch task.Type {
+	case TaskPartRebuild:
+		args := withSliceArgs(task.Args, task.CurrentSlice, task.TotalSlice)
+		err = handler.PartRebuild(task.CurrentSlice, task.TotalSlice, args)
+	default:
+		err = handler.FullRebuild(task.CurrentSlice, task.TotalSlice, task.Args)
+	}
+
+	if err != nil {
+		log.Printf("dispatcher execute task fail! alias:%s, slice:%d/%d, error:%v", task.Alias, task.CurrentSlice, task.TotalSlice, err)
+	} else {
+		log.Printf("dispatcher execute task success! alias:%s, slice:%d/%d", task.Alias, task.CurrentSlice, task.TotalSlice)
+	}
+}
+
+// reap 定时检查处理中的任务和运行中分片的心跳，租约过期的任务和心跳超时的分片以PartRebuild的方式重新入队，
+// 同一时间只有一个节点检查
+func (d *dispatcher) reap() {
+
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.ReapOnce()
+	}
+}
+
+// ReapOnce 获取检查锁后执行一次检查，其他节点正在检查时返回false
+func (d *dispatcher) ReapOnce() bool {
+
+	redisLockHandler := lock.RedisLockHandler
+	requestId := redisLockHandler.GetRequestId()
+	lockKey := key.SliceReaperLockRedisKey.GetKey()
+	if !redisLockHandler.Lock(lockKey, requestId, key.SliceReaperLockRedisKey.GetExpire()) {
+		return false
+	}
+	defer redisLockHandler.UnLock(lockKey, requestId)
+
+	d.reapExpired()
+	d.reapStaleSlices()
+	return true
+}
+
+// reapExpired 重新入队租约过期的任务
+// 任务领取后到设置租约之间有短暂间隔，连续两次检查都没有租约且超过租约时间才认为过期，
+// 首次发现没有租约的时间保存在redis中，检查的节点变化后仍然有效
+func (d *dispatcher) reapExpired() {
+
+	ctx := context.Background()
+	processingKey := key.SliceProcessingRedisKey.GetKey()
+	items, err := d.rdb.LRange(ctx, processingKey, 0, -1).Result()
+	if err != nil {
+		log.Printf("dispatcher reap fail! error:%v", err)
+		return
+	}
+	missing, err := d.missingSince()
+	if err != nil {
+		log.Printf("dispatcher reap fail! error:%v", err)
+		return
+	}
+
+	now := time.Now()
+	seen := make(map[string]time.Time, len(items))
+	for _, data := range items {
+		var task SliceTask
+		if err := json.Unmarshal([]byte(data), &task); err != nil {
+			d.rdb.LRem(ctx, processingKey, 1, data)
+			continue
+		}
+
+		count, err := d.rdb.Exists(ctx, key.SliceLeaseRedisKey.MakeRedisKey(task.TaskId)).Result()
+		if err != nil || count > 0 {
+			continue
+		}
+
+		first, ok := missing[data]
+		if !ok {
+			seen[data] = now
+			continue
+		}
+		seen[data] = first
+
+		if now.Sub(first) < key.SliceLeaseRedisKey.GetExpire() {
+			continue
+		}
+
+		//租约过期，从处理中队列移除并以PartRebuild的方式重新入队
+		if removed, _ := d.rdb.LRem(ctx, processingKey, 1, data).Result(); removed == 0 {
+			continue
+		}
+		delete(seen, data)
+		if !d.needRequeue(&task) {
+			continue
+		}
+		task.Type = TaskPartRebuild
+		task.Attempts++
+		if err := d.Requeue(&task); err != nil {
+			log.Printf("dispatcher reap requeue fail! %v", err)
+			continue
+		}
+		log.Printf("dispatcher reap requeue task! alias:%s, slice:%d/%d, attempts:%d", task.Alias, task.CurrentSlice, task.TotalSlice, task.Attempts)
+	}
+	if err := d.saveMissing(seen); err != nil {
+		log.Printf("dispatcher reap fail! error:%v", err)
+	}
+}
+
+// missingSince 获取处理中的任务首次发现没有租约的时间
+func (d *dispatcher) missingSince() (map[string]time.Time, error) {
+
+	values, err := d.rdb.HGetAll(context.Background(), key.SliceMissingRedisKey.GetKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("dispatcher get missing lease fail! error:%v", err)
+	}
+
+	missing := make(map[string]time.Time, len(values))
+	for data, value := range values {
+		since, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		missing[data] = time.UnixMilli(since)
+	}
+	return missing, nil
+}
+
+// saveMissing 覆盖保存没有租约的任务，已恢复租约或已重新入队的任务不再保留
+func (d *dispatcher) saveMissing(missing map[string]time.Time) error {
+
+	ctx := context.Background()
+	missingKey := key.SliceMissingRedisKey.GetKey()
+	_, err := d.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, missingKey)
+		if len(missing) == 0 {
+			return nil
+		}
+		values := make(map[string]interface{}, len(missing))
+		for data, since := range missing {
+			values[data] = since.UnixMilli()
+		}
+		pipe.HSet(ctx, missingKey, values)
+		pipe.Expire(ctx, missingKey, key.SliceMissingRedisKey.GetExpire())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("dispatcher save missing lease fail! error:%v", err)
+	}
+	return nil
+}
+
+// needRequeue 租约过期的任务是否需要重新入队
+// 分片已经开始运行时由分片心跳判断是否需要重新分配，只有任务还没有开始或者分片还没有开始时重新入队
+func (d *dispatcher) needRequeue(task *SliceTask) bool {
+
+	job, err := Jobs.Current(task.Alias)
+	if err != nil {
+		log.Printf("dispatcher reap get running job fail! alias:%s, error:%v", task.Alias, err)
+	}
+
+	if task.Attempts >= maxSliceAttempts {
+		log.Printf("dispatcher reap drop task, exceeded max attempts! alias:%s, slice:%d/%d, attempts:%d",
+			task.Alias, task.CurrentSlice, task.TotalSlice, task.Attempts)
+		if job != nil {
+			Jobs.Finish(job.JobId, JobFailed, fmt.Errorf("slice %d exceeded max attempts %d, lease expired", task.CurrentSlice, maxSliceAttempts))
+		}
+		return false
+	}
+
+	if job == nil || task.CurrentSlice >= len(job.Slices) {
+		return true
+	}
+	return job.Slices[task.CurrentSlice].Status == SlicePending
+}
+
+// withSliceArgs 复制args并写入分片参数
+func withSliceArgs(args map[string]interface{}, currentSlice int, totalSlice int) map[string]interface{} {
+	newArgs := make(map[string]interface{}, len(args)+2)
+	for k, v := range args {
+		newArgs[k] = v
+	}
+	newArgs[currentSliceParam] = currentSlice
+	newArgs[totalSliceParam] = totalSlice
+	return newArgs
+}
@@ -0,0 +1,245 @@
+package rebuild
+
+import (
+	"bytes"
+	"context"
+	"elasticsearch-data-import-go/es"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDryRunSamples 默认返回的样例文档数量
+	defaultDryRunSamples = 10
+	// dryRunIndexSplitter 试运行索引名称中的分隔，试运行索引不符合索引代的命名规则，不会被当作历史索引
+	dryRunIndexSplitter = "-dryrun-"
+)
+
+// DryRunOptions 试运行选项
+type DryRunOptions struct {
+	// NoWrite 为true时不写入ES，只统计转换得到的文档，要求数据源使用Reader流水线
+	NoWrite bool `json:"noWrite"`
+	// Samples 返回的样例文档数量，默认10
+	Samples int `json:"samples"`
+	// MaxRows 最多读取的数据行数，读满后停止读取，0表示不限制，只对Reader流水线生效
+	MaxRows int64 `json:"maxRows"`
+}
+
+// DryRunSample 样例文档
+type DryRunSample struct {
+	Id     string                 `json:"id"`
+	Source map[string]interface{} `json:"source"`
+}
+
+// DryRunReport 试运行报告
+type DryRunReport struct {
+	Alias string `json:"alias"`
+	// IndexName 试运行使用的临时索引，结束后删除，不写入ES时为空
+	IndexName    string `json:"indexName"`
+	CurrentSlice int    `json:"currentSlice"`
+	TotalSlice   int    `json:"totalSlice"`
+	// Rows 读取的数据行数，只统计Reader流水线读取的数据
+	Rows int64 `json:"rows"`
+	// Docs 转换得到的文档数量，只统计Reader流水线转换的文档
+	Docs     int64 `json:"docs"`
+	Success  int64 `json:"success"`
+	Fail     int64 `json:"fail"`
+	Conflict int64 `json:"conflict"`
+	// Errors 按错误类型统计的写入失败数量
+	Errors map[string]int64 `json:"errors"`
+	// Failed 写入失败的文档，最多Samples条
+	Failed []*es.FailedItem `json:"failed"`
+	// Mapping 临时索引的mapping与索引定义的差异，没有索引定义或不写入ES时为空
+	Mapping *Drift          `json:"mapping,omitempty"`
+	Samples []*DryRunSample `json:"samples"`
+	// Truncated 读取达到MaxRows后停止
+	Truncated bool `json:"truncated"`
+	// Error 处理失败的原因，处理失败时仍然返回已经统计的结果
+	Error   string `json:"error,omitempty"`
+	Elapsed int64  `json:"elapsed"`
+}
+
+// dryRun 试运行统计，通过分片位点提交器传递给流水线
+type dryRun struct {
+	options DryRunOptions
+
+	mu     sync.Mutex
+	report *DryRunReport
+}
+
+// newDryRun 创建试运行统计
+func newDryRun(report *DryRunReport, options DryRunOptions) *dryRun {
+	options.Samples = defaultInt(options.Samples, defaultDryRunSamples)
+	return &dryRun{options: options, report: report}
+}
+
+// read 累加读取的行数，返回是否已经读满MaxRows
+func (d *dryRun) read(rows int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.report.Rows += int64(rows)
+	if d.options.MaxRows > 0 && d.report.Rows >= d.options.MaxRows {
+		d.report.Truncated = true
+		return true
+	}
+	return false
+}
+
+// transformed 累加转换得到的文档数量，并收集样例文档
+func (d *dryRun) transformed(docs []*es.DocumentEntity) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.report.Docs += int64(len(docs))
+	for _, doc := range docs {
+		if len(d.report.Samples) >= d.options.Samples {
+			return
+		}
+		sample := &DryRunSample{Id: doc.Id}
+		if doc.Data != nil {
+			sample.Source = *doc.Data
+		}
+		d.report.Samples = append(d.report.Samples, sample)
+	}
+}
+
+// written 累加批次的写入结果
+func (d *dryRun) written(result *es.BatchResult) {
+	if result == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.report.Success += result.Success
+	d.report.Fail += result.Fail
+	d.report.Conflict += result.Conflict
+	for errorType, count := range result.Errors {
+		d.report.Errors[errorType] += count
+	}
+	for _, item := range result.Failed {
+		if len(d.report.Failed) >= d.options.Samples {
+			break
+		}
+		d.report.Failed = append(d.report.Failed, item)
+	}
+}
+
+// DryRunIndexName 别名的试运行临时索引名称
+func DryRunIndexName(alias string) string {
+	return fmt.Sprintf("%s%s%d", alias, dryRunIndexSplitter, time.Now().UnixMilli())
+}
+
+// DryRun 试运行分片的全量索引，不创建任务，不切换别名
+// 默认写入一个临时索引，结束后比较临时索引的mapping与索引定义，并删除临时索引
+// NoWrite时不写入ES，只统计读取和转换的结果
+func (r *RebuildHandler) DryRun(currentSlice int, totalSlice int, args map[string]interface{}, options DryRunOptions) (*DryRunReport, error) {
+
+	alias := r.alias()
+	totalSlice = defaultInt(totalSlice, 1)
+	if currentSlice < 0 || currentSlice >= totalSlice {
+		return nil, fmt.Errorf("dry run fail! alias:%s, invalid slice %d/%d", alias, currentSlice, totalSlice)
+	}
+	if _, ok := r.source.(Handler); ok && options.NoWrite {
+		return nil, fmt.Errorf("dry run fail! alias:%s, noWrite requires a reader pipeline, source implements Handler", alias)
+	}
+
+	start := time.Now()
+	report := &DryRunReport{
+		Alias:        alias,
+		CurrentSlice: currentSlice,
+		TotalSlice:   totalSlice,
+		Errors:       make(map[string]int64),
+	}
+	collector := newDryRun(report, options)
+
+	if !options.NoWrite {
+		report.IndexName = DryRunIndexName(alias)
+		if err := r.createIndex(report.IndexName); err != nil {
+			return nil, fmt.Errorf("dry run create index fail! alias:%s, index:%s, error:%v", alias, report.IndexName, err)
+		}
+		defer func() {
+			if !es.Index.Delete(report.IndexName) {
+				log.Printf("dry run delete index fail! alias:%s, index:%s", alias, report.IndexName)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.timeout())*time.Millisecond)
+	defer cancel()
+
+	//不带别名的提交器不会提交位点、不会保存死信，也不会限速
+	checkpointer := NewCheckpointer("", "", currentSlice, totalSlice, "")
+	checkpointer.dryRun = collector
+	handleErr := r.handle(ctx, currentSlice, totalSlice, report.IndexName, withCheckpointer(args, checkpointer))
+	checkpointer.Wait()
+	if handleErr != nil {
+		report.Error = handleErr.Error()
+	}
+
+	if !options.NoWrite {
+		if err := es.Index.Refresh(report.IndexName); err != nil {
+			log.Printf("dry run refresh fail! alias:%s, index:%s, error:%v", alias, report.IndexName, err)
+		}
+		report.Mapping = r.dryRunMapping(report.IndexName)
+		//自定义Handler不经过流水线，从临时索引中取样例文档
+		if len(report.Samples) == 0 {
+			report.Samples = searchSamples(report.IndexName, collector.options.Samples)
+		}
+	}
+
+	report.Elapsed = time.Since(start).Milliseconds()
+	return report, nil
+}
+
+// dryRunMapping 比较临时索引的mapping与索引定义，没有索引定义时返回nil
+func (r *RebuildHandler) dryRunMapping(indexName string) *Drift {
+
+	definition, err := LoadDefinition(r.alias())
+	if err != nil {
+		log.Printf("dry run load definition fail! alias:%s, error:%v", r.alias(), err)
+		return nil
+	}
+	mapping, err := es.Index.GetMapping(indexName)
+	if err != nil {
+		log.Printf("dry run get mapping fail! alias:%s, index:%s, error:%v", r.alias(), indexName, err)
+		return nil
+	}
+
+	drift := &Drift{
+		Alias:             r.alias(),
+		IndexName:         indexName,
+		DefinitionVersion: definition.Version,
+	}
+	drift.Missing, drift.Changed, drift.Undeclared = CompareMappings(definition.Mappings, mapping)
+	return drift
+}
+
+// searchSamples 从索引中查询样例文档
+func searchSamples(indexName string, size int) []*DryRunSample {
+
+	query, _ := json.Marshal(map[string]interface{}{"size": size})
+	pager := es.Document.Find(esapi.SearchRequest{
+		Index: []string{indexName},
+		Body:  bytes.NewReader(query),
+	})
+
+	samples := make([]*DryRunSample, 0, len(pager.GetData()))
+	for _, data := range pager.GetData() {
+		hit, ok := data.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		sample := &DryRunSample{}
+		sample.Id, _ = hit["_id"].(string)
+		sample.Source, _ = hit["_source"].(map[string]interface{})
+		samples = append(samples, sample)
+	}
+	return samples
+}
@@ -0,0 +1,161 @@
+package rebuild
+
+import (
+	"elasticsearch-data-import-go/es"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// generationDateLayout 索引名称中的日期格式
+	generationDateLayout = "20060102"
+	// generationSplitter 索引名称分隔符
+	generationSplitter = "-"
+	// generationSequenceLength 索引名称中序号的长度
+	generationSequenceLength = 4
+)
+
+// generation 索引代
+type generation struct {
+	indexName string
+	date      string
+	sequence  int
+}
+
+// GenerationName 生成索引名称，格式为 {alias}-{yyyyMMdd}-{NNNN}，例如 user-20261018-0001
+func GenerationName(alias string, date time.Time, sequence int) string {
+	return fmt.Sprintf("%s%s%s%s%0*d", alias, generationSplitter, date.Format(generationDateLayout),
+		generationSplitter, generationSequenceLength, sequence)
+}
+
+// ParseGeneration 解析索引名称中的日期和序号，不是该别名生成的索引时ok为false
+func ParseGeneration(alias string, indexName string) (date string, sequence int, ok bool) {
+
+	prefix := alias + generationSplitter
+	if !strings.HasPrefix(indexName, prefix) {
+		return "", 0, false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(indexName, prefix), generationSplitter)
+	if len(parts) != 2 || len(parts[1]) != generationSequenceLength {
+		return "", 0, false
+	}
+
+	if _, err := time.Parse(generationDateLayout, parts[0]); err != nil {
+		return "", 0, false
+	}
+
+	sequence, err := strconv.Atoi(parts[1])
+	if err != nil || sequence <= 0 {
+		return "", 0, false
+	}
+
+	return parts[0], sequence, true
+}
+
+// SortGenerations 过滤出该别名生成的索引，按照从旧到新排序
+func SortGenerations(alias string, indexes []string) []string {
+
+	generations := make([]generation, 0, len(indexes))
+	for _, index := range indexes {
+		if date, sequence, ok := ParseGeneration(alias, index); ok {
+			generations = append(generations, generation{index, date, sequence})
+		}
+	}
+
+	sort.Slice(generations, func(i, j int) bool {
+		if generations[i].date != generations[j].date {
+			return generations[i].date < generations[j].date
+		}
+		return generations[i].sequence < generations[j].sequence
+	})
+
+	sorted := make([]string, 0, len(generations))
+	for _, g := range generations {
+		sorted = append(sorted, g.indexName)
+	}
+	return sorted
+}
+
+// NextGenerationName 根据已存在的索引生成下一代索引名称，同一天的序号递增
+func NextGenerationName(alias string, now time.Time, indexes []string) string {
+
+	today := now.Format(generationDateLayout)
+	sequence := 0
+	for _, index := range indexes {
+		if date, s, ok := ParseGeneration(alias, index); ok && date == today && s > sequence {
+			sequence = s
+		}
+	}
+
+	return GenerationName(alias, now, sequence+1)
+}
+
+// ExpiredGenerations 获取需要删除的旧索引
+// keeps中的索引（正在使用的索引、正在构建的索引）不参与计算，其余索引保留最新的retain个
+func ExpiredGenerations(alias string, indexes []string, retain int, keeps ...string) []string {
+
+	if retain < 0 {
+		retain = 0
+	}
+
+	var candidates []string
+	for _, index := range SortGenerations(alias, indexes) {
+		if !contains(keeps, index) {
+			candidates = append(candidates, index)
+		}
+	}
+
+	if len(candidates) <= retain {
+		return nil
+	}
+	return candidates[:len(candidates)-retain]
+}
+
+// findGenerations 查询该别名生成的所有索引
+func findGenerations(alias string) []string {
+	return SortGenerations(alias, es.Index.FindByPattern(alias+generationSplitter+"*"))
+}
+
+// currentIndex 获取别名当前指向的索引，别名不存在时返回空字符串
+func currentIndex(alias string) string {
+	indexes := es.Alias.FindIndexNameByAlias(alias)
+	if len(indexes) == 0 {
+		return ""
+	}
+	//别名指向多个索引时取最新的一代
+	if generations := SortGenerations(alias, indexes); len(generations) > 0 {
+		return generations[len(generations)-1]
+	}
+	return indexes[0]
+}
+
+// cleanGenerations 删除超出保留数量的旧索引
+func cleanGenerations(alias string, retain int) {
+
+	keeps := es.Alias.FindIndexNameByAlias(alias)
+	if job, err := Jobs.Current(alias); err == nil && job != nil {
+		keeps = append(keeps, job.IndexName)
+	}
+
+	for _, index := range ExpiredGenerations(alias, findGenerations(alias), retain, keeps...) {
+		if es.Index.Delete(index) {
+			log.Printf("cleanGenerations delete index success! alias:%s, index:%s", alias, index)
+		} else {
+			log.Printf("cleanGenerations delete index fail! alias:%s, index:%s", alias, index)
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
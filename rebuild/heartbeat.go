@@ -0,0 +1,148 @@
+package rebuild
+
+import (
+	"fmt"
+	uuid "github.com/satori/go.uuid"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sliceStaleTimeout 分片超过该时间没有心跳时认为所在节点已宕机
+	sliceStaleTimeout = 3 * heartbeatInterval
+	// maxSliceAttempts 分片最多被重新分配的次数，超过后任务失败
+	maxSliceAttempts = 3
+)
+
+// heartbeat 定时上报分片心跳，发现分片已被重新分配时取消分片
+func (r *RebuildHandler) heartbeat(running *runningSlice) {
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-running.ctx.Done():
+			return
+		case <-ticker.C:
+			owned, err := Jobs.SliceHeartbeat(running.jobId, running.slice, running.owner)
+			if err != nil {
+				log.Printf("heartbeat fail! %v", err)
+				continue
+			}
+			if !owned {
+				log.Printf("heartbeat stop, slice is reassigned! alias:%s, jobId:%s, slice:%d",
+					r.alias(), running.jobId, running.slice)
+				atomic.StoreInt32(&running.reassigned, 1)
+				running.cancel()
+				return
+			}
+		}
+	}
+}
+
+// owned 分片是否仍由本次运行持有，查询失败时认为仍然持有
+func (running *runningSlice) owned() bool {
+	if atomic.LoadInt32(&running.reassigned) == 1 {
+		return false
+	}
+
+	owned, err := Jobs.OwnsSlice(running.jobId, running.slice, running.owner)
+	if err != nil {
+		log.Printf("owned check fail! %v", err)
+		return true
+	}
+	if !owned {
+		atomic.StoreInt32(&running.reassigned, 1)
+	}
+	return owned
+}
+
+// lastBeat 分片最近一次心跳时间，还没有心跳时使用开始时间
+func (s *SliceState) lastBeat() time.Time {
+	last := s.Heartbeat
+	if last < s.StartTime {
+		last = s.StartTime
+	}
+	return time.UnixMilli(last)
+}
+
+// alive 分片是否运行中且心跳未超时
+func (s *SliceState) alive(now time.Time) bool {
+	return s.Status == SliceRunning && now.Sub(s.lastBeat()) < sliceStaleTimeout
+}
+
+// hasAliveSlice 任务是否还有运行中且心跳未超时的分片
+func (j *Job) hasAliveSlice(now time.Time) bool {
+	for _, state := range j.Slices {
+		if state.alive(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// reapStaleSlices 检查所有别名运行中任务的分片心跳，心跳超时的分片以PartRebuild的方式重新入队
+// 重新分配超过maxSliceAttempts次时任务失败
+func (d *dispatcher) reapStaleSlices() {
+
+	now := time.Now()
+	for _, alias := range Registry.Aliases() {
+		job, err := Jobs.Current(alias)
+		if err != nil {
+			log.Printf("dispatcher reap stale slices fail! alias:%s, error:%v", alias, err)
+			continue
+		}
+		if job == nil {
+			continue
+		}
+
+		for _, state := range job.Slices {
+			if state.Status != SliceRunning {
+				continue
+			}
+
+			if state.alive(now) {
+				continue
+			}
+
+			d.reassign(job, state.Slice, state.lastBeat())
+		}
+	}
+}
+
+// reassign 重新分配心跳超时的分片
+func (d *dispatcher) reassign(job *Job, slice int, lastHeartbeat time.Time) {
+
+	cause := fmt.Errorf("slice %d heartbeat lost, last heartbeat:%s", slice, lastHeartbeat.Format(time.RFC3339))
+	attempts, err := Jobs.ReassignSlice(job.JobId, slice, cause)
+	if err != nil {
+		log.Printf("dispatcher reassign slice fail! %v", err)
+		return
+	}
+	notify(EventSliceFailed, job.Alias, job.JobId, slice, cause.Error())
+
+	if attempts > maxSliceAttempts {
+		Jobs.Finish(job.JobId, JobFailed, fmt.Errorf("slice %d exceeded max attempts %d, %v", slice, maxSliceAttempts, cause))
+		log.Printf("dispatcher reassign slice exceeded max attempts! alias:%s, jobId:%s, slice:%d", job.Alias, job.JobId, slice)
+		return
+	}
+
+	task := &SliceTask{
+		TaskId:       strings.ReplaceAll(uuid.NewV4().String(), "-", ""),
+		Type:         TaskPartRebuild,
+		Alias:        job.Alias,
+		CurrentSlice: slice,
+		TotalSlice:   job.TotalSlice,
+		Attempts:     int(attempts),
+		SubmitTime:   time.Now().UnixMilli(),
+	}
+	if err := d.Requeue(task); err != nil {
+		log.Printf("dispatcher reassign slice requeue fail! %v", err)
+		return
+	}
+	log.Printf("dispatcher reassign slice! alias:%s, jobId:%s, slice:%d/%d, attempts:%d, cause:%v",
+		job.Alias, job.JobId, slice, job.TotalSlice, attempts, cause)
+}
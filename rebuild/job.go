@@ -0,0 +1,763 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	uuid "github.com/satori/go.uuid"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultHistoryLength 默认保留的任务历史数量
+	defaultHistoryLength = 50
+	// sliceUpdateRetries 分片状态被并发修改时的重试次数
+	sliceUpdateRetries = 3
+
+	jobInfoField       = "info"
+	jobStatusField     = "status"
+	jobEndTimeField    = "end_time"
+	jobLastErrorField  = "last_error"
+	docsReadField      = "docs_read"
+	docsWrittenField   = "docs_written"
+	docsFailedField    = "docs_failed"
+	docsConflictField  = "docs_conflict"
+	swappedFromField   = "swapped_from"
+	servingField       = "serving_settings"
+	errorFieldPrefix   = "error#"
+	sliceOwnerField    = "owner"
+	sliceBeatField     = "heartbeat"
+	sliceAttemptsField = "attempts"
+	sliceFieldPrefix   = "slice#"
+	sliceFieldSplitter = "#"
+
+	// reassignedOwner 分片被重新分配后的持有者，原来的持有者心跳时发现后停止处理
+	reassignedOwner = "reassigned"
+)
+
+// JobStatus 全量任务状态
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// JobType 任务类型
+type JobType string
+
+const (
+	JobTypeRebuild  JobType = "rebuild"
+	JobTypeRollback JobType = "rollback"
+)
+
+// SliceStatus 分片状态
+type SliceStatus string
+
+const (
+	SlicePending   SliceStatus = "pending"
+	SliceRunning   SliceStatus = "running"
+	SliceSucceeded SliceStatus = "succeeded"
+	SliceFailed    SliceStatus = "failed"
+)
+
+// sliceTransitions 分片状态机，key为当前状态，value为允许变更的状态
+var sliceTransitions = map[SliceStatus][]SliceStatus{
+	SlicePending:   {SliceRunning},
+	SliceRunning:   {SliceSucceeded, SliceFailed},
+	SliceFailed:    {SliceRunning},
+	SliceSucceeded: {SliceRunning},
+}
+
+var (
+	Jobs = jobStore{client.RedisClient}
+)
+
+// Job 全量索引任务
+type Job struct {
+	JobId     string  `json:"jobId"`
+	Type      JobType `json:"type"`
+	Alias     string  `json:"alias"`
+	IndexName string  `json:"indexName"`
+	//切换别名前的索引，全量任务在切换别名成功后记录
+	FromIndex   string    `json:"fromIndex,omitempty"`
+	TotalSlice  int       `json:"totalSlice"`
+	StartTime   int64     `json:"startTime"`
+	EndTime     int64     `json:"endTime"`
+	Status      JobStatus `json:"status"`
+	DocsRead    int64     `json:"docsRead"`
+	DocsWritten int64     `json:"docsWritten"`
+	DocsFailed  int64     `json:"docsFailed"`
+	//版本冲突跳过的文档数量，索引中已有更新的数据
+	DocsConflict int64 `json:"docsConflict"`
+	//按错误类型统计的写入失败数量
+	Errors    map[string]int64 `json:"errors,omitempty"`
+	LastError string           `json:"lastError"`
+	Slices    []*SliceState    `json:"slices"`
+}
+
+// IsFinished 任务是否已经结束
+func (j *Job) IsFinished() bool {
+	return j.Status != JobRunning
+}
+
+// SliceState 分片状态
+type SliceState struct {
+	Slice        int         `json:"slice"`
+	Status       SliceStatus `json:"status"`
+	StartTime    int64       `json:"startTime"`
+	EndTime      int64       `json:"endTime"`
+	DocsRead     int64       `json:"docsRead"`
+	DocsWritten  int64       `json:"docsWritten"`
+	DocsFailed   int64       `json:"docsFailed"`
+	DocsConflict int64       `json:"docsConflict"`
+	LastError    string      `json:"lastError"`
+	//最近一次心跳时间
+	Heartbeat int64 `json:"heartbeat"`
+	//因心跳超时被重新分配的次数
+	Attempts int64 `json:"attempts"`
+}
+
+// jobInfo 任务创建后不再变化的信息
+type jobInfo struct {
+	JobId      string  `json:"jobId"`
+	Type       JobType `json:"type"`
+	Alias      string  `json:"alias"`
+	IndexName  string  `json:"indexName"`
+	FromIndex  string  `json:"fromIndex,omitempty"`
+	TotalSlice int     `json:"totalSlice"`
+	StartTime  int64   `json:"startTime"`
+}
+
+// jobStore 全量任务存储
+// 任务保存为redis hash，各个分片的状态和统计保存在不同的field中，多个节点并发更新不同分片时互不覆盖
+type jobStore struct {
+	rdb *redis.Client
+}
+
+// Start 开始或加入一个全量任务，别名下已有同一个新索引的运行中任务时直接返回该任务
+func (j jobStore) Start(alias string, indexName string, totalSlice int) (*Job, error) {
+
+	ctx := context.Background()
+	currentJobKey := key.CurrentJobRedisKey.MakeRedisKey(alias)
+
+	for count := 0; count <= 10; count++ {
+		jobId := strings.ReplaceAll(uuid.NewV4().String(), "-", "")
+		ok, err := j.rdb.SetNX(ctx, currentJobKey, jobId, key.CurrentJobRedisKey.GetExpire()).Result()
+		if err != nil {
+			return nil, fmt.Errorf("job start fail! alias:%s, error:%v", alias, err)
+		}
+
+		if ok {
+			//成功抢占，创建新任务并初始化未完成的分片数量
+			job, err := j.create(jobId, JobTypeRebuild, alias, indexName, "", totalSlice)
+			if err != nil {
+				return nil, err
+			}
+			finishCountKey := key.FinishCountRedisKey.MakeRedisKey(jobId)
+			if err := j.rdb.Set(ctx, finishCountKey, totalSlice, key.FinishCountRedisKey.GetExpire()).Err(); err != nil {
+				j.Finish(jobId, JobFailed, err)
+				return nil, fmt.Errorf("job start init finish count fail! alias:%s, jobId:%s, error:%v", alias, jobId, err)
+			}
+			return job, nil
+		}
+
+		currentJobId, err := j.rdb.Get(ctx, currentJobKey).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("job start fail! alias:%s, error:%v", alias, err)
+		}
+
+		job, err := j.Get(currentJobId)
+		if err != nil {
+			return nil, err
+		}
+
+		if job == nil {
+			//任务正在创建，等待
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if job.IndexName == indexName && !job.IsFinished() {
+			return job, nil
+		}
+
+		//运行中的任务不是当前新索引的任务，结束旧任务
+		log.Printf("job start, finish stale job! alias:%s, jobId:%s, indexName:%s", alias, job.JobId, job.IndexName)
+		j.Finish(job.JobId, JobFailed, fmt.Errorf("superseded by new rebuild of index %s", indexName))
+	}
+
+	return nil, fmt.Errorf("job start fail! alias:%s, can not acquire current job", alias)
+}
+
+// Rollback 记录一次回滚，回滚不占用运行中的任务
+func (j jobStore) Rollback(alias string, fromIndex string, toIndex string, cause error) (*Job, error) {
+
+	jobId := strings.ReplaceAll(uuid.NewV4().String(), "-", "")
+	job, err := j.create(jobId, JobTypeRollback, alias, toIndex, fromIndex, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if cause != nil {
+		j.Finish(jobId, JobFailed, cause)
+	} else {
+		j.Finish(jobId, JobSucceeded, nil)
+	}
+	return j.Get(job.JobId)
+}
+
+// create 创建任务
+func (j jobStore) create(jobId string, jobType JobType, alias string, indexName string, fromIndex string, totalSlice int) (*Job, error) {
+
+	info := jobInfo{
+		JobId:      jobId,
+		Type:       jobType,
+		Alias:      alias,
+		IndexName:  indexName,
+		FromIndex:  fromIndex,
+		TotalSlice: totalSlice,
+		StartTime:  time.Now().UnixMilli(),
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("job create fail! alias:%s, error:%v", alias, err)
+	}
+
+	values := map[string]interface{}{
+		jobInfoField:   string(data),
+		jobStatusField: string(JobRunning),
+	}
+	for i := 0; i < totalSlice; i++ {
+		state, _ := json.Marshal(&SliceState{Slice: i, Status: SlicePending})
+		values[sliceField(i)] = string(state)
+	}
+
+	ctx := context.Background()
+	jobKey := key.JobRedisKey.MakeRedisKey(jobId)
+	historyKey := key.JobHistoryRedisKey.MakeRedisKey(alias)
+	_, err = j.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, jobKey, values)
+		pipe.Expire(ctx, jobKey, key.JobRedisKey.GetExpire())
+		pipe.LPush(ctx, historyKey, jobId)
+		pipe.LTrim(ctx, historyKey, 0, defaultHistoryLength-1)
+		pipe.Expire(ctx, historyKey, key.JobHistoryRedisKey.GetExpire())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("job create fail! alias:%s, error:%v", alias, err)
+	}
+
+	log.Printf("job create success! alias:%s, jobId:%s, type:%s, indexName:%s, totalSlice:%d", alias, jobId, jobType, indexName, totalSlice)
+	return j.Get(jobId)
+}
+
+// Get 获取任务，不存在时返回nil
+func (j jobStore) Get(jobId string) (*Job, error) {
+
+	values, err := j.rdb.HGetAll(context.Background(), key.JobRedisKey.MakeRedisKey(jobId)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("job get fail! jobId:%s, error:%v", jobId, err)
+	}
+
+	if _, ok := values[jobInfoField]; !ok {
+		return nil, nil
+	}
+
+	return parseJob(values)
+}
+
+// Current 获取别名下运行中的任务，不存在时返回nil
+func (j jobStore) Current(alias string) (*Job, error) {
+
+	jobId, err := j.rdb.Get(context.Background(), key.CurrentJobRedisKey.MakeRedisKey(alias)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("job current fail! alias:%s, error:%v", alias, err)
+	}
+
+	job, err := j.Get(jobId)
+	if err != nil || job == nil || job.IsFinished() {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Latest 获取别名下最近一次任务，不存在时返回nil
+func (j jobStore) Latest(alias string) (*Job, error) {
+	jobs, err := j.History(alias, 1)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return jobs[0], nil
+}
+
+// History 获取别名下的任务历史，按开始时间倒序
+func (j jobStore) History(alias string, limit int) ([]*Job, error) {
+
+	if limit <= 0 || limit > defaultHistoryLength {
+		limit = defaultHistoryLength
+	}
+
+	jobIds, err := j.rdb.LRange(context.Background(), key.JobHistoryRedisKey.MakeRedisKey(alias), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("job history fail! alias:%s, error:%v", alias, err)
+	}
+
+	jobs := make([]*Job, 0, len(jobIds))
+	for _, jobId := range jobIds {
+		job, err := j.Get(jobId)
+		if err != nil {
+			return nil, err
+		}
+		//任务已过期
+		if job == nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// SliceRunning 分片开始处理
+func (j jobStore) SliceRunning(jobId string, slice int) {
+	j.updateSlice(jobId, slice, "", SliceRunning, nil)
+}
+
+// SliceSucceeded 分片处理成功，owner为分片本次运行的持有者，分片已被重新分配时不更新
+func (j jobStore) SliceSucceeded(jobId string, slice int, owner string) {
+	j.updateSlice(jobId, slice, owner, SliceSucceeded, nil)
+}
+
+// SliceFailed 分片处理失败，同时记录任务最后一次错误，owner为分片本次运行的持有者，分片已被重新分配时不更新
+func (j jobStore) SliceFailed(jobId string, slice int, owner string, cause error) {
+	if j.updateSlice(jobId, slice, owner, SliceFailed, cause) && cause != nil {
+		j.rdb.HSet(context.Background(), key.JobRedisKey.MakeRedisKey(jobId), jobLastErrorField, cause.Error())
+	}
+}
+
+// updateSliceScript 分片状态未被其他节点修改且分片仍由owner持有时更新分片状态
+// 分片已被重新分配给其他持有者返回-3，分片状态已被修改返回-2，更新成功返回1
+var updateSliceScript = redis.NewScript(`
+if ARGV[5] ~= '' then
+	local current = redis.call('hget', KEYS[1], ARGV[4])
+	if current and current ~= ARGV[5] then
+		return -3
+	end
+end
+if (redis.call('hget', KEYS[1], ARGV[1]) or '') ~= ARGV[2] then
+	return -2
+end
+redis.call('hset', KEYS[1], ARGV[1], ARGV[3])
+return 1
+`)
+
+// updateSlice 更新分片状态，owner为空时不检查持有者，返回是否更新成功
+// 以读取到的分片状态作为条件更新，期间被其他节点修改时重新读取，最多重试sliceUpdateRetries次
+func (j jobStore) updateSlice(jobId string, slice int, owner string, status SliceStatus, cause error) bool {
+
+	ctx := context.Background()
+	jobKey := key.JobRedisKey.MakeRedisKey(jobId)
+
+	for retry := 0; retry < sliceUpdateRetries; retry++ {
+		state := &SliceState{Slice: slice, Status: SlicePending}
+		data, err := j.rdb.HGet(ctx, jobKey, sliceField(slice)).Result()
+		if err != nil && err != redis.Nil {
+			log.Printf("job update slice fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+			return false
+		}
+		if data != "" {
+			if err := json.Unmarshal([]byte(data), state); err != nil {
+				log.Printf("job update slice fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+				return false
+			}
+		}
+
+		if !canTransit(state.Status, status) {
+			log.Printf("job update slice fail! invalid transition! jobId:%s, slice:%d, from:%s, to:%s", jobId, slice, state.Status, status)
+			return false
+		}
+
+		now := time.Now().UnixMilli()
+		state.Status = status
+		switch status {
+		case SliceRunning:
+			state.StartTime = now
+			state.EndTime = 0
+			state.LastError = ""
+		case SliceSucceeded, SliceFailed:
+			state.EndTime = now
+		}
+		if cause != nil {
+			state.LastError = cause.Error()
+		}
+
+		newData, _ := json.Marshal(state)
+		result, err := updateSliceScript.Run(ctx, j.rdb, []string{jobKey},
+			sliceField(slice), data, string(newData), sliceStatsField(slice, sliceOwnerField), owner).Int()
+		if err != nil {
+			log.Printf("job update slice fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+			return false
+		}
+		switch result {
+		case 1:
+			return true
+		case -3:
+			log.Printf("job update slice skip! slice is reassigned! jobId:%s, slice:%d, owner:%s, status:%s", jobId, slice, owner, status)
+			return false
+		}
+	}
+
+	log.Printf("job update slice fail! slice is modified concurrently! jobId:%s, slice:%d, status:%s", jobId, slice, status)
+	return false
+}
+
+// ClaimSlice 记录分片的持有者，分片每次运行使用不同的持有者标识
+func (j jobStore) ClaimSlice(jobId string, slice int, owner string) error {
+
+	ctx := context.Background()
+	jobKey := key.JobRedisKey.MakeRedisKey(jobId)
+	values := map[string]interface{}{
+		sliceStatsField(slice, sliceOwnerField): owner,
+		sliceStatsField(slice, sliceBeatField):  time.Now().UnixMilli(),
+	}
+	if err := j.rdb.HSet(ctx, jobKey, values).Err(); err != nil {
+		return fmt.Errorf("job claim slice fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+	}
+	return nil
+}
+
+// SliceHeartbeat 分片心跳，分片已被重新分配给其他持有者时返回false
+func (j jobStore) SliceHeartbeat(jobId string, slice int, owner string) (bool, error) {
+
+	owned, err := j.OwnsSlice(jobId, slice, owner)
+	if err != nil || !owned {
+		return owned, err
+	}
+
+	jobKey := key.JobRedisKey.MakeRedisKey(jobId)
+	if err := j.rdb.HSet(context.Background(), jobKey, sliceStatsField(slice, sliceBeatField), time.Now().UnixMilli()).Err(); err != nil {
+		return true, fmt.Errorf("job slice heartbeat fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+	}
+	return true, nil
+}
+
+// OwnsSlice 分片是否仍由owner持有
+func (j jobStore) OwnsSlice(jobId string, slice int, owner string) (bool, error) {
+
+	jobKey := key.JobRedisKey.MakeRedisKey(jobId)
+	current, err := j.rdb.HGet(context.Background(), jobKey, sliceStatsField(slice, sliceOwnerField)).Result()
+	if err == redis.Nil {
+		return true, nil
+	} else if err != nil {
+		return true, fmt.Errorf("job get slice owner fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+	}
+	return current == owner, nil
+}
+
+// ReassignSlice 心跳超时的分片标记为失败并解除持有，返回重新分配的次数
+func (j jobStore) ReassignSlice(jobId string, slice int, cause error) (int64, error) {
+
+	ctx := context.Background()
+	jobKey := key.JobRedisKey.MakeRedisKey(jobId)
+	var attempts *redis.IntCmd
+	_, err := j.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, jobKey, sliceStatsField(slice, sliceOwnerField), reassignedOwner)
+		attempts = pipe.HIncrBy(ctx, jobKey, sliceStatsField(slice, sliceAttemptsField), 1)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("job reassign slice fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+	}
+
+	j.SliceFailed(jobId, slice, reassignedOwner, cause)
+	return attempts.Val(), nil
+}
+
+// AddRead 累加分片从数据源读取的数据条数，与写入结果分开统计
+func (j jobStore) AddRead(jobId string, slice int, rows int) {
+
+	if jobId == "" || rows <= 0 {
+		return
+	}
+
+	ctx := context.Background()
+	jobKey := key.JobRedisKey.MakeRedisKey(jobId)
+	_, err := j.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, jobKey, docsReadField, int64(rows))
+		pipe.HIncrBy(ctx, jobKey, sliceStatsField(slice, docsReadField), int64(rows))
+		return nil
+	})
+	if err != nil {
+		log.Printf("job add read fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+	}
+}
+
+// AddStats 累加分片的写入、失败、版本冲突文档数量
+func (j jobStore) AddStats(jobId string, slice int, result *es.BatchResult) {
+
+	if jobId == "" || result == nil {
+		return
+	}
+
+	ctx := context.Background()
+	jobKey := key.JobRedisKey.MakeRedisKey(jobId)
+	_, err := j.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, jobKey, docsWrittenField, result.Success)
+		pipe.HIncrBy(ctx, jobKey, docsFailedField, result.Fail)
+		pipe.HIncrBy(ctx, jobKey, docsConflictField, result.Conflict)
+		for errorType, count := range result.Errors {
+			pipe.HIncrBy(ctx, jobKey, errorFieldPrefix+errorType, count)
+		}
+		pipe.HIncrBy(ctx, jobKey, sliceStatsField(slice, docsWrittenField), result.Success)
+		pipe.HIncrBy(ctx, jobKey, sliceStatsField(slice, docsFailedField), result.Fail)
+		pipe.HIncrBy(ctx, jobKey, sliceStatsField(slice, docsConflictField), result.Conflict)
+		return nil
+	})
+	if err != nil {
+		log.Printf("job add stats fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+	}
+}
+
+// countDownScript 分片完成时递减任务的未完成分片数量
+// 计数不存在（任务已结束）返回-1，分片已经计数过返回-2，分片已被重新分配给其他持有者返回-3，同一分片重复完成不会重复递减
+var countDownScript = redis.NewScript(`
+if redis.call('exists', KEYS[1]) == 0 then
+	return -1
+end
+if ARGV[3] ~= '' then
+	local current = redis.call('hget', KEYS[3], ARGV[4])
+	if current and current ~= ARGV[3] then
+		return -3
+	end
+end
+if redis.call('sadd', KEYS[2], ARGV[1]) == 0 then
+	return -2
+end
+redis.call('pexpire', KEYS[2], ARGV[2])
+return redis.call('decr', KEYS[1])
+`)
+
+// CountDownSlice 分片完成，返回未完成的分片数量，owner为分片本次运行的持有者，为空时不检查
+// counted为false表示任务已结束、分片已经计数过或者分片已被重新分配
+func (j jobStore) CountDownSlice(jobId string, slice int, owner string) (remaining int64, counted bool, err error) {
+
+	keys := []string{key.FinishCountRedisKey.MakeRedisKey(jobId), key.FinishedSliceRedisKey.MakeRedisKey(jobId), key.JobRedisKey.MakeRedisKey(jobId)}
+	expire := key.FinishedSliceRedisKey.GetExpire().Milliseconds()
+	remaining, err = countDownScript.Run(context.Background(), j.rdb, keys, slice, expire, owner, sliceStatsField(slice, sliceOwnerField)).Int64()
+	if err != nil {
+		return 0, false, fmt.Errorf("job count down slice fail! jobId:%s, slice:%d, error:%v", jobId, slice, err)
+	}
+	if remaining < 0 {
+		return 0, false, nil
+	}
+	return remaining, true, nil
+}
+
+// RemainingSlices 获取任务未完成的分片数量，任务已结束时返回0
+func (j jobStore) RemainingSlices(jobId string) (int64, error) {
+
+	remaining, err := j.rdb.Get(context.Background(), key.FinishCountRedisKey.MakeRedisKey(jobId)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("job get remaining slices fail! jobId:%s, error:%v", jobId, err)
+	}
+	return remaining, nil
+}
+
+// Swapped 记录全量任务切换别名成功，fromIndex为切换前的索引，别名原先没有索引时为空
+func (j jobStore) Swapped(jobId string, fromIndex string) error {
+
+	if err := j.rdb.HSet(context.Background(), key.JobRedisKey.MakeRedisKey(jobId), swappedFromField, fromIndex).Err(); err != nil {
+		return fmt.Errorf("job swapped fail! jobId:%s, error:%v", jobId, err)
+	}
+	return nil
+}
+
+// SaveServingSettings 保存新索引的服务设置
+func (j jobStore) SaveServingSettings(jobId string, settings map[string]interface{}) error {
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("job save serving settings fail! jobId:%s, error:%v", jobId, err)
+	}
+	if err := j.rdb.HSet(context.Background(), key.JobRedisKey.MakeRedisKey(jobId), servingField, string(data)).Err(); err != nil {
+		return fmt.Errorf("job save serving settings fail! jobId:%s, error:%v", jobId, err)
+	}
+	return nil
+}
+
+// ServingSettings 获取新索引的服务设置
+func (j jobStore) ServingSettings(jobId string) (map[string]interface{}, error) {
+
+	data, err := j.rdb.HGet(context.Background(), key.JobRedisKey.MakeRedisKey(jobId), servingField).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("job get serving settings fail! jobId:%s, error:%v", jobId, err)
+	}
+
+	var settings map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &settings); err != nil {
+		return nil, fmt.Errorf("job get serving settings fail! jobId:%s, error:%v", jobId, err)
+	}
+	return settings, nil
+}
+
+// MarkRebuildRequired 在别名上标记需要重建索引，与任务无关，全量任务成功切换别名后清除
+func (j jobStore) MarkRebuildRequired(alias string, reason string) error {
+
+	requiredKey := key.RebuildRequiredRedisKey.MakeRedisKey(alias)
+	if err := j.rdb.Set(context.Background(), requiredKey, reason, key.RebuildRequiredRedisKey.GetExpire()).Err(); err != nil {
+		return fmt.Errorf("job mark rebuild required fail! alias:%s, error:%v", alias, err)
+	}
+	log.Printf("job mark rebuild required! alias:%s, reason:%s", alias, reason)
+	return nil
+}
+
+// RebuildRequired 获取别名需要重建索引的原因，为空表示不需要重建
+func (j jobStore) RebuildRequired(alias string) (string, error) {
+
+	reason, err := j.rdb.Get(context.Background(), key.RebuildRequiredRedisKey.MakeRedisKey(alias)).Result()
+	if err == redis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("job get rebuild required fail! alias:%s, error:%v", alias, err)
+	}
+	return reason, nil
+}
+
+// ClearRebuildRequired 清除别名需要重建索引的标记
+func (j jobStore) ClearRebuildRequired(alias string) error {
+
+	if err := j.rdb.Del(context.Background(), key.RebuildRequiredRedisKey.MakeRedisKey(alias)).Err(); err != nil {
+		return fmt.Errorf("job clear rebuild required fail! alias:%s, error:%v", alias, err)
+	}
+	return nil
+}
+
+// Finish 结束任务
+func (j jobStore) Finish(jobId string, status JobStatus, cause error) {
+
+	ctx := context.Background()
+	job, err := j.Get(jobId)
+	if err != nil || job == nil {
+		log.Printf("job finish fail! jobId:%s, error:%v", jobId, err)
+		return
+	}
+
+	values := map[string]interface{}{
+		jobStatusField:  string(status),
+		jobEndTimeField: time.Now().UnixMilli(),
+	}
+	if cause != nil {
+		values[jobLastErrorField] = cause.Error()
+	}
+
+	currentJobKey := key.CurrentJobRedisKey.MakeRedisKey(job.Alias)
+	err = j.rdb.HSet(ctx, key.JobRedisKey.MakeRedisKey(jobId), values).Err()
+	if err != nil {
+		log.Printf("job finish fail! jobId:%s, error:%v", jobId, err)
+		return
+	}
+
+	//只清除仍指向该任务的运行中任务标识
+	if currentJobId, _ := j.rdb.Get(ctx, currentJobKey).Result(); currentJobId == jobId {
+		j.rdb.Del(ctx, currentJobKey)
+	}
+	//无论任务结果如何都删除分片计数，之后到达的分片不会再触发切换别名
+	j.rdb.Del(ctx, key.FinishCountRedisKey.MakeRedisKey(jobId), key.FinishedSliceRedisKey.MakeRedisKey(jobId))
+	log.Printf("job finish! alias:%s, jobId:%s, status:%s, cause:%v", job.Alias, jobId, status, cause)
+	if status == JobFailed && job.Type == JobTypeRebuild {
+		notify(EventJobFailed, job.Alias, jobId, -1, fmt.Sprint(cause))
+	}
+}
+
+// parseJob 解析redis hash中的任务数据
+func parseJob(values map[string]string) (*Job, error) {
+
+	var info jobInfo
+	if err := json.Unmarshal([]byte(values[jobInfoField]), &info); err != nil {
+		return nil, fmt.Errorf("job parse fail! error:%v", err)
+	}
+
+	job := &Job{
+		JobId:      info.JobId,
+		Type:       info.Type,
+		Alias:      info.Alias,
+		IndexName:  info.IndexName,
+		FromIndex:  info.FromIndex,
+		TotalSlice: info.TotalSlice,
+		StartTime:  info.StartTime,
+		Status:     JobStatus(values[jobStatusField]),
+		LastError:  values[jobLastErrorField],
+	}
+	if swappedFrom, ok := values[swappedFromField]; ok {
+		job.FromIndex = swappedFrom
+	}
+	if job.Type == "" {
+		job.Type = JobTypeRebuild
+	}
+	job.EndTime, _ = strconv.ParseInt(values[jobEndTimeField], 10, 64)
+	job.DocsRead, _ = strconv.ParseInt(values[docsReadField], 10, 64)
+	job.DocsWritten, _ = strconv.ParseInt(values[docsWrittenField], 10, 64)
+	job.DocsFailed, _ = strconv.ParseInt(values[docsFailedField], 10, 64)
+	job.DocsConflict, _ = strconv.ParseInt(values[docsConflictField], 10, 64)
+	for field, value := range values {
+		if strings.HasPrefix(field, errorFieldPrefix) {
+			if job.Errors == nil {
+				job.Errors = make(map[string]int64)
+			}
+			job.Errors[strings.TrimPrefix(field, errorFieldPrefix)], _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+
+	for i := 0; i < info.TotalSlice; i++ {
+		state := &SliceState{Slice: i, Status: SlicePending}
+		if data, ok := values[sliceField(i)]; ok {
+			if err := json.Unmarshal([]byte(data), state); err != nil {
+				return nil, fmt.Errorf("job parse slice fail! jobId:%s, slice:%d, error:%v", info.JobId, i, err)
+			}
+		}
+		state.DocsRead, _ = strconv.ParseInt(values[sliceStatsField(i, docsReadField)], 10, 64)
+		state.DocsWritten, _ = strconv.ParseInt(values[sliceStatsField(i, docsWrittenField)], 10, 64)
+		state.DocsFailed, _ = strconv.ParseInt(values[sliceStatsField(i, docsFailedField)], 10, 64)
+		state.DocsConflict, _ = strconv.ParseInt(values[sliceStatsField(i, docsConflictField)], 10, 64)
+		state.Heartbeat, _ = strconv.ParseInt(values[sliceStatsField(i, sliceBeatField)], 10, 64)
+		state.Attempts, _ = strconv.ParseInt(values[sliceStatsField(i, sliceAttemptsField)], 10, 64)
+		job.Slices = append(job.Slices, state)
+	}
+
+	return job, nil
+}
+
+// canTransit 分片状态是否允许变更
+func canTransit(from SliceStatus, to SliceStatus) bool {
+	for _, s := range sliceTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func sliceField(slice int) string {
+	return sliceFieldPrefix + strconv.Itoa(slice)
+}
+
+func sliceStatsField(slice int, field string) string {
+	return sliceField(slice) + sliceFieldSplitter + field
+}
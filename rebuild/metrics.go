@@ -0,0 +1,60 @@
+package rebuild
+
+import (
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+)
+
+var (
+	bufferSizeDesc = metrics.NewDesc("record_buffer_size",
+		"Incremental records waiting in the default record buffer for the running rebuild job.", "alias")
+)
+
+func init() {
+	metrics.MustRegister(recordBufferCollector{})
+}
+
+// recordDocs 按别名和索引统计批次的写入结果
+func recordDocs(alias string, result *es.BatchResult) {
+	if result == nil {
+		return
+	}
+	metrics.DocsIndexed.WithLabelValues(alias, result.Index, metrics.DocSuccess).Add(float64(result.Success))
+	metrics.DocsIndexed.WithLabelValues(alias, result.Index, metrics.DocFailed).Add(float64(result.Fail))
+	metrics.DocsIndexed.WithLabelValues(alias, result.Index, metrics.DocConflict).Add(float64(result.Conflict))
+}
+
+// recordBufferCollector 采集时读取运行中任务缓存的增量数据数量，只统计默认的增量数据缓存
+type recordBufferCollector struct{}
+
+func (c recordBufferCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bufferSizeDesc
+}
+
+func (c recordBufferCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, alias := range Registry.Aliases() {
+		handler, ok := Registry.Get(alias)
+		if !ok {
+			continue
+		}
+		if _, ok := handler.recordCache().(streamRecordCache); !ok {
+			continue
+		}
+
+		var size int64
+		job, err := Jobs.Current(alias)
+		if err != nil {
+			log.Printf("record buffer collect fail! alias:%s, error:%v", alias, err)
+			continue
+		}
+		if job != nil {
+			if size, err = RecordBuffer.Size(alias, job.JobId); err != nil {
+				log.Printf("record buffer collect fail! alias:%s, error:%v", alias, err)
+				continue
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(bufferSizeDesc, prometheus.GaugeValue, float64(size), alias)
+	}
+}
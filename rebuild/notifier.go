@@ -0,0 +1,245 @@
+package rebuild
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// EventType 全量任务生命周期事件类型
+type EventType string
+
+const (
+	// EventJobStarted 全量任务开始，新索引已创建
+	EventJobStarted EventType = "job_started"
+	// EventJobFailed 全量任务失败
+	EventJobFailed EventType = "job_failed"
+	// EventSliceFailed 分片处理失败或心跳超时
+	EventSliceFailed EventType = "slice_failed"
+	// EventTimeout 全量任务超时
+	EventTimeout EventType = "timeout"
+	// EventValidationFailed 切换别名前校验失败
+	EventValidationFailed EventType = "validation_failed"
+	// EventShadowDiverged 切换别名前新索引的查询结果与当前索引差异过大，但没有拒绝切换
+	EventShadowDiverged EventType = "shadow_diverged"
+	// EventAliasSwapped 别名已切换到新索引，全量任务成功
+	EventAliasSwapped EventType = "alias_swapped"
+	// EventRolledBack 别名已回滚到最近一次切换前的索引
+	EventRolledBack EventType = "rolled_back"
+
+	// defaultNotifyRetries 默认webhook重试次数
+	defaultNotifyRetries = 3
+	// defaultNotifyBackoff 默认webhook首次重试间隔，之后每次翻倍
+	defaultNotifyBackoff = time.Second
+	// defaultNotifyTimeout 默认webhook请求超时时间
+	defaultNotifyTimeout = 5 * time.Second
+)
+
+// Event 全量任务生命周期事件
+type Event struct {
+	Type  EventType `json:"type"`
+	Alias string    `json:"alias"`
+	JobId string    `json:"jobId,omitempty"`
+	// Slice 事件相关的分片，-1表示与分片无关
+	Slice   int    `json:"slice"`
+	Message string `json:"message"`
+	Time    int64  `json:"time"`
+	// Job 发送前加载的任务详情
+	Job *Job `json:"job,omitempty"`
+}
+
+// Notifier 生命周期事件的通知方式
+type Notifier interface {
+	Notify(event *Event) error
+}
+
+// notifierEntry 别名的通知方式及其订阅的事件
+type notifierEntry struct {
+	notifier Notifier
+	// events 订阅的事件，为空时订阅全部事件
+	events map[EventType]bool
+}
+
+// AddNotifier 添加生命周期事件的通知方式，events为空时通知全部事件
+func (r *RebuildHandler) AddNotifier(notifier Notifier, events ...EventType) {
+	entry := &notifierEntry{notifier: notifier}
+	if len(events) > 0 {
+		entry.events = make(map[EventType]bool, len(events))
+		for _, event := range events {
+			entry.events[event] = true
+		}
+	}
+	r.notifiers = append(r.notifiers, entry)
+}
+
+// notify 异步发送事件到别名的所有通知方式
+func notify(eventType EventType, alias string, jobId string, slice int, message string) {
+
+	handler, ok := Registry.Get(alias)
+	if !ok || len(handler.notifiers) == 0 {
+		return
+	}
+
+	event := &Event{
+		Type:    eventType,
+		Alias:   alias,
+		JobId:   jobId,
+		Slice:   slice,
+		Message: message,
+		Time:    time.Now().UnixMilli(),
+	}
+
+	go func() {
+		if event.JobId != "" {
+			job, err := Jobs.Get(event.JobId)
+			if err != nil {
+				log.Printf("notify get job fail! alias:%s, event:%s, error:%v", alias, eventType, err)
+			}
+			event.Job = job
+		}
+
+		for _, entry := range handler.notifiers {
+			if entry.events != nil && !entry.events[eventType] {
+				continue
+			}
+			if err := entry.notifier.Notify(event); err != nil {
+				log.Printf("notify fail! alias:%s, event:%s, error:%v", alias, eventType, err)
+			}
+		}
+	}()
+}
+
+// WebhookNotifier 以JSON POST发送事件，请求失败或服务端返回5xx、429时按指数退避重试
+type WebhookNotifier struct {
+	URL     string
+	Headers map[string]string
+	// Retries 重试次数，默认3
+	Retries int
+	// Backoff 首次重试间隔，默认1秒
+	Backoff time.Duration
+	// Timeout 请求超时时间，默认5秒
+	Timeout time.Duration
+}
+
+// NewWebhookNotifier 创建使用默认重试配置的webhook通知
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:     url,
+		Retries: defaultNotifyRetries,
+		Backoff: defaultNotifyBackoff,
+		Timeout: defaultNotifyTimeout,
+	}
+}
+
+// Notify 发送事件
+func (w *WebhookNotifier) Notify(event *Event) error {
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("webhook notify fail! url:%s, error:%v", w.URL, err)
+	}
+
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = defaultNotifyTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	backoff := w.Backoff
+	if backoff <= 0 {
+		backoff = defaultNotifyBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = w.post(client, body)
+		if err == nil {
+			return nil
+		}
+		if _, retryable := err.(retryableError); !retryable || attempt >= w.Retries {
+			return fmt.Errorf("webhook notify fail! url:%s, attempts:%d, error:%v", w.URL, attempt+1, err)
+		}
+		time.Sleep(backoff << attempt)
+	}
+}
+
+// retryableError 可以重试的webhook错误
+type retryableError struct {
+	error
+}
+
+// post 发送一次请求
+func (w *WebhookNotifier) post(client *http.Client, body []byte) error {
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return retryableError{fmt.Errorf("response status:%d", resp.StatusCode)}
+	default:
+		return fmt.Errorf("response status:%d", resp.StatusCode)
+	}
+}
+
+// SmtpNotifier 以邮件发送事件
+type SmtpNotifier struct {
+	// Addr 邮件服务器地址，格式为host:port
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Notify 发送事件
+func (s *SmtpNotifier) Notify(event *Event) error {
+
+	if len(s.To) == 0 {
+		return fmt.Errorf("smtp notify fail! recipients is empty! addr:%s", s.Addr)
+	}
+
+	detail, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return fmt.Errorf("smtp notify fail! addr:%s, error:%v", s.Addr, err)
+	}
+
+	var message strings.Builder
+	message.WriteString("From: " + s.From + "\r\n")
+	message.WriteString("To: " + strings.Join(s.To, ",") + "\r\n")
+	message.WriteString(fmt.Sprintf("Subject: [rebuild][%s] %s\r\n", event.Alias, event.Type))
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	message.WriteString(event.Message + "\r\n\r\n")
+	message.Write(detail)
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	if err := smtp.SendMail(s.Addr, auth, s.From, s.To, []byte(message.String())); err != nil {
+		return fmt.Errorf("smtp notify fail! addr:%s, error:%v", s.Addr, err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/redis/key"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"hash/fnv"
+	"strconv"
+)
+
+// PartitionType 分片的数据划分方式
+type PartitionType string
+
+const (
+	// PartitionModulo 按id取模
+	PartitionModulo PartitionType = "modulo"
+	// PartitionRange 按id划分为连续的区间
+	PartitionRange PartitionType = "range"
+	// PartitionHash 按key的哈希取模
+	PartitionHash PartitionType = "hash"
+
+	partitionMinField = "partition_min"
+	partitionMaxField = "partition_max"
+)
+
+// Partition 分片对应的数据范围，所有分片的数据互不重叠且合起来是全部数据
+type Partition struct {
+	Type         PartitionType
+	CurrentSlice int
+	TotalSlice   int
+	// StartId 区间的起始id（包含），HasStart为false时没有下界
+	StartId  int64
+	HasStart bool
+	// EndId 区间的结束id（不包含），HasEnd为false时没有上界
+	EndId  int64
+	HasEnd bool
+}
+
+// ModuloPartition id % totalSlice == currentSlice
+func ModuloPartition(currentSlice int, totalSlice int) Partition {
+	return Partition{Type: PartitionModulo, CurrentSlice: currentSlice, TotalSlice: totalSlice}
+}
+
+// HashPartition hash(key) % totalSlice == currentSlice
+func HashPartition(currentSlice int, totalSlice int) Partition {
+	return Partition{Type: PartitionHash, CurrentSlice: currentSlice, TotalSlice: totalSlice}
+}
+
+// RangePartition 将[minId, maxId]平均划分为totalSlice个连续区间
+// 第一个分片没有下界，最后一个分片没有上界，计算区间后新增的数据也会被处理
+func RangePartition(currentSlice int, totalSlice int, minId int64, maxId int64) Partition {
+
+	p := Partition{Type: PartitionRange, CurrentSlice: currentSlice, TotalSlice: totalSlice}
+	if maxId < minId {
+		maxId = minId
+	}
+
+	size := (maxId - minId + int64(totalSlice)) / int64(totalSlice)
+	if currentSlice > 0 {
+		p.StartId, p.HasStart = minId+size*int64(currentSlice), true
+	}
+	if currentSlice < totalSlice-1 {
+		p.EndId, p.HasEnd = minId+size*int64(currentSlice+1), true
+	}
+	return p
+}
+
+// Contains id是否属于该分片，用于PartitionModulo和PartitionRange
+func (p Partition) Contains(id int64) bool {
+	switch p.Type {
+	case PartitionModulo:
+		return mod(id, p.TotalSlice) == p.CurrentSlice
+	case PartitionRange:
+		return (!p.HasStart || id >= p.StartId) && (!p.HasEnd || id < p.EndId)
+	default:
+		return p.ContainsKey(strconv.FormatInt(id, 10))
+	}
+}
+
+// ContainsKey key是否属于该分片，用于PartitionHash，使用fnv哈希，与SQL中的哈希函数不同，不能混用
+func (p Partition) ContainsKey(key string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()%uint32(p.TotalSlice)) == p.CurrentSlice
+}
+
+// SQL 生成分片的查询条件，column为分片字段
+// PartitionHash使用postgres的hashtext函数
+func (p Partition) SQL(column string) (string, []interface{}) {
+	switch p.Type {
+	case PartitionModulo:
+		return fmt.Sprintf("(%s %% ? + ?) %% ? = ?", column), []interface{}{p.TotalSlice, p.TotalSlice, p.TotalSlice, p.CurrentSlice}
+	case PartitionRange:
+		switch {
+		case p.HasStart && p.HasEnd:
+			return fmt.Sprintf("%s >= ? AND %s < ?", column, column), []interface{}{p.StartId, p.EndId}
+		case p.HasStart:
+			return fmt.Sprintf("%s >= ?", column), []interface{}{p.StartId}
+		case p.HasEnd:
+			return fmt.Sprintf("%s < ?", column), []interface{}{p.EndId}
+		default:
+			return "1 = 1", nil
+		}
+	default:
+		return fmt.Sprintf("(hashtext(%s::text)::bigint %% ? + ?) %% ? = ?", column),
+			[]interface{}{p.TotalSlice, p.TotalSlice, p.TotalSlice, p.CurrentSlice}
+	}
+}
+
+// RangeBounds 获取全量任务的id范围，同一任务的所有分片使用第一个分片查询到的范围，保证区间不重叠
+// args中没有全量任务时直接查询
+func RangeBounds(args map[string]interface{}, fetch func() (int64, int64, error)) (int64, int64, error) {
+
+	checkpointer := GetCheckpointer(args)
+	if checkpointer.job == "" {
+		return fetch()
+	}
+
+	ctx := context.Background()
+	jobKey := key.JobRedisKey.MakeRedisKey(checkpointer.job)
+	values, err := Jobs.rdb.HMGet(ctx, jobKey, partitionMinField, partitionMaxField).Result()
+	if err != nil {
+		return 0, 0, fmt.Errorf("range bounds get fail! jobId:%s, error:%v", checkpointer.job, err)
+	}
+	if values[0] == nil || values[1] == nil {
+		minId, maxId, err := fetch()
+		if err != nil {
+			return 0, 0, err
+		}
+		//只保存第一个分片查询到的范围
+		_, err = Jobs.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSetNX(ctx, jobKey, partitionMinField, minId)
+			pipe.HSetNX(ctx, jobKey, partitionMaxField, maxId)
+			return nil
+		})
+		if err != nil {
+			return 0, 0, fmt.Errorf("range bounds save fail! jobId:%s, error:%v", checkpointer.job, err)
+		}
+		if values, err = Jobs.rdb.HMGet(ctx, jobKey, partitionMinField, partitionMaxField).Result(); err != nil {
+			return 0, 0, fmt.Errorf("range bounds get fail! jobId:%s, error:%v", checkpointer.job, err)
+		}
+	}
+
+	minId, err := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("range bounds parse fail! jobId:%s, error:%v", checkpointer.job, err)
+	}
+	maxId, err := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("range bounds parse fail! jobId:%s, error:%v", checkpointer.job, err)
+	}
+	return minId, maxId, nil
+}
+
+// mod 非负取模
+func mod(id int64, total int) int {
+	return int((id%int64(total) + int64(total)) % int64(total))
+}
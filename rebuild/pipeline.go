@@ -0,0 +1,221 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"fmt"
+	"sync"
+)
+
+const (
+	// defaultPageSize 默认每页读取的数量
+	defaultPageSize = 100
+	// defaultPipelineBuffer 默认每个通道缓冲的批次数量
+	defaultPipelineBuffer = 4
+)
+
+// Reader 按keyset分页读取数据，position为上一页最后一条数据的位点，为空时从头读取
+// 返回本页数据和本页最后一条数据的位点，数据为空时读取结束
+type Reader func(ctx context.Context, position string, limit int) (rows []interface{}, next string, err error)
+
+// Transformer 将一条数据转换为文档，返回nil时跳过该数据
+type Transformer func(row interface{}) (*es.DocumentEntity, error)
+
+// Pipeline 全量索引的读取、转换、写入流水线
+// 读取按位点顺序执行，转换和写入由多个协程并发执行，通道有界，写入跟不上时读取会阻塞
+// 每页作为一个批次登记到分片位点提交器，批次刷入ES后提交连续完成的最大位点
+// 读取和写入按别名的限速配置等待，见Throttles
+// 试运行时统计读取和转换的结果，NoWrite时不写入ES，见DryRun
+type Pipeline struct {
+	Reader      Reader
+	Transformer Transformer
+	// PageSize 每页读取的数量，默认100
+	PageSize int
+	// Transformers 转换协程数量，默认1
+	Transformers int
+	// Writers 写入协程数量，默认1
+	Writers int
+	// Buffer 每个通道缓冲的批次数量，默认4
+	Buffer int
+}
+
+// page 流水线中的一个批次
+type page struct {
+	rows     []interface{}
+	docs     []*es.DocumentEntity
+	callback es.BatchCallback
+	abandon  func()
+}
+
+// Run 执行流水线，从args中的分片位点继续读取，写入indexName，所有批次刷入ES后返回
+func (p *Pipeline) Run(ctx context.Context, indexName string, args map[string]interface{}) error {
+
+	if p.Reader == nil || p.Transformer == nil {
+		return fmt.Errorf("pipeline run fail! reader and transformer can not be nil! index:%s", indexName)
+	}
+
+	pageSize := defaultInt(p.PageSize, defaultPageSize)
+	transformers := defaultInt(p.Transformers, 1)
+	writers := defaultInt(p.Writers, 1)
+	buffer := defaultInt(p.Buffer, defaultPipelineBuffer)
+
+	checkpointer := GetCheckpointer(args)
+	dryRun := checkpointer.dryRun
+	var throttle *Throttle
+	if checkpointer.alias != "" {
+		throttle = Throttles.Get(checkpointer.alias)
+	}
+	//等待已提交的批次全部刷入ES
+	defer checkpointer.Wait()
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var runErr error
+	fail := func(err error) {
+		once.Do(func() {
+			runErr = err
+			cancel()
+		})
+	}
+
+	pages := make(chan *page, buffer)
+	batches := make(chan *page, buffer)
+
+	//读取
+	go func() {
+		defer close(pages)
+		position := checkpointer.Position()
+		for {
+			if runCtx.Err() != nil {
+				return
+			}
+
+			rows, next, err := p.Reader(runCtx, position, pageSize)
+			if err != nil {
+				fail(fmt.Errorf("pipeline read fail! index:%s, position:%s, error:%v", indexName, position, err))
+				return
+			}
+			if len(rows) == 0 {
+				return
+			}
+			checkpointer.Read(len(rows))
+			if throttle != nil {
+				if err := throttle.WaitRead(runCtx, len(rows)); err != nil {
+					return
+				}
+			}
+
+			//试运行读满MaxRows后，本页处理完停止读取
+			full := dryRun != nil && dryRun.read(len(rows))
+
+			callback, abandon := checkpointer.track(next)
+			select {
+			case pages <- &page{rows: rows, callback: callback, abandon: abandon}:
+				position = next
+			case <-runCtx.Done():
+				abandon()
+				return
+			}
+			if full {
+				return
+			}
+		}
+	}()
+
+	//转换
+	var transformWg sync.WaitGroup
+	for i := 0; i < transformers; i++ {
+		transformWg.Add(1)
+		go func() {
+			defer transformWg.Done()
+			for pg := range pages {
+				if runCtx.Err() != nil {
+					pg.abandon()
+					continue
+				}
+
+				docs, err := p.transform(pg.rows)
+				if err != nil {
+					fail(fmt.Errorf("pipeline transform fail! index:%s, error:%v", indexName, err))
+					pg.abandon()
+					continue
+				}
+				pg.docs = docs
+				if dryRun != nil {
+					dryRun.transformed(docs)
+				}
+				batches <- pg
+			}
+		}()
+	}
+	go func() {
+		transformWg.Wait()
+		close(batches)
+	}()
+
+	//写入
+	var writeWg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		writeWg.Add(1)
+		go func() {
+			defer writeWg.Done()
+			for pg := range batches {
+				if runCtx.Err() != nil {
+					pg.abandon()
+					continue
+				}
+
+				if dryRun != nil && dryRun.options.NoWrite {
+					pg.callback(&es.BatchResult{Success: int64(len(pg.docs))})
+					continue
+				}
+
+				if throttle != nil {
+					if err := throttle.WaitWrite(runCtx, pg.docs); err != nil {
+						pg.abandon()
+						continue
+					}
+				}
+
+				//写入使用调用方的ctx，其他批次失败时已经加入的批次继续刷入ES
+				if err := es.Document.BatchSaveWithCallback(ctx, indexName, pg.docs, pg.callback); err != nil {
+					fail(fmt.Errorf("pipeline write fail! index:%s, error:%v", indexName, err))
+				}
+			}
+		}()
+	}
+	writeWg.Wait()
+
+	if runErr != nil {
+		return runErr
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("pipeline cancelled! index:%s, error:%v", indexName, ctx.Err())
+	}
+	return nil
+}
+
+// transform 转换一页数据，跳过转换结果为nil的数据
+func (p *Pipeline) transform(rows []interface{}) ([]*es.DocumentEntity, error) {
+	docs := make([]*es.DocumentEntity, 0, len(rows))
+	for _, row := range rows {
+		doc, err := p.Transformer(row)
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+// defaultInt value不大于0时返回默认值
+func defaultInt(value int, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
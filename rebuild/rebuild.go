@@ -3,15 +3,15 @@ package rebuild
 import (
 	"context"
 	"elasticsearch-data-import-go/es"
-	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/metrics"
 	"elasticsearch-data-import-go/redis/key"
 	"elasticsearch-data-import-go/redis/lock"
 	"elasticsearch-data-import-go/util/jsonutil"
+	"encoding/json"
 	"fmt"
-	"github.com/go-redis/redis/v8"
-	"github.com/patrickmn/go-cache"
 	"log"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -23,23 +23,32 @@ const (
 	totalSliceParam = "total_slice"
 	// OneHour 1小时毫秒
 	OneHour = 60 * 60 * 1000
-	// defaultQueueLength 默认的通道长度
-	defaultQueueLength = 100
+	// defaultReplayBatch 默认每批回放的增量数据数量
+	defaultReplayBatch = 100
 )
 
 // RebuildHandler 全量索引结构体
 type RebuildHandler struct {
-	rebuild         Rebuild
+	source          Source
 	timeoutChecking int32
-	recordChannel   chan *Record
-	cache           *cache.Cache
+	//每批回放的增量数据数量
+	replayBatch int64
+	//当前节点运行中的分片，用于取消
+	running     map[*runningSlice]struct{}
+	runningLock sync.Mutex
+	//切换别名前的校验
+	validators []Validator
+	//全量索引期间的索引设置
+	settingsProfile *SettingsProfile
+	//生命周期事件通知
+	notifiers []*notifierEntry
 }
 
 // FullRebuild 全量索引处理逻辑
 func (r *RebuildHandler) FullRebuild(currentSlice int, totalSlice int, args map[string]interface{}) (err error) {
 
 	//获取Rebuild的索引别名
-	alias := r.rebuild.GetAlias()
+	alias := r.alias()
 
 	//后置处理
 	//如果对于defer的处理顺序有要求，那就放在一个defer里面，通过指针来判断
@@ -48,17 +57,19 @@ func (r *RebuildHandler) FullRebuild(currentSlice int, totalSlice int, args map[
 	//分布式锁key和value
 	requestId := lock.RedisLockHandler.GetRequestId()
 	lockKey := key.RebuildTaskLockRedisKey.MakeRedisKey(alias, currentSlice, totalSlice)
-	defer func(isLock *bool, lockKey string, requestId string, success *bool, currentSlice int, totalSlice int) {
+	var jobId string
+	var owner string
+	defer func(isLock *bool, lockKey string, requestId string, success *bool, jobId *string, owner *string, currentSlice int, totalSlice int) {
 		if *success {
 			//后置处理
-			r.afterHandle(currentSlice, totalSlice, alias)
+			r.afterHandle(*jobId, *owner, currentSlice, totalSlice, alias)
 		}
 
 		if *isLock {
 			//释放锁
 			lock.RedisLockHandler.UnLock(lockKey, requestId)
 		}
-	}(&isLock, lockKey, requestId, &success, currentSlice, totalSlice)
+	}(&isLock, lockKey, requestId, &success, &jobId, &owner, currentSlice, totalSlice)
 
 	//获取分布式锁，这里的分布式锁用于保证分片不会并发处理
 	isLock = lock.RedisLockHandler.Lock(lockKey, requestId, key.RebuildTaskLockRedisKey.GetExpire())
@@ -67,60 +78,108 @@ func (r *RebuildHandler) FullRebuild(currentSlice int, totalSlice int, args map[
 		return fmt.Errorf(message)
 	}
 
-	//创建索引或者获取新的索引名称
-	indexName, createErr := r.createOrGetNewIndex(alias)
+	//创建新索引并开始全量任务，或者加入运行中的全量任务
+	job, createErr := r.createOrGetNewIndex(alias, totalSlice)
 	if createErr != nil {
 		return fmt.Errorf("index %s rebuild fail, get or creatre index fail! %v", alias, createErr)
 	}
+	jobId = job.JobId
+	indexName := job.IndexName
 	//处理开始事件
-	r.rebuildStart(alias, totalSlice)
+	r.rebuildStart(alias, job.JobId)
+
+	//记录分片状态并定时上报心跳，分片在可取消的上下文中运行，先于后置处理执行
+	running := r.startSlice(job.JobId, currentSlice)
+	owner = running.owner
+	defer r.finishSlice(running, &err)
+	ctx := running.ctx
+	if IsCancelled(job.JobId) {
+		return fmt.Errorf("index %s rebuild fail, job %s is cancelled", alias, job.JobId)
+	}
+
+	//全量索引从头开始处理，清除分片之前的位点
+	if err := Checkpoint.Clear(alias, job.JobId, currentSlice, totalSlice); err != nil {
+		log.Printf("FullRebuild clear checkpoint fail! %v", err)
+	}
+	checkpointer := NewCheckpointer(alias, job.JobId, currentSlice, totalSlice, "")
+	checkpointer.owner = running.owner
 
 	//核心处理逻辑
-	handleErr := r.rebuild.Handle(currentSlice, totalSlice, indexName, args)
+	handleErr := r.handle(ctx, currentSlice, totalSlice, indexName, withCheckpointer(args, checkpointer))
 	if handleErr != nil {
 		return fmt.Errorf("index %s rebuild fail, handle fail! %v", alias, handleErr)
 	}
+	//分片已被重新分配，由新的持有者执行后置处理
+	if !running.owned() {
+		return fmt.Errorf("index %s rebuild fail, slice %d is reassigned", alias, currentSlice)
+	}
 	success = true
 
 	return nil
 }
 
 // PartRebuild 全量索引部分分片失败后的重试逻辑
-func (r *RebuildHandler) PartRebuild(currentSlice int, totalSlice int, args map[string]interface{}) error {
+func (r *RebuildHandler) PartRebuild(currentSlice int, totalSlice int, args map[string]interface{}) (err error) {
 
-	alias := r.rebuild.GetAlias()
+	alias := r.alias()
 	if args == nil || len(args) == 0 {
 		return fmt.Errorf("PartRebuild index %s rebuild fail! args is empty! currentSlice:%d, totalSlice:%d", alias, currentSlice, totalSlice)
-	} else {
+	}
 
-		//后置处理
-		var success bool
-		defer func(success *bool, currentSlice int, totalSlice int) {
-			if *success {
-				//后置处理
-				r.afterHandle(currentSlice, totalSlice, alias)
-			}
-		}(&success, currentSlice, totalSlice)
+	//解析参数
+	currentSliceArgs, totalSliceArgs, err := parseArgs(args)
+	if err != nil {
+		return fmt.Errorf("PartRebuild index %s rebuild fail, get or creatre index fail! error:%v", alias, err)
+	}
 
-		//解析参数
-		currentSliceArgs, totalSliceArgs, err := parseArgs(args)
-		if err != nil {
-			return fmt.Errorf("PartRebuild index %s rebuild fail, get or creatre index fail! error:%v", alias, err)
+	//后置处理
+	var success bool
+	var jobId string
+	var owner string
+	defer func(success *bool, jobId *string, owner *string, currentSlice int, totalSlice int) {
+		if *success {
+			//后置处理
+			r.afterHandle(*jobId, *owner, currentSlice, totalSlice, alias)
 		}
+	}(&success, &jobId, &owner, currentSliceArgs, totalSliceArgs)
 
-		//创建索引或者获取新的索引名称
-		indexName, err := r.createOrGetNewIndex(alias)
-		if err != nil {
-			return fmt.Errorf("PartRebuild index %s rebuild fail, get or creatre index fail! error:%v", alias, err)
-		}
+	//加入运行中的全量任务，或者创建新索引并开始全量任务
+	job, err := r.createOrGetNewIndex(alias, totalSliceArgs)
+	if err != nil {
+		return fmt.Errorf("PartRebuild index %s rebuild fail, get or creatre index fail! error:%v", alias, err)
+	}
+	jobId = job.JobId
+	indexName := job.IndexName
 
-		//核心处理逻辑
-		err = r.rebuild.Handle(currentSliceArgs, totalSliceArgs, indexName, args)
-		if err != nil {
-			return fmt.Errorf("PartRebuild index %s rebuild fail, handle fail! error:%v", alias, err)
-		}
-		success = true
+	//记录分片状态并定时上报心跳，分片在可取消的上下文中运行，先于后置处理执行
+	running := r.startSlice(job.JobId, currentSliceArgs)
+	owner = running.owner
+	defer r.finishSlice(running, &err)
+	ctx := running.ctx
+	if IsCancelled(job.JobId) {
+		return fmt.Errorf("PartRebuild index %s rebuild fail, job %s is cancelled", alias, job.JobId)
+	}
+
+	//获取分片最后提交的位点，从该位点之后继续处理
+	position, err := Checkpoint.Get(alias, job.JobId, currentSliceArgs, totalSliceArgs)
+	if err != nil {
+		return fmt.Errorf("PartRebuild index %s rebuild fail, get checkpoint fail! error:%v", alias, err)
 	}
+	checkpointer := NewCheckpointer(alias, job.JobId, currentSliceArgs, totalSliceArgs, position)
+	checkpointer.owner = running.owner
+	log.Printf("PartRebuild index %s resume from checkpoint! currentSlice:%d, totalSlice:%d, position:%s",
+		alias, currentSliceArgs, totalSliceArgs, position)
+
+	//核心处理逻辑
+	err = r.handle(ctx, currentSliceArgs, totalSliceArgs, indexName, withCheckpointer(args, checkpointer))
+	if err != nil {
+		return fmt.Errorf("PartRebuild index %s rebuild fail, handle fail! error:%v", alias, err)
+	}
+	//分片已被重新分配，由新的持有者执行后置处理
+	if !running.owned() {
+		return fmt.Errorf("PartRebuild index %s rebuild fail, slice %d is reassigned", alias, currentSliceArgs)
+	}
+	success = true
 
 	return nil
 }
@@ -128,7 +187,7 @@ func (r *RebuildHandler) PartRebuild(currentSlice int, totalSlice int, args map[
 // PartReload 部分分片数据处理逻辑
 func (r *RebuildHandler) PartReload(currentSlice int, totalSlice int, args map[string]interface{}) error {
 
-	alias := r.rebuild.GetAlias()
+	alias := r.alias()
 	if args == nil || len(args) == 0 {
 		return fmt.Errorf("PartRebuild index %s rebuild fail! args is empty! currentSlice:%d, totalSlice:%d", alias, currentSlice, totalSlice)
 	} else {
@@ -138,12 +197,13 @@ func (r *RebuildHandler) PartReload(currentSlice int, totalSlice int, args map[s
 			return fmt.Errorf("PartRebuild index %s rebuild fail, get or creatre index fail! error:%v", alias, err)
 		}
 
-		indexes := r.rebuild.GetIndexes()
-		currentIndexes := es.Alias.FindIndexNameByAlias(alias)
-		currentIndexName := getCurrentIndexName(currentIndexes, indexes)
+		currentIndexName := currentIndex(alias)
+		if currentIndexName == "" {
+			return fmt.Errorf("PartReload index %s fail, alias has no index!", alias)
+		}
 
 		//核心处理逻辑
-		err = r.rebuild.Handle(currentSliceArgs, totalSliceArgs, currentIndexName, args)
+		err = r.handle(context.Background(), currentSliceArgs, totalSliceArgs, currentIndexName, args)
 		if err != nil {
 			return fmt.Errorf("PartRebuild index %s rebuild fail, handle fail! error:%v", alias, err)
 		}
@@ -155,25 +215,50 @@ func (r *RebuildHandler) PartReload(currentSlice int, totalSlice int, args map[s
 // PartImport 增量索引处理逻辑
 func (r *RebuildHandler) PartImport(record Record, args map[string]interface{}) error {
 
-	alias := r.rebuild.GetAlias()
-	indexes := r.rebuild.GetIndexes()
-	currentIndexes := es.Alias.FindIndexNameByAlias(alias)
-	newIndexName := getNewIndexName(currentIndexes, indexes)
-	currentIndexName := getCurrentIndexName(currentIndexes, indexes)
-
-	var finalIndexes = []string{currentIndexName}
-	//判断新索引是否存在，即判断全量索引当前是否正在处理
-	if indexExists(newIndexName) && newIndexName != currentIndexName {
-		//如果当前正在执行全量索引倒入，临时保存增量数据
-		if !r.storeRecord(&record) {
+	switch record.GetOp() {
+	case OpIndex, OpUpdate, OpDelete:
+	default:
+		return fmt.Errorf("PartImport fail! unknown op:%s, id:%s", record.Op, record.Id)
+	}
+
+	alias := r.alias()
+	currentIndexName := currentIndex(alias)
+
+	var finalIndexes []string
+	if currentIndexName != "" {
+		finalIndexes = append(finalIndexes, currentIndexName)
+	}
+
+	//判断是否有运行中的全量任务
+	job, err := Jobs.Current(alias)
+	if err != nil {
+		log.Printf("PartImport get running job fail! alias:%s, error:%v", alias, err)
+	}
+	if job != nil && job.IndexName != currentIndexName && indexExists(job.IndexName) {
+		newIndexName := job.IndexName
+		//如果当前正在执行全量索引倒入，临时保存增量数据，切换别名后回放
+		if err := r.recordCache().CacheRecord(job.JobId, &record); err != nil {
 			//保存失败，立即倒入
-			log.Printf("PartImport cache newIndexName data fail!, input newIndexName immediately!")
+			log.Printf("PartImport cache newIndexName data fail!, input newIndexName immediately! error:%v", err)
 			finalIndexes = append(finalIndexes, newIndexName)
+		} else {
+			metrics.RecordsBuffered.WithLabelValues(alias).Inc()
+			//任务结束后才开始回放，缓存后任务已结束时回放可能已经读取完成，同时直接写入新索引
+			if latest, err := Jobs.Get(job.JobId); err != nil || latest == nil || latest.IsFinished() {
+				finalIndexes = append(finalIndexes, newIndexName)
+			}
 		}
 	}
 
 	//由rebuild实现的增量倒入
-	err := r.rebuild.HandlePartImport(record, finalIndexes, args)
+	err = r.partImport(record, finalIndexes, args)
+	result := metrics.DocSuccess
+	if err != nil {
+		result = metrics.DocFailed
+	}
+	for _, indexName := range finalIndexes {
+		metrics.DocsIndexed.WithLabelValues(alias, indexName, result).Inc()
+	}
 	if err != nil {
 		return fmt.Errorf("PartImport#handlePartImport fail! error:%v", err)
 	}
@@ -181,53 +266,98 @@ func (r *RebuildHandler) PartImport(record Record, args map[string]interface{})
 	return nil
 }
 
-// HandleScheduleLoad 定时任务
-func (r *RebuildHandler) HandleScheduleLoad() {
-	r.rebuild.HandleScheduleLoad()
-}
-
 // afterHandle 后置处理逻辑
-func (r *RebuildHandler) afterHandle(currentSlice int, totalSlice int, alias string) (err error) {
+func (r *RebuildHandler) afterHandle(jobId string, owner string, currentSlice int, totalSlice int, alias string) (err error) {
 
-	finishCountRedisKey := key.FinishCountRedisKey
-	//获取分布式锁
-	lockKey := finishCountRedisKey.MakeRedisKey(alias)
-	//分片数量递减
-	intCmd := client.RedisClient.IncrBy(context.Background(), lockKey, -1)
-	if intCmd.Err() != nil {
-		return fmt.Errorf("afterHandle incr -1 error! alias:%s, currentSlice: %d, totalSlice:%d, err:%v",
-			alias, currentSlice, totalSlice, intCmd.Err())
+	//任务已取消，不再切换别名
+	if IsCancelled(jobId) {
+		return fmt.Errorf("afterHandle skip! job is cancelled! alias:%s, jobId:%s", alias, jobId)
+	}
+
+	//分片数量递减，计数以任务为维度，任务结束后删除，分片已被重新分配时由新的持有者递减
+	remaining, counted, err := Jobs.CountDownSlice(jobId, currentSlice, owner)
+	if err != nil {
+		return fmt.Errorf("afterHandle count down error! alias:%s, currentSlice: %d, totalSlice:%d, err:%v",
+			alias, currentSlice, totalSlice, err)
+	}
+	if !counted {
+		log.Printf("afterHandle skip! job is finished, slice is counted or reassigned! alias:%s, jobId:%s, slice:%d", alias, jobId, currentSlice)
+		return nil
 	}
 
 	//判断当前分片是否是最后一个分片
-	if intCmd.Val() == 0 {
-		indexes := r.rebuild.GetIndexes()
-		currentIndexes := es.Alias.FindIndexNameByAlias(alias)
-		newIndexName := getNewIndexName(currentIndexes, indexes)
-		currentIndexName := getCurrentIndexName(currentIndexes, indexes)
+	if remaining == 0 {
+		job, err := Jobs.Get(jobId)
+		if err != nil || job == nil {
+			return fmt.Errorf("afterHandle get job fail! alias:%s, jobId:%s, err:%v", alias, jobId, err)
+		}
+		newIndexName := job.IndexName
+		currentIndexName := currentIndex(alias)
+
+		//恢复服务设置并等待索引健康状态，失败时不切换别名
+		if err = r.restoreServingSettings(job); err != nil {
+			log.Printf("afterHandle restore serving settings fail! alias:%s, jobId:%s, err:%v", alias, jobId, err)
+			Jobs.Finish(jobId, JobFailed, err)
+			r.discardRecords(alias, jobId)
+			return err
+		}
+
+		//切换别名前校验，校验失败时保留新索引，任务标记为失败
+		if err = r.validate(job, newIndexName, currentIndexName); err != nil {
+			log.Printf("afterHandle validate fail! alias:%s, jobId:%s, err:%v", alias, jobId, err)
+			notify(EventValidationFailed, alias, jobId, -1, err.Error())
+			Jobs.Finish(jobId, JobFailed, err)
+			r.discardRecords(alias, jobId)
+			return err
+		}
 
 		//处理同步的后置处理
-		err := r.rebuild.SyncAfterHandle(newIndexName, currentIndexName)
+		err = r.beforeSwap(newIndexName, currentIndexName)
 		if err != nil {
-			return fmt.Errorf("afterHandle syncAfterHandle error! alias:%s, currentSlice: %d, totalSlice:%d, err:%v",
-				alias, currentSlice, totalSlice, intCmd.Err())
+			err = fmt.Errorf("afterHandle syncAfterHandle error! alias:%s, currentSlice: %d, totalSlice:%d, err:%v",
+				alias, currentSlice, totalSlice, err)
+			Jobs.Finish(jobId, JobFailed, err)
+			r.discardRecords(alias, jobId)
+			return err
 		}
 
 		//是否需要合并索引
-		if r.rebuild.NeedForceMergeEvent() {
+		if r.needForceMerge() {
 			//处理合并
-			go r.deleteIndexByForceMerge(alias, newIndexName, currentIndexName)
+			go r.deleteIndexByForceMerge(alias, jobId, newIndexName, currentIndexName)
 		} else {
 			//删除旧索引
-			r.syncDeleteIndex(alias, newIndexName, currentIndexName)
+			r.syncDeleteIndex(alias, jobId, newIndexName, currentIndexName)
 		}
 	}
 
 	return err
 }
 
-// createOrGetNewIndex 创建或获取新索引
-func (r *RebuildHandler) createOrGetNewIndex(alias string) (indexName string, err error) {
+// finishSlice 记录分片处理结果
+func (r *RebuildHandler) finishSlice(running *runningSlice, err *error) {
+	r.stopSlice(running)
+	duration := time.Since(running.start).Seconds()
+	//分片已被重新分配，状态由新的持有者更新
+	if !running.owned() {
+		metrics.SliceDuration.WithLabelValues(r.alias(), "reassigned").Observe(duration)
+		log.Printf("finishSlice skip, slice is reassigned! jobId:%s, slice:%d, error:%v", running.jobId, running.slice, *err)
+		return
+	}
+
+	if *err != nil {
+		metrics.SliceDuration.WithLabelValues(r.alias(), string(SliceFailed)).Observe(duration)
+		Jobs.SliceFailed(running.jobId, running.slice, running.owner, *err)
+		notify(EventSliceFailed, r.alias(), running.jobId, running.slice, (*err).Error())
+	} else {
+		metrics.SliceDuration.WithLabelValues(r.alias(), string(SliceSucceeded)).Observe(duration)
+		Jobs.SliceSucceeded(running.jobId, running.slice, running.owner)
+	}
+}
+
+// createOrGetNewIndex 创建或获取新索引，返回新索引所属的全量任务
+// 别名下有运行中的全量任务时使用该任务的新索引，否则生成下一代索引名称并创建新索引
+func (r *RebuildHandler) createOrGetNewIndex(alias string, totalSlice int) (job *Job, err error) {
 
 	redisLockHandler := lock.RedisLockHandler
 	createIndexLockRedisKey := key.CreateIndexLockRedisKey
@@ -244,64 +374,68 @@ func (r *RebuildHandler) createOrGetNewIndex(alias string) (indexName string, er
 		}
 	}(lockKey, isLock, requestId)
 
-	//获取新索引名称
-	indexes := r.rebuild.GetIndexes()
-	currentIndexes := es.Alias.FindIndexNameByAlias(alias)
-	newIndexName := getNewIndexName(currentIndexes, indexes)
 	if isLock {
 
-		//判断新索引是否存在
-		if !indexExists(newIndexName) {
-			//不存在，创建新索引
-			err := r.rebuild.HandleCreateIndex(newIndexName)
-			if err != nil {
-				return "", err
-			} else {
-				indexName = newIndexName
+		//判断是否有运行中的全量任务
+		job, err = Jobs.Current(alias)
+		if err != nil {
+			return nil, err
+		}
+
+		if job != nil && indexExists(job.IndexName) {
+			//存在，使用该任务的新索引
+			if job.TotalSlice != totalSlice {
+				return nil, fmt.Errorf("running job %s has different totalSlice! expect:%d, actual:%d", job.JobId, job.TotalSlice, totalSlice)
 			}
+			return job, nil
+		}
 
-		} else {
-			//存在，使用该索引名称
-			indexName = newIndexName
+		//不存在，生成下一代索引名称并创建新索引
+		newIndexName := NextGenerationName(alias, time.Now(), findGenerations(alias))
+		if err := r.createIndex(newIndexName); err != nil {
+			return nil, err
 		}
-	} else {
-		//未成功加锁
-		count := 0
-		for indexName == "" && count <= 60 {
-			//判断索引是否存在
-			if !indexExists(newIndexName) {
-				//等待
-				count++
-				time.Sleep(1000)
-			} else {
-				//存在，使用该索引名称
-				indexName = newIndexName
-			}
+		log.Printf("createOrGetNewIndex create index success! alias:%s, index:%s", alias, newIndexName)
+
+		job, err = Jobs.Start(alias, newIndexName, totalSlice)
+		if err != nil {
+			return nil, err
 		}
+		//任务已创建，之后的提交由运行中的任务拒绝
+		Dispatcher.release(alias)
+
+		//应用批量写入设置，失败时仍使用创建时的设置写入
+		if err := r.applyBulkSettings(job); err != nil {
+			log.Printf("createOrGetNewIndex apply bulk settings fail! alias:%s, error:%v", alias, err)
+		}
+		notify(EventJobStarted, alias, job.JobId, -1, fmt.Sprintf("rebuild started! index:%s, totalSlice:%d", job.IndexName, job.TotalSlice))
+		return job, nil
+	}
 
-		//等待新索引超时
-		if indexName == "" {
-			log.Panicln("createOrGetNewIndex get new index fail")
+	//未成功加锁，等待持有锁的节点创建新索引
+	for count := 0; count <= 60; count++ {
+		job, err = Jobs.Current(alias)
+		if err == nil && job != nil && indexExists(job.IndexName) {
+			if job.TotalSlice != totalSlice {
+				return nil, fmt.Errorf("running job %s has different totalSlice! expect:%d, actual:%d", job.JobId, job.TotalSlice, totalSlice)
+			}
+			return job, nil
 		}
+		time.Sleep(time.Second)
 	}
 
-	return indexName, err
+	//等待新索引超时
+	return nil, fmt.Errorf("createOrGetNewIndex get new index fail! alias:%s", alias)
 }
 
-// rebuildStart 全量索引开始事件
-func (r *RebuildHandler) rebuildStart(alias string, totalSlice int) {
-	//设置初始任务数量
-	initFinishCount(alias, totalSlice)
+// rebuildStart 全量索引开始事件，分片计数由Jobs.Start初始化
+func (r *RebuildHandler) rebuildStart(alias string, jobId string) {
 	//开启任务超时检查（异步）
-	go r.checkAllTaskTimeout(alias)
-	//开启增量缓存（异步）
-	go r.loopCacheChannel()
-	//开启全量结束后的处理（异步）
-	go r.startRecordCacheHandle()
+	go r.checkAllTaskTimeout(alias, jobId)
 }
 
 // syncDeleteIndex 同步删除索引
-func (r *RebuildHandler) syncDeleteIndex(alias string, newIndexName string, currentIndexName string) {
+func (r *RebuildHandler) syncDeleteIndex(alias string, jobId string, newIndexName string, currentIndexName string) {
 
 	redisLockHandler := lock.RedisLockHandler
 	deleteIndexLockRedisKey := key.DeleteIndexLockRedisKey
@@ -319,39 +453,49 @@ func (r *RebuildHandler) syncDeleteIndex(alias string, newIndexName string, curr
 
 	if isLock {
 		//删除索引
-		r.deleteIndex(alias, newIndexName, currentIndexName)
+		r.deleteIndex(alias, jobId, newIndexName, currentIndexName)
 	}
 }
 
 // deleteIndex 删除索引
-func (r *RebuildHandler) deleteIndex(alias string, newIndexName string, currentIndexName string) {
+func (r *RebuildHandler) deleteIndex(alias string, jobId string, newIndexName string, currentIndexName string) {
 	//由rebuild实现的删除索引
-	if err := r.rebuild.HandleDeleteIndex(newIndexName, currentIndexName); err != nil {
-		fmt.Printf("deleteIndex newIndexKey fail! alias:%s", alias)
+	if err := r.swap(newIndexName, currentIndexName); err != nil {
+		log.Printf("deleteIndex swap fail! alias:%s, error:%v", alias, err)
+		Jobs.Finish(jobId, JobFailed, fmt.Errorf("deleteIndex fail! alias:%s, error:%v", alias, err))
+		r.discardRecords(alias, jobId)
 	} else {
-		fmt.Printf("deleteIndex 开始状态清理完成! alias:%s", alias)
+		log.Printf("deleteIndex swap success! alias:%s, from:%s, to:%s", alias, currentIndexName, newIndexName)
+		//记录切换前的索引，作为回滚的目标
+		if err := Jobs.Swapped(jobId, currentIndexName); err != nil {
+			log.Printf("deleteIndex %v", err)
+		}
+		Jobs.Finish(jobId, JobSucceeded, nil)
+		//新索引由当前的索引定义创建，清除需要重建的标记
+		if err := Jobs.ClearRebuildRequired(alias); err != nil {
+			log.Printf("deleteIndex %v", err)
+		}
+		notify(EventAliasSwapped, alias, jobId, -1, fmt.Sprintf("alias swapped! from:%s, to:%s", currentIndexName, newIndexName))
+		//回放全量期间缓存的增量数据（异步）
+		go r.startRecordCacheHandle(alias, jobId, newIndexName)
+		//删除超出保留数量的旧索引
+		cleanGenerations(alias, r.retainGenerations())
 	}
 
 }
 
 // deleteIndexByForceMerge 合并索引分段
-func (r *RebuildHandler) deleteIndexByForceMerge(alias string, newIndexName string, currentIndexName string) {
+func (r *RebuildHandler) deleteIndexByForceMerge(alias string, jobId string, newIndexName string, currentIndexName string) {
 	//合并索引
 	if err := es.Index.ForceMerge(newIndexName); err != nil {
-		//删除旧索引
-		r.deleteIndex(alias, newIndexName, currentIndexName)
+		log.Printf("deleteIndexByForceMerge force merge fail! alias:%s, index:%s, error:%v", alias, newIndexName, err)
 	}
-
-}
-
-// initFinishCount 初始化任务数量
-func initFinishCount(alias string, totalSlice int) {
-	finishCountKey := key.FinishCountRedisKey.MakeRedisKey(alias)
-	client.RedisClient.SetNX(context.Background(), finishCountKey, totalSlice, time.Duration(key.FinishCountRedisKey.GetExpire()))
+	//删除旧索引
+	r.syncDeleteIndex(alias, jobId, newIndexName, currentIndexName)
 }
 
 // checkAllTaskTimeout 全量检查
-func (r *RebuildHandler) checkAllTaskTimeout(alias string) {
+func (r *RebuildHandler) checkAllTaskTimeout(alias string, jobId string) {
 	//保证检查超时的任务不重复触发
 	result := atomic.CompareAndSwapInt32(&(r.timeoutChecking), 0, 1)
 	if !result {
@@ -366,7 +510,7 @@ func (r *RebuildHandler) checkAllTaskTimeout(alias string) {
 
 	timestamp := time.Now().UnixMilli()
 	//检查超时
-	if r.checkTimeout(alias, timestamp) {
+	if r.checkTimeout(jobId, timestamp) {
 		log.Printf("full reload timeout! alias:%s", alias)
 
 		redisLockHandler := lock.RedisLockHandler
@@ -384,206 +528,93 @@ func (r *RebuildHandler) checkAllTaskTimeout(alias string) {
 		}(lockKey, isLock, requestId)
 
 		if isLock {
+			notify(EventTimeout, alias, jobId, -1, fmt.Sprintf("full reload timeout! timeout:%dms", r.timeout()))
+			Jobs.Finish(jobId, JobFailed, fmt.Errorf("full reload timeout! alias:%s", alias))
+			r.discardRecords(alias, jobId)
 			//由rebuild实现超时处理
-			r.rebuild.TimeoutAlert()
+			r.timeoutAlert()
 		}
 	}
 
 }
 
-// startRecordCacheHandle 开始处理增量数据缓存
-func (r *RebuildHandler) startRecordCacheHandle() {
-	//检查全量索引是否结束
-	if r.checkFullReloadStop() {
-		//如果结束，开始处理缓存的增量数据
-		if r.rebuild.UseCustomCache() {
-			//自定义增量数据重载
-			r.customReloadRecordCache()
-		} else {
-			//默认增量数据重载
-			r.reloadRecordCache()
-		}
-	} else {
-		log.Printf("check full load fail!")
-	}
-}
+// startRecordCacheHandle 回放全量期间缓存的增量数据
+// 切换别名后新索引已经是当前索引，新的增量数据直接写入，缓存中的数据由HandlePartImport重新写入新索引
+func (r *RebuildHandler) startRecordCacheHandle(alias string, jobId string, newIndexName string) {
 
-// customReloadRecordCache 处理自定义缓存加载
-func (r *RebuildHandler) customReloadRecordCache() {
-
-	var id string
-	for {
-		//接收数据，records返回数据，lastId最后一个id，作为下一个查询的参数
-		records, lastId := r.rebuild.LoadRecords(id)
-		if records != nil && len(records) > 0 {
-			//循环处理
-			for _, record := range records {
-				err := r.PartImport(*record, nil)
-				if err != nil {
-					log.Printf("partImport(custom reload cache) handle error! error: %v", err)
-				}
-			}
-			id = lastId
-		} else {
-			break
-		}
+	handled, failed, err := r.recordCache().LoadRecords(jobId, r.replayBatch, func(record Record) error {
+		return r.partImport(record, []string{newIndexName}, make(map[string]interface{}))
+	})
+	if err != nil {
+		log.Printf("startRecordCacheHandle fail! alias:%s, jobId:%s, error:%v", alias, jobId, err)
+		return
 	}
+	log.Printf("startRecordCacheHandle finish! alias:%s, jobId:%s, handled:%d, failed:%d", alias, jobId, handled, failed)
 }
 
-// checkFullReloadStop 检查全量索引是否结束
-func (r *RebuildHandler) checkFullReloadStop() bool {
-
-	finishCountKey := key.FinishCountRedisKey.MakeRedisKey(r.rebuild.GetIndexes())
-	for {
-		stringCmd := client.RedisClient.Get(context.Background(), finishCountKey)
-		count, err := stringCmd.Int()
-		if count <= 0 || err == redis.Nil {
-			return true
-		} else if err != nil {
-			log.Printf("checheck full reload stopc has error! redis throw error! err:%v", err)
-			break
-		} else {
-			time.Sleep(6000)
-		}
-
+// discardRecords 任务失败不会切换别名，删除全量期间缓存的增量数据
+func (r *RebuildHandler) discardRecords(alias string, jobId string) {
+	if err := r.recordCache().ClearRecords(jobId); err != nil {
+		log.Printf("discardRecords fail! alias:%s, jobId:%s, error:%v", alias, jobId, err)
 	}
-	return false
 }
 
-// checkTimeout 超时检查
-func (r *RebuildHandler) checkTimeout(alias string, timestamp int64) bool {
-	finishCountKey := key.FinishCountRedisKey.MakeRedisKey(alias)
-	timeout := r.rebuild.GetTimeout()
+// checkTimeout 超时检查，任务结束后分片计数被删除，检查随之结束
+func (r *RebuildHandler) checkTimeout(jobId string, timestamp int64) bool {
+	timeout := r.timeout()
 
 	var isTimeout = true
 	for (time.Now().UnixMilli() - timestamp) < timeout {
-		stringCmd := client.RedisClient.Get(context.Background(), finishCountKey)
-		count, err := stringCmd.Int()
+		count, err := Jobs.RemainingSlices(jobId)
 		if count <= 0 || err != nil {
 			isTimeout = false
 			break
 		} else {
-			time.Sleep(6000)
+			time.Sleep(6 * time.Second)
 		}
 	}
 	return isTimeout
 
 }
 
-// storeRecord 保存缓存
-func (r *RebuildHandler) storeRecord(record *Record) (res bool) {
-
-	if record == nil {
-		log.Printf("storeRecord fail! record pointer is nil!")
-		return false
-	}
-
-	select {
-	case r.recordChannel <- record:
-		res = true
-	default:
-		res = false
-	}
-
-	return res
-}
-
-// loopCacheChannel 轮询获取增量数据通道
-func (r *RebuildHandler) loopCacheChannel() {
-
-	for {
-		record, ok := <-r.recordChannel
-		if !ok {
-			log.Printf("recordChannel is close!")
-			break
-		}
-
-		if record == nil {
-			log.Printf("loopCacheChannel fail!  record pointer is nil!")
-			continue
-		}
-
-		if r.rebuild.UseCustomCache() {
-			r.rebuild.CacheRecord(record)
-		} else {
-
-			if record.Id == "" {
-				log.Printf("loopCacheChannel fail! record id can not be empty!")
-				continue
-			}
-
-			r.cache.Set(record.Id, record, cache.DefaultExpiration)
-		}
-	}
+// NewRebuildHandler 创建新的索引处理实例，旧的Rebuild实现通过适配器转换为Source
+func NewRebuildHandler(r Rebuild, length int) (handler *RebuildHandler) {
+	return NewSourceHandler(AdaptRebuild(r), length)
 }
 
-// reloadRecordCache 加载增量数据缓存
-func (r *RebuildHandler) reloadRecordCache() {
+// NewSourceHandler 创建新的索引处理实例
+func NewSourceHandler(source Source, length int) (handler *RebuildHandler) {
 
-	if r.cache == nil {
-		log.Print("reload record cache finish! cache is nil!")
-		return
+	if length <= 0 {
+		length = defaultReplayBatch
 	}
 
-	for {
-		items := r.cache.Items()
-		if items == nil || len(items) <= 0 {
-			log.Print("reload record cache finish! cache is empty!")
-			break
-		}
-
-		for k, v := range items {
-			if vr, ok := v.Object.(Record); ok {
-				err := r.PartImport(vr, nil)
-				if err != nil {
-					log.Printf("partImport(reload cache) handle error! error: %v", err)
-				}
-				r.cache.Delete(k)
-			} else {
-				log.Printf("cache value type is not Record! key:%s", k)
-			}
-		}
+	handler = &RebuildHandler{
+		source:      source,
+		replayBatch: int64(length),
+		running:     make(map[*runningSlice]struct{}),
+		//默认使用批量写入设置
+		settingsProfile: DefaultSettingsProfile(),
 	}
-}
-
-// NewRebuildHandler 创建新的索引处理实例
-func NewRebuildHandler(r Rebuild, length int) (handler *RebuildHandler) {
 
 	//检查别名是否为空
-	alias := r.GetAlias()
-	if strings.TrimSpace(alias) == "" {
+	if strings.TrimSpace(handler.alias()) == "" {
 		panic("alias is empty!")
 	}
 
-	//检查索引数组是否为空
-	indexes := r.GetIndexes()
-	for _, v := range indexes {
-		if strings.TrimSpace(v) == "" {
-			panic("index name has empty element!")
-		}
-	}
-
-	//如果Rebuild类不使用自定义增量数据缓存，创建一个默认缓存
-	var c *cache.Cache
-	if !r.UseCustomCache() {
-		c = cache.New(5*time.Minute, 10*time.Minute)
+	//检查保留的索引代数
+	if handler.retainGenerations() < 0 {
+		panic("retain generations can`t be negative")
 	}
 
-	timeout := r.GetTimeout()
-	if timeout == 0 {
+	if handler.timeout() == 0 {
 		panic("timeout can`t be zero")
 	}
 
-	if length == 0 {
-		length = defaultQueueLength
-	}
+	//订阅取消广播
+	go handler.listenCancel()
 
-	return &RebuildHandler{
-		r,
-		0,
-		make(chan *Record, length),
-		c,
-	}
+	return handler
 }
 
 // parseArgs 解析参数
@@ -598,23 +629,40 @@ func parseArgs(args map[string]interface{}) (param1 int, param2 int, err error)
 		return -1, -1, fmt.Errorf("parseArgs 索引分片补偿失败!%s参数为空！ 参数:%s", totalSliceParam, argsStr)
 	}
 
-	currentSliceArgs, ok := currentSliceParamI.(int)
+	currentSliceArgs, ok := toInt(currentSliceParamI)
 	if !ok {
 		return -1, -1, fmt.Errorf("parseArgs 索引分片补偿失败!%s参数异常！参数:%s", currentSliceParam, argsStr)
 	}
 
-	totalSliceParamArgs, ok := totalSliceParamI.(int)
+	totalSliceParamArgs, ok := toInt(totalSliceParamI)
 	if !ok {
 		return -1, -1, fmt.Errorf("parseArgs 索引分片补偿失败!%s参数异常！参数:%s", totalSliceParam, argsStr)
 	}
 
-	if currentSliceArgs < totalSliceParamArgs {
+	if currentSliceArgs < 0 || currentSliceArgs >= totalSliceParamArgs {
 		return -1, -1, fmt.Errorf("parseArgs 索引分片补偿失败!参数异常！参数:%s", argsStr)
 	}
 
 	return currentSliceArgs, totalSliceParamArgs, nil
 }
 
+// toInt 转换分片参数，json解析后的数字类型为float64
+func toInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err == nil
+	default:
+		return 0, false
+	}
+}
+
 // indexExists 索引是否存在
 func indexExists(indexName string) bool {
 	if es.Index.Exists(indexName) && !es.Index.IsClose(indexName) {
@@ -624,73 +672,56 @@ func indexExists(indexName string) bool {
 	}
 }
 
-// getNewIndexName 获取新索引名称
-func getNewIndexName(currentIndexes []string, indexes [2]string) string {
-
-	index1 := indexes[0]
-	index2 := indexes[1]
-
-	if currentIndexes == nil || len(currentIndexes) == 0 {
-		return index1
-	}
-
-	for _, v := range currentIndexes {
-		if v == index1 {
-			return index2
-		}
-	}
-	return index1
-}
-
-// getCurrentIndexName 获取当前索引名称
-func getCurrentIndexName(currentIndexes []string, indexes [2]string) string {
-
-	index1 := indexes[0]
-	index2 := indexes[1]
+// RecordOp 增量数据的操作类型
+type RecordOp string
 
-	if currentIndexes == nil || len(currentIndexes) == 0 {
-		return index2
-	}
-
-	for _, v := range currentIndexes {
-		if v == index1 {
-			return index1
-		}
-	}
-	return index2
-}
+const (
+	// OpIndex 写入整个文档，默认操作
+	OpIndex RecordOp = "index"
+	// OpUpdate 局部更新文档
+	OpUpdate RecordOp = "update"
+	// OpDelete 删除文档
+	OpDelete RecordOp = "delete"
+)
 
 // Record 增量数据结构体
 type Record struct {
 	Id   string      `json:"Id"`
+	Op   RecordOp    `json:"Op,omitempty"`
 	Data interface{} `json:"Data"`
 }
 
+// GetOp 获取操作类型，未设置时为OpIndex
+func (r Record) GetOp() RecordOp {
+	if r.Op == "" {
+		return OpIndex
+	}
+	return r.Op
+}
+
+// Rebuild 旧的全量索引接口，需要实现全部方法，注册时通过AdaptRebuild适配为Source
+// 新的实现使用Source和可选的能力接口
 type Rebuild interface {
 	// GetAlias 获取索引别名
 	GetAlias() string
-	// GetIndexes 获取索引名称
-	GetIndexes() [2]string
-	// Handle 全量索引核心梳理逻辑
-	Handle(currentSlice int, totalSlice int, indexName string, args map[string]interface{}) error
+	// GetRetainGenerations 切换别名后保留的旧索引代数，超出的旧索引会被删除
+	GetRetainGenerations() int
+	// Handle 全量索引核心梳理逻辑，ctx被取消时应尽快返回
+	Handle(ctx context.Context, currentSlice int, totalSlice int, indexName string, args map[string]interface{}) error
 	// HandleCreateIndex 创建索引逻辑
 	HandleCreateIndex(indexName string) error
 	// HandleDeleteIndex 删除索引逻辑
 	HandleDeleteIndex(newIndexName string, oldIndexName string) error
 	// HandlePartImport 增量索引逻辑
 	HandlePartImport(r Record, indexes []string, args map[string]interface{}) error
-	// HandleScheduleLoad 定时任务处理逻辑
+	// HandleScheduleLoad 定时任务处理逻辑，由Scheduler按GetSchedules中ScheduleLoad类型的定时配置触发
 	HandleScheduleLoad()
+	// GetSchedules 获取定时配置，没有定时任务时返回nil
+	GetSchedules() []Schedule
 	// SyncAfterHandle 同步的全量索引后置处理逻辑
 	SyncAfterHandle(newIndexName string, oldIndexName string) error
 	// NeedForceMergeEvent 是否需要合并索引
 	NeedForceMergeEvent() bool
-	// UseCustomCache 是否需要自定义缓存增量数据
-	UseCustomCache() bool
-	// CacheRecord 缓存增量数据
-	CacheRecord(record *Record)
-	// LoadRecords 加载增量数据
-	LoadRecords(id string) (records []*Record, lastId string)
 	// GetTimeout 获取超时时间
 	GetTimeout() int64
 	// TimeoutAlert 超时处理逻辑
@@ -0,0 +1,138 @@
+package rebuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+var (
+	Registry = &registry{handlers: make(map[string]*RebuildHandler)}
+)
+
+// AliasInfo 已注册别名的索引信息
+type AliasInfo struct {
+	Alias        string   `json:"alias"`
+	CurrentIndex string   `json:"currentIndex"`
+	NextIndex    string   `json:"nextIndex"`
+	RunningJobId string   `json:"runningJobId"`
+	Generations  []string `json:"generations"`
+	//索引定义变化，需要重建索引
+	RebuildRequired bool   `json:"rebuildRequired"`
+	RebuildReason   string `json:"rebuildReason,omitempty"`
+}
+
+// registry 以索引别名为key的RebuildHandler注册表
+type registry struct {
+	lock     sync.RWMutex
+	handlers map[string]*RebuildHandler
+}
+
+// Register 注册旧的Rebuild实现，返回该别名的RebuildHandler，别名重复注册或定时配置错误时panic
+func (g *registry) Register(r Rebuild, length int) *RebuildHandler {
+	return g.RegisterSource(AdaptRebuild(r), length)
+}
+
+// RegisterSource 注册Source实现，返回该别名的RebuildHandler，别名重复注册或定时配置错误时panic
+func (g *registry) RegisterSource(source Source, length int) *RebuildHandler {
+
+	handler := NewSourceHandler(source, length)
+	alias := handler.alias()
+	if err := handler.validateSchedules(); err != nil {
+		panic(err.Error())
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if _, ok := g.handlers[alias]; ok {
+		panic(fmt.Sprintf("alias %s is already registered!", alias))
+	}
+	g.handlers[alias] = handler
+	log.Printf("registry register rebuild! alias:%s", alias)
+
+	return handler
+}
+
+// Get 获取别名的RebuildHandler
+func (g *registry) Get(alias string) (*RebuildHandler, bool) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	handler, ok := g.handlers[alias]
+	return handler, ok
+}
+
+// Aliases 获取所有已注册的别名
+func (g *registry) Aliases() []string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	aliases := make([]string, 0, len(g.handlers))
+	for alias := range g.handlers {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// List 获取所有已注册别名的当前索引和正在构建的新索引
+func (g *registry) List() []*AliasInfo {
+
+	aliases := g.Aliases()
+	infos := make([]*AliasInfo, 0, len(aliases))
+	for _, alias := range aliases {
+		info := &AliasInfo{
+			Alias:        alias,
+			CurrentIndex: currentIndex(alias),
+			Generations:  findGenerations(alias),
+		}
+
+		if reason, err := Jobs.RebuildRequired(alias); err != nil {
+			log.Printf("registry list get rebuild required fail! %v", err)
+		} else {
+			info.RebuildRequired = reason != ""
+			info.RebuildReason = reason
+		}
+
+		job, err := Jobs.Current(alias)
+		if err != nil {
+			log.Printf("registry list get running job fail! alias:%s, error:%v", alias, err)
+		} else if job != nil {
+			info.NextIndex = job.IndexName
+			info.RunningJobId = job.JobId
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// DecodeRecordData 将增量数据的Data解析到v中
+// Data可能是调用方传入的结构体，也可能是通过接口或缓存反序列化得到的map
+func DecodeRecordData(record Record, v interface{}) error {
+
+	if record.Data == nil {
+		return fmt.Errorf("record data is empty! id:%s", record.Id)
+	}
+
+	var data []byte
+	var err error
+	switch d := record.Data.(type) {
+	case json.RawMessage:
+		data = d
+	case []byte:
+		data = d
+	default:
+		data, err = json.Marshal(d)
+		if err != nil {
+			return fmt.Errorf("record data marshal fail! id:%s, error:%v", record.Id, err)
+		}
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("record data unmarshal fail! id:%s, error:%v", record.Id, err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package rebuild
+
+import (
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/redis/key"
+	"elasticsearch-data-import-go/redis/lock"
+	"fmt"
+	"log"
+)
+
+// Rollback 将别名回滚到最近一次切换前的索引
+func (r *RebuildHandler) Rollback() (*Job, error) {
+	return Rollback(r.alias())
+}
+
+// Rollback 将别名回滚到最近一次切换前的索引
+// 目标索引已关闭时先打开，再切换别名，回滚记录保存在任务历史中
+func Rollback(alias string) (*Job, error) {
+
+	//全量任务运行中时不允许回滚，避免任务结束后再次切换别名
+	if job, err := Jobs.Current(alias); err != nil {
+		return nil, fmt.Errorf("rollback fail! alias:%s, error:%v", alias, err)
+	} else if job != nil {
+		return nil, fmt.Errorf("rollback fail! alias:%s, job %s is running", alias, job.JobId)
+	}
+
+	//与切换别名使用同一把锁
+	redisLockHandler := lock.RedisLockHandler
+	deleteIndexLockRedisKey := key.DeleteIndexLockRedisKey
+	requestId := redisLockHandler.GetRequestId()
+	lockKey := deleteIndexLockRedisKey.MakeRedisKey(alias)
+	isLock := redisLockHandler.Lock(lockKey, requestId, deleteIndexLockRedisKey.GetExpire())
+	if !isLock {
+		return nil, fmt.Errorf("rollback fail! alias:%s, alias is switching", alias)
+	}
+	defer redisLockHandler.UnLock(lockKey, requestId)
+
+	currentIndexName := currentIndex(alias)
+	if currentIndexName == "" {
+		return nil, fmt.Errorf("rollback fail! alias:%s, alias has no index", alias)
+	}
+
+	history, err := Jobs.History(alias, 0)
+	if err != nil {
+		return nil, fmt.Errorf("rollback fail! alias:%s, error:%v", alias, err)
+	}
+	previousIndexName := RollbackTarget(currentIndexName, history)
+	if previousIndexName == "" {
+		return nil, fmt.Errorf("rollback fail! alias:%s, no successful swap to index %s in job history", alias, currentIndexName)
+	}
+	//切换前的索引已被清理时不允许回滚
+	if !es.Index.Exists(previousIndexName) {
+		return nil, fmt.Errorf("rollback fail! alias:%s, previous index %s is gone", alias, previousIndexName)
+	}
+
+	err = switchAlias(alias, currentIndexName, previousIndexName)
+	job, recordErr := Jobs.Rollback(alias, currentIndexName, previousIndexName, err)
+	if recordErr != nil {
+		log.Printf("rollback record fail! alias:%s, error:%v", alias, recordErr)
+	}
+	if err != nil {
+		return job, err
+	}
+
+	log.Printf("rollback success! alias:%s, from:%s, to:%s", alias, currentIndexName, previousIndexName)
+	jobId := ""
+	if job != nil {
+		jobId = job.JobId
+	}
+	notify(EventRolledBack, alias, jobId, -1, fmt.Sprintf("rolled back! from:%s, to:%s", currentIndexName, previousIndexName))
+	return job, nil
+}
+
+// switchAlias 打开目标索引并将别名从from切换到to
+func switchAlias(alias string, from string, to string) error {
+
+	if es.Index.IsClose(to) && !es.Index.Open(to) {
+		return fmt.Errorf("rollback fail! alias:%s, open index %s fail", alias, to)
+	}
+
+	if !es.Alias.Swap(alias, from, to) {
+		return fmt.Errorf("rollback fail! alias:%s, swap alias from index %s to %s fail", alias, from, to)
+	}
+
+	return nil
+}
+
+// RollbackTarget 获取回滚的目标索引，history按开始时间倒序
+// 目标为最近一次成功切换到当前索引的全量任务切换前的索引，未通过校验的索引不会被切换，也不会成为回滚目标
+func RollbackTarget(currentIndexName string, history []*Job) string {
+
+	for _, job := range history {
+		if job.Type != JobTypeRebuild || job.Status != JobSucceeded {
+			continue
+		}
+		if job.IndexName == currentIndexName {
+			return job.FromIndex
+		}
+	}
+	return ""
+}
@@ -0,0 +1,347 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"elasticsearch-data-import-go/redis/lock"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/robfig/cron/v3"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ScheduleAction 定时任务的操作
+type ScheduleAction string
+
+// OverlapPolicy 上一次执行未结束时的处理方式
+type OverlapPolicy string
+
+// MissedPolicy 错过触发时间（例如所有节点都停机）时的处理方式
+type MissedPolicy string
+
+const (
+	// ScheduleFullRebuild 通过Dispatcher提交分布式全量索引
+	ScheduleFullRebuild ScheduleAction = "fullRebuild"
+	// ScheduleLoad 调用ScheduleLoader.HandleScheduleLoad
+	ScheduleLoad ScheduleAction = "scheduleLoad"
+
+	// OverlapSkip 上一次执行未结束时跳过本次，默认
+	OverlapSkip OverlapPolicy = "skip"
+	// OverlapAllow 允许同时执行，只对ScheduleLoad有效，同一别名同时只能有一个全量任务
+	OverlapAllow OverlapPolicy = "allow"
+
+	// MissedSkip 错过的触发全部跳过，等待下一次触发，默认
+	MissedSkip MissedPolicy = "skip"
+	// MissedRunOnce 错过的触发合并为一次立即执行
+	MissedRunOnce MissedPolicy = "runOnce"
+
+	// scheduleInterval 检查定时任务的间隔
+	scheduleInterval = 5 * time.Second
+	// scheduleGrace 触发时间过去不超过该时间时仍然执行，超过后按MissedPolicy处理
+	scheduleGrace = time.Minute
+	// maxMissedTicks 计算错过的触发次数的上限
+	maxMissedTicks = 100000
+)
+
+var (
+	Scheduler = &scheduler{rdb: client.RedisClient}
+)
+
+// Schedule 别名的定时配置
+type Schedule struct {
+	// Name 定时任务名称，同一别名下唯一
+	Name string `json:"name"`
+	// Spec 标准的5位cron表达式，也支持@daily、@every 1m等写法，使用服务器时区
+	Spec   string         `json:"spec"`
+	Action ScheduleAction `json:"action"`
+	// TotalSlice ScheduleFullRebuild的分片数量，默认1
+	TotalSlice int                    `json:"totalSlice"`
+	Args       map[string]interface{} `json:"args"`
+	Overlap    OverlapPolicy          `json:"overlap"`
+	Missed     MissedPolicy           `json:"missed"`
+	// Timeout ScheduleLoad的最长执行时间，超过后不再认为上一次执行未结束，默认1小时
+	Timeout time.Duration `json:"timeout"`
+}
+
+// ScheduleStatus 定时任务的状态
+type ScheduleStatus struct {
+	Alias string `json:"alias"`
+	Schedule
+	// LastTick 最近一次处理的触发时间（毫秒），包括因重叠或错过而跳过的触发
+	LastTick int64 `json:"lastTick"`
+	// NextTick 下一次触发时间（毫秒）
+	NextTick int64 `json:"nextTick"`
+	// Running ScheduleLoad是否正在执行
+	Running bool `json:"running"`
+}
+
+// Due 计算last之后到now为止最近的一次触发时间，没有触发时tick为零值
+// 触发时间过去超过scheduleGrace且MissedPolicy为MissedSkip时fire为false
+func (s Schedule) Due(last time.Time, now time.Time) (tick time.Time, fire bool, err error) {
+
+	spec, err := cron.ParseStandard(s.Spec)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("schedule parse fail! name:%s, spec:%s, error:%v", s.Name, s.Spec, err)
+	}
+
+	next := spec.Next(last)
+	if next.IsZero() || next.After(now) {
+		return time.Time{}, false, nil
+	}
+
+	tick = next
+	for i := 0; i < maxMissedTicks; i++ {
+		next = spec.Next(tick)
+		if next.IsZero() || next.After(now) {
+			break
+		}
+		tick = next
+	}
+
+	if now.Sub(tick) <= scheduleGrace || s.Missed == MissedRunOnce {
+		return tick, true, nil
+	}
+	return tick, false, nil
+}
+
+// Validate 检查定时配置
+func (s Schedule) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("schedule name can not be empty! spec:%s", s.Spec)
+	}
+	if _, err := cron.ParseStandard(s.Spec); err != nil {
+		return fmt.Errorf("schedule parse fail! name:%s, spec:%s, error:%v", s.Name, s.Spec, err)
+	}
+	switch s.Action {
+	case ScheduleFullRebuild, ScheduleLoad:
+	default:
+		return fmt.Errorf("schedule action is invalid! name:%s, action:%s", s.Name, s.Action)
+	}
+	return nil
+}
+
+// timeout ScheduleLoad的最长执行时间
+func (s Schedule) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return key.ScheduleRunningRedisKey.GetExpire()
+}
+
+// validateSchedules 检查别名的所有定时配置，名称不能重复，ScheduleLoad类型需要实现ScheduleLoader
+func (r *RebuildHandler) validateSchedules() error {
+	alias := r.alias()
+	_, loader := r.source.(ScheduleLoader)
+	names := make(map[string]bool)
+	for _, schedule := range r.GetSchedules() {
+		if err := schedule.Validate(); err != nil {
+			return fmt.Errorf("alias:%s, %v", alias, err)
+		}
+		if schedule.Action == ScheduleLoad && !loader {
+			return fmt.Errorf("alias:%s, schedule %s requires ScheduleLoader", alias, schedule.Name)
+		}
+		if names[schedule.Name] {
+			return fmt.Errorf("alias:%s, schedule %s is duplicated", alias, schedule.Name)
+		}
+		names[schedule.Name] = true
+	}
+	return nil
+}
+
+// scheduler 定时任务调度
+// 每个节点定时检查，通过redis锁保证同一时间只有一个节点检查，每个定时任务最近一次处理的触发时间保存在redis中，
+// 同一次触发只会被处理一次
+type scheduler struct {
+	rdb  *redis.Client
+	once sync.Once
+}
+
+// Run 启动当前节点的定时检查，每个节点只启动一次
+func (s *scheduler) Run() {
+	s.once.Do(func() {
+		go s.loop()
+		log.Printf("scheduler run! nodeId:%s", nodeId)
+	})
+}
+
+// loop 定时检查所有别名的定时任务
+func (s *scheduler) loop() {
+
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		redisLockHandler := lock.RedisLockHandler
+		requestId := redisLockHandler.GetRequestId()
+		lockKey := key.SchedulerLockRedisKey.GetKey()
+		if !redisLockHandler.Lock(lockKey, requestId, key.SchedulerLockRedisKey.GetExpire()) {
+			continue
+		}
+		s.check(time.Now())
+		redisLockHandler.UnLock(lockKey, requestId)
+	}
+}
+
+// check 检查并触发到期的定时任务
+func (s *scheduler) check(now time.Time) {
+	for _, alias := range Registry.Aliases() {
+		handler, ok := Registry.Get(alias)
+		if !ok {
+			continue
+		}
+		for _, schedule := range handler.GetSchedules() {
+			s.checkSchedule(alias, handler, schedule, now)
+		}
+	}
+}
+
+// checkSchedule 检查一个定时任务，先保存触发时间再执行，保证同一次触发只处理一次
+func (s *scheduler) checkSchedule(alias string, handler *RebuildHandler, schedule Schedule, now time.Time) {
+
+	last, ok, err := s.lastTick(alias, schedule.Name)
+	if err != nil {
+		log.Printf("scheduler get last tick fail! alias:%s, schedule:%s, error:%v", alias, schedule.Name, err)
+		return
+	}
+	if !ok {
+		//第一次发现该定时任务，从当前时间开始计算
+		if err := s.saveTick(alias, schedule.Name, now); err != nil {
+			log.Printf("scheduler save tick fail! alias:%s, schedule:%s, error:%v", alias, schedule.Name, err)
+		}
+		return
+	}
+
+	tick, fire, err := schedule.Due(last, now)
+	if err != nil {
+		log.Printf("scheduler check fail! alias:%s, %v", alias, err)
+		return
+	}
+	if tick.IsZero() {
+		return
+	}
+	if err := s.saveTick(alias, schedule.Name, tick); err != nil {
+		log.Printf("scheduler save tick fail! alias:%s, schedule:%s, error:%v", alias, schedule.Name, err)
+		return
+	}
+	if !fire {
+		log.Printf("scheduler skip missed tick! alias:%s, schedule:%s, tick:%v", alias, schedule.Name, tick)
+		return
+	}
+
+	s.fire(alias, handler, schedule, tick)
+}
+
+// fire 执行定时任务
+func (s *scheduler) fire(alias string, handler *RebuildHandler, schedule Schedule, tick time.Time) {
+
+	switch schedule.Action {
+	case ScheduleFullRebuild:
+		if job, err := Jobs.Current(alias); err != nil {
+			log.Printf("scheduler fire fail! alias:%s, schedule:%s, error:%v", alias, schedule.Name, err)
+			return
+		} else if job != nil {
+			log.Printf("scheduler skip overlapped tick! alias:%s, schedule:%s, tick:%v, running job:%s", alias, schedule.Name, tick, job.JobId)
+			return
+		}
+
+		totalSlice := defaultInt(schedule.TotalSlice, 1)
+		if _, err := Dispatcher.Submit(alias, totalSlice, schedule.Args); err != nil {
+			log.Printf("scheduler fire fail! alias:%s, schedule:%s, error:%v", alias, schedule.Name, err)
+			return
+		}
+	case ScheduleLoad:
+		runningKey := key.ScheduleRunningRedisKey.MakeRedisKey(alias, schedule.Name)
+		if schedule.Overlap != OverlapAllow {
+			ok, err := s.rdb.SetNX(context.Background(), runningKey, nodeId, schedule.timeout()).Result()
+			if err != nil {
+				log.Printf("scheduler fire fail! alias:%s, schedule:%s, error:%v", alias, schedule.Name, err)
+				return
+			}
+			if !ok {
+				log.Printf("scheduler skip overlapped tick! alias:%s, schedule:%s, tick:%v", alias, schedule.Name, tick)
+				return
+			}
+		}
+
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("scheduler schedule load panic! alias:%s, schedule:%s, error:%v", alias, schedule.Name, err)
+				}
+				if schedule.Overlap != OverlapAllow {
+					s.rdb.Del(context.Background(), runningKey)
+				}
+			}()
+			handler.HandleScheduleLoad()
+			log.Printf("scheduler schedule load finish! alias:%s, schedule:%s, tick:%v", alias, schedule.Name, tick)
+		}()
+	}
+
+	log.Printf("scheduler fire! alias:%s, schedule:%s, action:%s, tick:%v", alias, schedule.Name, schedule.Action, tick)
+}
+
+// List 获取别名所有定时任务的状态
+func (s *scheduler) List(alias string) ([]*ScheduleStatus, error) {
+
+	handler, ok := Registry.Get(alias)
+	if !ok {
+		return nil, fmt.Errorf("scheduler list fail! alias %s is not registered", alias)
+	}
+
+	now := time.Now()
+	schedules := handler.GetSchedules()
+	statuses := make([]*ScheduleStatus, 0, len(schedules))
+	for _, schedule := range schedules {
+		status := &ScheduleStatus{Alias: alias, Schedule: schedule}
+
+		last, ok, err := s.lastTick(alias, schedule.Name)
+		if err != nil {
+			return nil, fmt.Errorf("scheduler list fail! alias:%s, schedule:%s, error:%v", alias, schedule.Name, err)
+		}
+		if ok {
+			status.LastTick = last.UnixMilli()
+		}
+		if spec, err := cron.ParseStandard(schedule.Spec); err == nil {
+			status.NextTick = spec.Next(now).UnixMilli()
+		}
+
+		count, err := s.rdb.Exists(context.Background(), key.ScheduleRunningRedisKey.MakeRedisKey(alias, schedule.Name)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("scheduler list fail! alias:%s, schedule:%s, error:%v", alias, schedule.Name, err)
+		}
+		status.Running = count > 0
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// lastTick 获取定时任务最近一次处理的触发时间，没有记录时ok为false
+func (s *scheduler) lastTick(alias string, name string) (time.Time, bool, error) {
+
+	value, err := s.rdb.HGet(context.Background(), key.ScheduleRedisKey.GetKey(), scheduleField(alias, name)).Result()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.UnixMilli(millis), true, nil
+}
+
+// saveTick 保存定时任务最近一次处理的触发时间
+func (s *scheduler) saveTick(alias string, name string, tick time.Time) error {
+	return s.rdb.HSet(context.Background(), key.ScheduleRedisKey.GetKey(), scheduleField(alias, name), tick.UnixMilli()).Err()
+}
+
+// scheduleField 定时任务在hash中的field
+func scheduleField(alias string, name string) string {
+	return alias + "#" + name
+}
@@ -0,0 +1,115 @@
+package rebuild
+
+import (
+	"elasticsearch-data-import-go/es"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// defaultHealthTimeout 默认等待索引健康状态的超时时间
+	defaultHealthTimeout = 5 * time.Minute
+)
+
+// SettingsProfile 全量索引期间的索引设置
+// 新索引创建后应用Bulk设置加快写入，切换别名前恢复Serving设置，刷新并等待索引健康状态达到HealthStatus
+type SettingsProfile struct {
+	// Bulk 批量写入期间的设置
+	Bulk map[string]interface{}
+	// Serving 对外服务的设置，为空时恢复新索引创建时的设置
+	Serving map[string]interface{}
+	// HealthStatus 切换别名前等待的健康状态，默认green
+	HealthStatus string
+	// HealthTimeout 等待健康状态的超时时间，默认5分钟
+	HealthTimeout time.Duration
+}
+
+// DefaultSettingsProfile 默认的索引设置：不刷新、没有副本、异步写translog
+func DefaultSettingsProfile() *SettingsProfile {
+	return &SettingsProfile{
+		Bulk: map[string]interface{}{
+			"index.refresh_interval":    "-1",
+			"index.number_of_replicas":  "0",
+			"index.translog.durability": "async",
+		},
+		HealthStatus:  "green",
+		HealthTimeout: defaultHealthTimeout,
+	}
+}
+
+// SetSettingsProfile 设置全量索引期间的索引设置，profile为nil时不调整索引设置
+func (r *RebuildHandler) SetSettingsProfile(profile *SettingsProfile) {
+	r.settingsProfile = profile
+}
+
+// applyBulkSettings 记录新索引的服务设置并应用批量写入设置
+func (r *RebuildHandler) applyBulkSettings(job *Job) error {
+
+	profile := r.settingsProfile
+	if profile == nil || len(profile.Bulk) == 0 {
+		return nil
+	}
+
+	serving := profile.Serving
+	if serving == nil {
+		current, err := es.Index.GetSettings(job.IndexName)
+		if err != nil {
+			return fmt.Errorf("apply bulk settings fail! index:%s, error:%v", job.IndexName, err)
+		}
+		//创建时没有设置的项恢复为默认值
+		serving = make(map[string]interface{}, len(profile.Bulk))
+		for k := range profile.Bulk {
+			serving[k] = current[k]
+		}
+	}
+
+	//切换别名的节点不一定是创建索引的节点，服务设置保存在任务中
+	if err := Jobs.SaveServingSettings(job.JobId, serving); err != nil {
+		return err
+	}
+
+	if err := es.Index.PutSettings(job.IndexName, profile.Bulk); err != nil {
+		return fmt.Errorf("apply bulk settings fail! index:%s, error:%v", job.IndexName, err)
+	}
+	log.Printf("apply bulk settings success! alias:%s, index:%s", job.Alias, job.IndexName)
+	return nil
+}
+
+// restoreServingSettings 恢复新索引的服务设置，刷新并等待健康状态
+func (r *RebuildHandler) restoreServingSettings(job *Job) error {
+
+	profile := r.settingsProfile
+	if profile == nil || len(profile.Bulk) == 0 {
+		return nil
+	}
+
+	serving, err := Jobs.ServingSettings(job.JobId)
+	if err != nil {
+		return err
+	}
+	if len(serving) > 0 {
+		if err := es.Index.PutSettings(job.IndexName, serving); err != nil {
+			return fmt.Errorf("restore serving settings fail! index:%s, error:%v", job.IndexName, err)
+		}
+	}
+
+	if err := es.Index.Refresh(job.IndexName); err != nil {
+		return fmt.Errorf("restore serving settings refresh fail! index:%s, error:%v", job.IndexName, err)
+	}
+
+	status := profile.HealthStatus
+	if status == "" {
+		status = "green"
+	}
+	timeout := profile.HealthTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	if err := es.Index.WaitForStatus(job.IndexName, status, timeout); err != nil {
+		return fmt.Errorf("restore serving settings wait for health fail! index:%s, error:%v", job.IndexName, err)
+	}
+
+	log.Printf("restore serving settings success! alias:%s, index:%s", job.Alias, job.IndexName)
+	return nil
+}
@@ -0,0 +1,379 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultShadowTopN 默认比较的命中数量
+	defaultShadowTopN = 10
+	// defaultShadowMaxErrorRate 默认允许的查询失败比例
+	defaultShadowMaxErrorRate = 0.1
+	// maxCapturedQueries 每个别名最多保存的捕获查询数量，超过后丢弃最早的查询
+	maxCapturedQueries = 100
+	// capturedQueryPrefix 捕获查询的名称前缀
+	capturedQueryPrefix = "captured#"
+)
+
+var (
+	ShadowQueries = shadowQueryStore{client.RedisClient}
+)
+
+// ShadowQuery 切换别名前在当前索引和新索引上重放的查询
+type ShadowQuery struct {
+	Name string `json:"name"`
+	// Body 查询请求体，size、_source、from会被覆盖
+	Body map[string]interface{} `json:"body"`
+}
+
+// ShadowResult 单个查询在当前索引和新索引上的比较结果
+type ShadowResult struct {
+	Name       string   `json:"name"`
+	CurrentIds []string `json:"currentIds"`
+	NewIds     []string `json:"newIds"`
+	// Overlap 两个索引前N条命中的重合比例，1表示完全相同
+	Overlap float64 `json:"overlap"`
+	// RankDistance 两个索引前N条命中的排名差异，0表示排名完全相同，1表示完全不相交
+	RankDistance float64 `json:"rankDistance"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// ShadowReport 切换别名前的查询比较报告
+type ShadowReport struct {
+	Alias            string          `json:"alias"`
+	JobId            string          `json:"jobId"`
+	NewIndexName     string          `json:"newIndexName"`
+	CurrentIndexName string          `json:"currentIndexName"`
+	TopN             int             `json:"topN"`
+	Results          []*ShadowResult `json:"results"`
+	// Overlap 所有成功查询的平均重合比例
+	Overlap float64 `json:"overlap"`
+	// RankDistance 所有成功查询的平均排名差异
+	RankDistance float64 `json:"rankDistance"`
+	// ErrorRate 在任一索引上执行失败的查询比例
+	ErrorRate float64 `json:"errorRate"`
+	// Diverged 平均值或失败比例超过阈值，没有成功比较的查询时同样视为差异过大
+	Diverged bool  `json:"diverged"`
+	Blocked  bool  `json:"blocked"`
+	Time     int64 `json:"time"`
+}
+
+// shadowQueryStore 保存的查询在以别名为key的hash中，field为查询名称
+// 捕获的查询在以别名为key的list中，只保留最近maxCapturedQueries条
+type shadowQueryStore struct {
+	rdb *redis.Client
+}
+
+// Save 保存查询，同名查询会被覆盖
+func (s shadowQueryStore) Save(alias string, query *ShadowQuery) error {
+
+	if strings.TrimSpace(query.Name) == "" || len(query.Body) == 0 {
+		return fmt.Errorf("shadow query save fail! name and body can not be empty! alias:%s", alias)
+	}
+
+	data, err := json.Marshal(query)
+	if err != nil {
+		return fmt.Errorf("shadow query save fail! alias:%s, name:%s, error:%v", alias, query.Name, err)
+	}
+	if err := s.rdb.HSet(context.Background(), key.ShadowQueryRedisKey.MakeRedisKey(alias), query.Name, string(data)).Err(); err != nil {
+		return fmt.Errorf("shadow query save fail! alias:%s, name:%s, error:%v", alias, query.Name, err)
+	}
+	return nil
+}
+
+// Delete 删除保存的查询
+func (s shadowQueryStore) Delete(alias string, name string) error {
+	if err := s.rdb.HDel(context.Background(), key.ShadowQueryRedisKey.MakeRedisKey(alias), name).Err(); err != nil {
+		return fmt.Errorf("shadow query delete fail! alias:%s, name:%s, error:%v", alias, name, err)
+	}
+	return nil
+}
+
+// Capture 捕获一次线上查询，由查询ES的搜索接口调用，失败只记录日志，不影响搜索
+func (s shadowQueryStore) Capture(alias string, body map[string]interface{}) {
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("shadow query capture fail! alias:%s, error:%v", alias, err)
+		return
+	}
+
+	ctx := context.Background()
+	captureKey := key.ShadowCaptureRedisKey.MakeRedisKey(alias)
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, captureKey, string(data))
+		pipe.LTrim(ctx, captureKey, 0, maxCapturedQueries-1)
+		pipe.Expire(ctx, captureKey, key.ShadowCaptureRedisKey.GetExpire())
+		return nil
+	})
+	if err != nil {
+		log.Printf("shadow query capture fail! alias:%s, error:%v", alias, err)
+	}
+}
+
+// SampleCapture 按采样率异步捕获线上查询，rate为0到1之间的采样比例，不阻塞搜索
+func (s shadowQueryStore) SampleCapture(alias string, rate float64, body map[string]interface{}) {
+	if rate <= 0 || rand.Float64() >= rate {
+		return
+	}
+	go s.Capture(alias, body)
+}
+
+// List 获取保存的查询和捕获的查询，保存的查询按名称排序在前
+func (s shadowQueryStore) List(alias string) ([]*ShadowQuery, error) {
+
+	ctx := context.Background()
+	saved, err := s.rdb.HGetAll(ctx, key.ShadowQueryRedisKey.MakeRedisKey(alias)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("shadow query list fail! alias:%s, error:%v", alias, err)
+	}
+	captured, err := s.rdb.LRange(ctx, key.ShadowCaptureRedisKey.MakeRedisKey(alias), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("shadow query list fail! alias:%s, error:%v", alias, err)
+	}
+
+	queries := make([]*ShadowQuery, 0, len(saved)+len(captured))
+	for _, data := range saved {
+		var query ShadowQuery
+		if err := json.Unmarshal([]byte(data), &query); err != nil {
+			log.Printf("shadow query list skip! alias:%s, error:%v", alias, err)
+			continue
+		}
+		queries = append(queries, &query)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].Name < queries[j].Name
+	})
+
+	for i, data := range captured {
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &body); err != nil {
+			log.Printf("shadow query list skip! alias:%s, error:%v", alias, err)
+			continue
+		}
+		queries = append(queries, &ShadowQuery{Name: fmt.Sprintf("%s%d", capturedQueryPrefix, i), Body: body})
+	}
+	return queries, nil
+}
+
+// SaveReport 保存任务的查询比较报告
+func (s shadowQueryStore) SaveReport(report *ShadowReport) error {
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("shadow report save fail! jobId:%s, error:%v", report.JobId, err)
+	}
+	reportKey := key.ShadowReportRedisKey.MakeRedisKey(report.JobId)
+	if err := s.rdb.Set(context.Background(), reportKey, string(data), key.ShadowReportRedisKey.GetExpire()).Err(); err != nil {
+		return fmt.Errorf("shadow report save fail! jobId:%s, error:%v", report.JobId, err)
+	}
+	return nil
+}
+
+// GetReport 获取任务的查询比较报告，不存在时返回nil
+func (s shadowQueryStore) GetReport(jobId string) (*ShadowReport, error) {
+
+	data, err := s.rdb.Get(context.Background(), key.ShadowReportRedisKey.MakeRedisKey(jobId)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("shadow report get fail! jobId:%s, error:%v", jobId, err)
+	}
+
+	var report ShadowReport
+	if err := json.Unmarshal([]byte(data), &report); err != nil {
+		return nil, fmt.Errorf("shadow report get fail! jobId:%s, error:%v", jobId, err)
+	}
+	return &report, nil
+}
+
+// CompareHits 比较两个有序的命中列表
+// overlap为交集大小除以较长列表的长度，两个列表都为空时为1
+// rankDistance为归一化的Spearman footrule距离，不在列表中的文档排名记为列表长度
+func CompareHits(current []string, candidate []string) (overlap float64, rankDistance float64) {
+
+	k := len(current)
+	if len(candidate) > k {
+		k = len(candidate)
+	}
+	if k == 0 {
+		return 1, 0
+	}
+
+	currentRanks := make(map[string]int, len(current))
+	for i, id := range current {
+		currentRanks[id] = i
+	}
+	candidateRanks := make(map[string]int, len(candidate))
+	for i, id := range candidate {
+		candidateRanks[id] = i
+	}
+
+	rank := func(ranks map[string]int, id string) int {
+		if r, ok := ranks[id]; ok {
+			return r
+		}
+		return k
+	}
+
+	var common, distance, maxDistance int
+	for i, id := range current {
+		if _, ok := candidateRanks[id]; ok {
+			common++
+		}
+		distance += abs(i - rank(candidateRanks, id))
+		maxDistance += k - i
+	}
+	for i, id := range candidate {
+		if _, ok := currentRanks[id]; !ok {
+			distance += k - i
+		}
+		maxDistance += k - i
+	}
+
+	return float64(common) / float64(k), float64(distance) / float64(maxDistance)
+}
+
+// abs 整数的绝对值
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+// ShadowConfig 查询比较校验的配置
+type ShadowConfig struct {
+	// TopN 比较的命中数量，默认10
+	TopN int
+	// MinOverlap 平均重合比例低于该值时认为结果差异过大
+	MinOverlap float64
+	// MaxRankDistance 平均排名差异高于该值时认为结果差异过大，0表示不检查
+	MaxRankDistance float64
+	// MaxErrorRate 查询失败比例高于该值时认为结果差异过大，默认0.1
+	MaxErrorRate float64
+	// Block 为true时差异过大拒绝切换别名，否则只发送shadow_diverged事件
+	Block bool
+	// Queries 固定的查询，与ShadowQueries中保存和捕获的查询一起执行
+	Queries []*ShadowQuery
+}
+
+// shadowQueryValidator 在当前索引和新索引上重放查询并比较前N条命中
+type shadowQueryValidator struct {
+	config ShadowConfig
+}
+
+// NewShadowQueryValidator 创建查询比较校验，别名还没有索引或没有查询时跳过
+func NewShadowQueryValidator(config ShadowConfig) Validator {
+	config.TopN = defaultInt(config.TopN, defaultShadowTopN)
+	if config.MaxErrorRate <= 0 {
+		config.MaxErrorRate = defaultShadowMaxErrorRate
+	}
+	return &shadowQueryValidator{config}
+}
+
+func (s *shadowQueryValidator) Name() string {
+	return "shadow_query"
+}
+
+func (s *shadowQueryValidator) Validate(v *Validation) error {
+
+	if v.CurrentIndexName == "" {
+		return nil
+	}
+
+	queries, err := ShadowQueries.List(v.Alias)
+	if err != nil {
+		return err
+	}
+	queries = append(append([]*ShadowQuery{}, s.config.Queries...), queries...)
+	if len(queries) == 0 {
+		return nil
+	}
+
+	report := s.compare(v, queries)
+	if err := ShadowQueries.SaveReport(report); err != nil {
+		log.Printf("shadow query validate fail! %v", err)
+	}
+	if !report.Diverged {
+		return nil
+	}
+
+	message := fmt.Sprintf("shadow queries diverged! overlap %.3f, min %.3f, rank distance %.3f, max %.3f, error rate %.3f, max %.3f, queries %d",
+		report.Overlap, s.config.MinOverlap, report.RankDistance, s.config.MaxRankDistance,
+		report.ErrorRate, s.config.MaxErrorRate, len(report.Results))
+	if report.Blocked {
+		return fmt.Errorf(message)
+	}
+	log.Printf("shadow query validate flagged! alias:%s, jobId:%s, %s", v.Alias, v.Job.JobId, message)
+	notify(EventShadowDiverged, v.Alias, v.Job.JobId, -1, message)
+	return nil
+}
+
+// compare 执行所有查询并计算平均差异，查询失败的不参与平均
+func (s *shadowQueryValidator) compare(v *Validation, queries []*ShadowQuery) *ShadowReport {
+
+	report := &ShadowReport{
+		Alias:            v.Alias,
+		JobId:            v.Job.JobId,
+		NewIndexName:     v.NewIndexName,
+		CurrentIndexName: v.CurrentIndexName,
+		TopN:             s.config.TopN,
+		Time:             time.Now().UnixMilli(),
+	}
+
+	var succeeded int
+	for _, query := range queries {
+		result := &ShadowResult{Name: query.Name}
+		report.Results = append(report.Results, result)
+
+		body := make(map[string]interface{}, len(query.Body)+2)
+		for k, value := range query.Body {
+			body[k] = value
+		}
+		body["size"] = s.config.TopN
+		body["from"] = 0
+		body["_source"] = false
+
+		var err error
+		if result.CurrentIds, err = es.Document.SearchIds(v.CurrentIndexName, body); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		if result.NewIds, err = es.Document.SearchIds(v.NewIndexName, body); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+
+		result.Overlap, result.RankDistance = CompareHits(result.CurrentIds, result.NewIds)
+		report.Overlap += result.Overlap
+		report.RankDistance += result.RankDistance
+		succeeded++
+	}
+
+	report.ErrorRate = float64(len(queries)-succeeded) / float64(len(queries))
+	if succeeded == 0 {
+		//没有成功比较的查询，无法证明新索引可用
+		report.Diverged = true
+	} else {
+		report.Overlap /= float64(succeeded)
+		report.RankDistance /= float64(succeeded)
+		report.Diverged = report.Overlap < s.config.MinOverlap ||
+			(s.config.MaxRankDistance > 0 && report.RankDistance > s.config.MaxRankDistance) ||
+			report.ErrorRate > s.config.MaxErrorRate
+	}
+	report.Blocked = report.Diverged && s.config.Block
+	return report
+}
@@ -0,0 +1,336 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"fmt"
+	"log"
+)
+
+const (
+	// defaultRetainGenerations 默认切换别名后保留的旧索引代数
+	defaultRetainGenerations = 2
+	// defaultTimeout 默认全量任务超时时间（毫秒）
+	defaultTimeout = 6 * OneHour
+)
+
+// Source 全量索引的核心接口，只需要提供别名、数据读取和文档构建
+// 其余处理由框架提供默认实现，需要自定义时实现对应的能力接口，框架通过类型断言识别：
+// Handler、PipelineConfigurer、PartImporter、Loader、IndexCreator、BeforeSwapHook、AfterSwapHook、
+// RecordCache、ScheduleProvider、ScheduleLoader、GenerationRetainer、ForceMerger、TimeoutProvider、TimeoutAlerter
+type Source interface {
+	// GetAlias 获取索引别名
+	GetAlias() string
+	// NewReader 创建分片的数据读取，ctx被取消时应尽快返回
+	NewReader(ctx context.Context, currentSlice int, totalSlice int, args map[string]interface{}) (Reader, error)
+	// BuildDocument 将一条数据构建为文档，返回nil时跳过该数据
+	BuildDocument(row interface{}) (*es.DocumentEntity, error)
+}
+
+// Handler 自定义全量索引逻辑，实现后不再使用NewReader和BuildDocument组成的默认流水线
+type Handler interface {
+	// Handle 全量索引核心处理逻辑，ctx被取消时应尽快返回
+	Handle(ctx context.Context, currentSlice int, totalSlice int, indexName string, args map[string]interface{}) error
+}
+
+// PipelineConfigurer 调整默认流水线的页大小、并发和缓冲
+type PipelineConfigurer interface {
+	ConfigurePipeline(p *Pipeline)
+}
+
+// PartImporter 自定义增量索引逻辑
+// 默认删除操作按id删除文档，其他操作通过Loader重新读取数据并写入整个文档
+type PartImporter interface {
+	HandlePartImport(r Record, indexes []string, args map[string]interface{}) error
+}
+
+// Loader 按id读取一条数据，用于默认的增量索引，数据不存在时返回nil
+type Loader interface {
+	Load(id string) (interface{}, error)
+}
+
+// IndexCreator 自定义创建索引逻辑，默认使用definitions目录中别名的索引定义
+type IndexCreator interface {
+	HandleCreateIndex(indexName string) error
+}
+
+// BeforeSwapHook 切换别名前的处理，在校验通过后执行，返回错误时不切换别名，任务失败
+type BeforeSwapHook interface {
+	BeforeSwap(newIndexName string, oldIndexName string) error
+}
+
+// AfterSwapHook 切换别名后的处理，默认关闭旧索引
+type AfterSwapHook interface {
+	AfterSwap(newIndexName string, oldIndexName string) error
+}
+
+// RecordCache 自定义全量期间增量数据的缓存，默认使用redis stream，见RecordBuffer
+type RecordCache interface {
+	// CacheRecord 缓存增量数据
+	CacheRecord(jobId string, record *Record) error
+	// LoadRecords 切换别名后按批读取缓存的增量数据交给handle处理，处理成功的数据不再返回
+	LoadRecords(jobId string, batch int64, handle func(record Record) error) (handled int, failed int, err error)
+	// ClearRecords 任务取消时清除缓存
+	ClearRecords(jobId string) error
+}
+
+// ScheduleProvider 别名的定时配置
+type ScheduleProvider interface {
+	GetSchedules() []Schedule
+}
+
+// ScheduleLoader ScheduleLoad类型定时任务的处理逻辑
+type ScheduleLoader interface {
+	HandleScheduleLoad()
+}
+
+// GenerationRetainer 切换别名后保留的旧索引代数，默认2
+type GenerationRetainer interface {
+	GetRetainGenerations() int
+}
+
+// ForceMerger 切换别名前是否合并索引分段，默认不合并
+type ForceMerger interface {
+	NeedForceMergeEvent() bool
+}
+
+// TimeoutProvider 全量任务超时时间（毫秒），默认6小时
+type TimeoutProvider interface {
+	GetTimeout() int64
+}
+
+// TimeoutAlerter 超时处理逻辑，也可以通过AddNotifier订阅EventTimeout
+type TimeoutAlerter interface {
+	TimeoutAlert()
+}
+
+// aliasSwapper 自定义切换别名逻辑，仅用于适配旧的Rebuild.HandleDeleteIndex
+type aliasSwapper interface {
+	swapAlias(newIndexName string, oldIndexName string) error
+}
+
+// rebuildAdapter 将旧的Rebuild实现适配为Source，Rebuild的方法同时满足对应的能力接口
+type rebuildAdapter struct {
+	Rebuild
+}
+
+// AdaptRebuild 将旧的Rebuild实现适配为Source
+func AdaptRebuild(r Rebuild) Source {
+	return rebuildAdapter{r}
+}
+
+// NewReader Rebuild实现了Handle，不使用默认流水线
+func (a rebuildAdapter) NewReader(ctx context.Context, currentSlice int, totalSlice int, args map[string]interface{}) (Reader, error) {
+	return nil, fmt.Errorf("rebuild %s uses Handle, reader is not supported", a.GetAlias())
+}
+
+// BuildDocument Rebuild实现了Handle，不使用默认流水线
+func (a rebuildAdapter) BuildDocument(row interface{}) (*es.DocumentEntity, error) {
+	return nil, fmt.Errorf("rebuild %s uses Handle, document builder is not supported", a.GetAlias())
+}
+
+// BeforeSwap 对应Rebuild.SyncAfterHandle
+func (a rebuildAdapter) BeforeSwap(newIndexName string, oldIndexName string) error {
+	return a.SyncAfterHandle(newIndexName, oldIndexName)
+}
+
+// AfterSwap 旧索引由Rebuild.HandleDeleteIndex处理
+func (a rebuildAdapter) AfterSwap(newIndexName string, oldIndexName string) error {
+	return nil
+}
+
+// swapAlias 对应Rebuild.HandleDeleteIndex
+func (a rebuildAdapter) swapAlias(newIndexName string, oldIndexName string) error {
+	return a.HandleDeleteIndex(newIndexName, oldIndexName)
+}
+
+// streamRecordCache 默认的增量数据缓存
+type streamRecordCache struct {
+	alias string
+}
+
+func (c streamRecordCache) CacheRecord(jobId string, record *Record) error {
+	return RecordBuffer.Append(c.alias, jobId, record)
+}
+
+func (c streamRecordCache) LoadRecords(jobId string, batch int64, handle func(record Record) error) (int, int, error) {
+	return RecordBuffer.Drain(c.alias, jobId, batch, handle)
+}
+
+func (c streamRecordCache) ClearRecords(jobId string) error {
+	return RecordBuffer.Clear(c.alias, jobId)
+}
+
+// alias 索引别名
+func (r *RebuildHandler) alias() string {
+	return r.source.GetAlias()
+}
+
+// handle 执行全量索引，Source实现Handler时使用自定义逻辑，否则运行默认流水线
+func (r *RebuildHandler) handle(ctx context.Context, currentSlice int, totalSlice int, indexName string, args map[string]interface{}) error {
+
+	if h, ok := r.source.(Handler); ok {
+		return h.Handle(ctx, currentSlice, totalSlice, indexName, args)
+	}
+
+	reader, err := r.source.NewReader(ctx, currentSlice, totalSlice, args)
+	if err != nil {
+		return fmt.Errorf("handle create reader fail! alias:%s, index:%s, error:%v", r.alias(), indexName, err)
+	}
+
+	pipeline := &Pipeline{Reader: reader, Transformer: r.source.BuildDocument}
+	if c, ok := r.source.(PipelineConfigurer); ok {
+		c.ConfigurePipeline(pipeline)
+	}
+	return pipeline.Run(ctx, indexName, args)
+}
+
+// partImport 执行增量索引
+func (r *RebuildHandler) partImport(record Record, indexes []string, args map[string]interface{}) error {
+
+	if p, ok := r.source.(PartImporter); ok {
+		return p.HandlePartImport(record, indexes, args)
+	}
+
+	doc := es.DocumentEntity{Id: record.Id}
+	if record.GetOp() != OpDelete {
+		loader, ok := r.source.(Loader)
+		if !ok {
+			return fmt.Errorf("partImport fail! alias %s implements neither PartImporter nor Loader", r.alias())
+		}
+
+		row, err := loader.Load(record.Id)
+		if err != nil {
+			return fmt.Errorf("partImport load fail! alias:%s, id:%s, error:%v", r.alias(), record.Id, err)
+		}
+		//数据已删除时删除文档
+		if row != nil {
+			built, err := r.source.BuildDocument(row)
+			if err != nil {
+				return fmt.Errorf("partImport build document fail! alias:%s, id:%s, error:%v", r.alias(), record.Id, err)
+			}
+			if built != nil {
+				for _, index := range indexes {
+					if err := es.Document.Save(index, *built); err != nil {
+						return fmt.Errorf("partImport save fail! index:%s, id:%s, error:%v", index, record.Id, err)
+					}
+				}
+				return nil
+			}
+		}
+	}
+
+	for _, index := range indexes {
+		if err := es.Document.Delete(index, doc); err != nil {
+			return fmt.Errorf("partImport delete fail! index:%s, id:%s, error:%v", index, record.Id, err)
+		}
+	}
+	return nil
+}
+
+// createIndex 创建新索引，默认使用别名的索引定义
+func (r *RebuildHandler) createIndex(indexName string) error {
+
+	if c, ok := r.source.(IndexCreator); ok {
+		return c.HandleCreateIndex(indexName)
+	}
+
+	if es.Index.Exists(indexName) && !es.Index.Delete(indexName) {
+		return fmt.Errorf("createIndex delete exists index fail! index:%s", indexName)
+	}
+
+	definition, err := LoadDefinition(r.alias())
+	if err != nil {
+		return fmt.Errorf("createIndex fail! index:%s, error:%v", indexName, err)
+	}
+	if err := es.Index.Create(indexName, definition.Body()); err != nil {
+		return fmt.Errorf("createIndex fail! index:%s, error:%v", indexName, err)
+	}
+	return nil
+}
+
+// beforeSwap 切换别名前的处理
+func (r *RebuildHandler) beforeSwap(newIndexName string, oldIndexName string) error {
+	if h, ok := r.source.(BeforeSwapHook); ok {
+		return h.BeforeSwap(newIndexName, oldIndexName)
+	}
+	return nil
+}
+
+// swap 原子切换别名后执行AfterSwapHook，首次全量时别名还不存在，oldIndexName为空
+// 别名已经切换时AfterSwapHook失败只记录日志
+func (r *RebuildHandler) swap(newIndexName string, oldIndexName string) error {
+
+	if s, ok := r.source.(aliasSwapper); ok {
+		if err := s.swapAlias(newIndexName, oldIndexName); err != nil {
+			return err
+		}
+	} else if !es.Alias.Swap(r.alias(), oldIndexName, newIndexName) {
+		return fmt.Errorf("swap alias fail! alias:%s, new index:%s, old index:%s", r.alias(), newIndexName, oldIndexName)
+	}
+
+	var err error
+	if h, ok := r.source.(AfterSwapHook); ok {
+		err = h.AfterSwap(newIndexName, oldIndexName)
+	} else if oldIndexName != "" && !es.Index.Close(oldIndexName) {
+		err = fmt.Errorf("close old index %s fail", oldIndexName)
+	}
+	if err != nil {
+		log.Printf("swap after swap hook fail! alias:%s, new index:%s, old index:%s, error:%v", r.alias(), newIndexName, oldIndexName, err)
+	}
+	return nil
+}
+
+// recordCache 全量期间增量数据的缓存
+func (r *RebuildHandler) recordCache() RecordCache {
+	if c, ok := r.source.(RecordCache); ok {
+		return c
+	}
+	return streamRecordCache{r.alias()}
+}
+
+// GetSchedules 定时配置
+func (r *RebuildHandler) GetSchedules() []Schedule {
+	if p, ok := r.source.(ScheduleProvider); ok {
+		return p.GetSchedules()
+	}
+	return nil
+}
+
+// HandleScheduleLoad 定时任务
+func (r *RebuildHandler) HandleScheduleLoad() {
+	if l, ok := r.source.(ScheduleLoader); ok {
+		l.HandleScheduleLoad()
+	}
+}
+
+// retainGenerations 切换别名后保留的旧索引代数
+func (r *RebuildHandler) retainGenerations() int {
+	if g, ok := r.source.(GenerationRetainer); ok {
+		return g.GetRetainGenerations()
+	}
+	return defaultRetainGenerations
+}
+
+// needForceMerge 是否需要合并索引
+func (r *RebuildHandler) needForceMerge() bool {
+	if f, ok := r.source.(ForceMerger); ok {
+		return f.NeedForceMergeEvent()
+	}
+	return false
+}
+
+// timeout 全量任务超时时间（毫秒）
+func (r *RebuildHandler) timeout() int64 {
+	if t, ok := r.source.(TimeoutProvider); ok {
+		return t.GetTimeout()
+	}
+	return defaultTimeout
+}
+
+// timeoutAlert 超时处理
+func (r *RebuildHandler) timeoutAlert() {
+	if t, ok := r.source.(TimeoutAlerter); ok {
+		t.TimeoutAlert()
+	}
+}
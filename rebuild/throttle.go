@@ -0,0 +1,370 @@
+package rebuild
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// minThrottleFactor 降速的下限，不低于配置速度的10%
+	minThrottleFactor = 0.1
+	// rejectedFactor 文档被ES拒绝时的降速比例
+	rejectedFactor = 0.5
+	// slowFactor 批量请求耗时超过阈值时的降速比例
+	slowFactor = 0.8
+	// recoverStep 批量请求正常时每次恢复的比例
+	recoverStep = 0.05
+	// backoffInterval 两次降速的最小间隔，避免同一波拒绝连续降速
+	backoffInterval = time.Second
+	// observeWindow 统计实际速度的窗口
+	observeWindow = time.Second
+	// observeWeight 新窗口的速度在实际速度中的权重
+	observeWeight = 0.5
+	// latencyRiseRatio 未配置耗时阈值时，批量请求耗时超过基线的倍数时降速
+	latencyRiseRatio = 2
+	// latencyWeight 正常的批量请求耗时在基线中的权重
+	latencyWeight = 0.2
+	// minLatencySamples 耗时基线至少包含的批量请求数量，样本不足时不根据基线降速
+	minLatencySamples = 5
+)
+
+var (
+	Throttles = &throttleRegistry{throttles: make(map[string]*Throttle)}
+)
+
+// ThrottleConfig 别名的全量索引限速配置，速度为0时不限制
+type ThrottleConfig struct {
+	// DocsPerSecond 每秒写入的文档数量
+	DocsPerSecond float64 `json:"docsPerSecond"`
+	// BytesPerSecond 每秒写入的字节数
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	// ReadsPerSecond 每秒从数据源读取的数量
+	ReadsPerSecond float64 `json:"readsPerSecond"`
+	// LatencyThresholdMs 批量请求耗时超过该值时降速，0表示批量请求耗时超过基线的latencyRiseRatio倍时降速
+	LatencyThresholdMs int64 `json:"latencyThresholdMs"`
+}
+
+// ThrottleStatus 限速状态
+type ThrottleStatus struct {
+	Alias  string         `json:"alias"`
+	Config ThrottleConfig `json:"config"`
+	// Factor 当前生效的速度比例，ES反压时降低，恢复后逐渐回到1
+	Factor float64 `json:"factor"`
+}
+
+// bucket 令牌桶，允许透支，透支后按速度等待
+// 同时统计未降速时的实际速度，没有配置速度时作为降速的基准
+type bucket struct {
+	tokens float64
+	last   time.Time
+
+	observed    float64
+	windowStart time.Time
+	windowCount float64
+}
+
+// Throttle 别名的全量索引限速
+// 按配置的速度乘以Factor限速，ES返回429或批量请求变慢时降低Factor，正常后逐渐恢复
+// 没有配置速度时以降速前的实际速度乘以Factor限速
+type Throttle struct {
+	alias string
+
+	mu          sync.Mutex
+	config      ThrottleConfig
+	factor      float64
+	lastBackoff time.Time
+	docs        bucket
+	bytes       bucket
+	reads       bucket
+	//正常的批量请求耗时基线
+	latency        time.Duration
+	latencySamples int
+}
+
+// throttleRegistry 以别名为key的限速注册表
+type throttleRegistry struct {
+	lock      sync.Mutex
+	throttles map[string]*Throttle
+}
+
+// Get 获取别名的限速，不存在时创建，并从redis加载配置、订阅配置变更
+func (g *throttleRegistry) Get(alias string) *Throttle {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if throttle, ok := g.throttles[alias]; ok {
+		return throttle
+	}
+
+	var config ThrottleConfig
+	if stored, err := loadThrottleConfig(alias); err != nil {
+		log.Printf("throttle load config fail! alias:%s, error:%v", alias, err)
+	} else if stored != nil {
+		config = *stored
+	}
+	throttle := NewThrottle(alias, config)
+	g.throttles[alias] = throttle
+	es.AddBulkObserver(throttle)
+	go throttle.listen()
+	return throttle
+}
+
+// NewThrottle 创建别名的限速，不注册到Throttles，也不订阅配置变更
+func NewThrottle(alias string, config ThrottleConfig) *Throttle {
+	return &Throttle{alias: alias, config: config, factor: 1}
+}
+
+// SetThrottle 修改别名的限速配置，保存到redis并广播到所有节点
+func SetThrottle(alias string, config ThrottleConfig) (*ThrottleStatus, error) {
+
+	if config.DocsPerSecond < 0 || config.BytesPerSecond < 0 || config.ReadsPerSecond < 0 || config.LatencyThresholdMs < 0 {
+		return nil, fmt.Errorf("set throttle fail! alias:%s, config can not be negative", alias)
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("set throttle fail! alias:%s, error:%v", alias, err)
+	}
+
+	ctx := context.Background()
+	if err := client.RedisClient.Set(ctx, key.ThrottleRedisKey.MakeRedisKey(alias), string(data), key.ThrottleRedisKey.GetExpire()).Err(); err != nil {
+		return nil, fmt.Errorf("set throttle fail! alias:%s, error:%v", alias, err)
+	}
+	if err := client.RedisClient.Publish(ctx, key.ThrottleChannelRedisKey.MakeRedisKey(alias), string(data)).Err(); err != nil {
+		log.Printf("set throttle publish fail! alias:%s, error:%v", alias, err)
+	}
+
+	throttle := Throttles.Get(alias)
+	throttle.SetConfig(config)
+	log.Printf("set throttle success! alias:%s, config:%s", alias, data)
+	return throttle.Status(), nil
+}
+
+// loadThrottleConfig 从redis加载限速配置，不存在时返回nil
+func loadThrottleConfig(alias string) (*ThrottleConfig, error) {
+
+	data, err := client.RedisClient.Get(context.Background(), key.ThrottleRedisKey.MakeRedisKey(alias)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var config ThrottleConfig
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// listen 订阅其他节点的限速配置变更
+func (t *Throttle) listen() {
+
+	pubsub := client.RedisClient.Subscribe(context.Background(), key.ThrottleChannelRedisKey.MakeRedisKey(t.alias))
+	defer pubsub.Close()
+
+	for message := range pubsub.Channel() {
+		var config ThrottleConfig
+		if err := json.Unmarshal([]byte(message.Payload), &config); err != nil {
+			log.Printf("throttle parse config fail! alias:%s, error:%v", t.alias, err)
+			continue
+		}
+		t.SetConfig(config)
+	}
+	log.Printf("throttle listen stop! alias:%s", t.alias)
+}
+
+// SetConfig 修改当前节点的限速配置
+func (t *Throttle) SetConfig(config ThrottleConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config = config
+}
+
+// Status 当前的限速状态
+func (t *Throttle) Status() *ThrottleStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &ThrottleStatus{Alias: t.alias, Config: t.config, Factor: t.factor}
+}
+
+// WaitWrite 写入一批文档前等待，只有配置了BytesPerSecond时才计算文档大小
+func (t *Throttle) WaitWrite(ctx context.Context, docs []*es.DocumentEntity) error {
+	if err := t.wait(ctx, &t.docs, func(c ThrottleConfig) float64 { return c.DocsPerSecond }, float64(len(docs))); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	limitBytes := t.config.BytesPerSecond > 0
+	t.mu.Unlock()
+	if !limitBytes {
+		return nil
+	}
+	return t.wait(ctx, &t.bytes, func(c ThrottleConfig) float64 { return c.BytesPerSecond }, float64(docsSize(docs)))
+}
+
+// WaitRead 读取rows条数据后等待
+func (t *Throttle) WaitRead(ctx context.Context, rows int) error {
+	return t.wait(ctx, &t.reads, func(c ThrottleConfig) float64 { return c.ReadsPerSecond }, float64(rows))
+}
+
+// wait 从令牌桶中取n个令牌，令牌不足时等待，令牌桶容量为1秒的速度
+func (t *Throttle) wait(ctx context.Context, b *bucket, rateOf func(c ThrottleConfig) float64, n float64) error {
+
+	t.mu.Lock()
+	now := time.Now()
+	//降速期间不更新实际速度，保留降速前的速度作为基准
+	if t.factor >= 1 {
+		b.observe(now, n)
+	}
+	rate := rateOf(t.config)
+	if rate <= 0 && t.factor < 1 {
+		rate = b.observed
+	}
+	rate *= t.factor
+	if rate <= 0 || n <= 0 {
+		t.mu.Unlock()
+		return nil
+	}
+
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / rate * float64(time.Second))
+	}
+	t.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// observe 统计实际速度，每个窗口结束时按权重合并到实际速度中，调用方持有锁
+func (b *bucket) observe(now time.Time, n float64) {
+	if b.windowStart.IsZero() {
+		b.windowStart = now
+	}
+	if elapsed := now.Sub(b.windowStart); elapsed >= observeWindow {
+		rate := b.windowCount / elapsed.Seconds()
+		if b.observed == 0 {
+			b.observed = rate
+		} else {
+			b.observed = b.observed*(1-observeWeight) + rate*observeWeight
+		}
+		b.windowStart = now
+		b.windowCount = 0
+	}
+	b.windowCount += n
+}
+
+// OnFlush 包含别名索引的批量请求耗时超过阈值或耗时基线的latencyRiseRatio倍时降速，否则逐渐恢复并更新基线
+// 只包含其他别名索引的请求不影响限速
+func (t *Throttle) OnFlush(indexes []string, latency time.Duration) {
+	owned := false
+	for _, index := range indexes {
+		if t.ownsIndex(index) {
+			owned = true
+			break
+		}
+	}
+	if !owned {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	threshold := time.Duration(t.config.LatencyThresholdMs) * time.Millisecond
+	if threshold <= 0 && t.latencySamples >= minLatencySamples {
+		threshold = t.latency * latencyRiseRatio
+	}
+	if threshold > 0 && latency > threshold {
+		t.backoff(slowFactor, fmt.Sprintf("bulk latency %v exceeds %v", latency, threshold))
+		return
+	}
+
+	if t.latencySamples == 0 {
+		t.latency = latency
+	} else {
+		t.latency = time.Duration(float64(t.latency)*(1-latencyWeight) + float64(latency)*latencyWeight)
+	}
+	t.latencySamples++
+
+	if t.factor < 1 {
+		t.factor += recoverStep
+		if t.factor > 1 {
+			t.factor = 1
+		}
+	}
+}
+
+// OnRejected 别名的索引有文档被ES拒绝时降速
+func (t *Throttle) OnRejected(index string) {
+	if !t.ownsIndex(index) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.backoff(rejectedFactor, fmt.Sprintf("index %s rejected execution", index))
+}
+
+// ownsIndex 索引是否属于该别名
+func (t *Throttle) ownsIndex(index string) bool {
+	_, _, ok := ParseGeneration(t.alias, index)
+	return ok || index == t.alias
+}
+
+// backoff 按比例降速，调用方持有锁
+func (t *Throttle) backoff(ratio float64, reason string) {
+	now := time.Now()
+	if now.Sub(t.lastBackoff) < backoffInterval {
+		return
+	}
+	t.lastBackoff = now
+
+	t.factor *= ratio
+	if t.factor < minThrottleFactor {
+		t.factor = minThrottleFactor
+	}
+	log.Printf("throttle backoff! alias:%s, factor:%.2f, reason:%s", t.alias, t.factor, reason)
+}
+
+// docsSize 估算一批文档序列化后的大小
+func docsSize(docs []*es.DocumentEntity) int {
+	size := 0
+	for _, doc := range docs {
+		data, err := json.Marshal(doc.Data)
+		if err != nil {
+			continue
+		}
+		size += len(data)
+	}
+	return size
+}
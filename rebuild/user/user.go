@@ -1,51 +1,32 @@
 package user
 
 import (
+	"context"
 	"elasticsearch-data-import-go/es"
 	"elasticsearch-data-import-go/rebuild"
 	userDao "elasticsearch-data-import-go/web/dao/user"
 	"fmt"
-	"log"
 	"strconv"
 )
 
 var UerRebuildHandler *rebuild.RebuildHandler
-var indexes = [2]string{indexName01, indexName02}
-var indexInfos map[string]interface{}
 
 const (
-	indexName01 = "user_01"
-	indexName02 = "user_02"
-	alias       = "user"
+	alias = "user"
+	// retainGenerations 保留的旧索引代数
+	retainGenerations = 2
+	// captureRate 捕获线上查询的采样比例，用于切换别名前的查询比较
+	captureRate = 0.01
 )
 
 func init() {
-	UerRebuildHandler = rebuild.NewRebuildHandler(userRebuild{}, 500)
-	indexInfos = map[string]interface{}{
-		"mappings": map[string]interface{}{
-			"properties": map[string]interface{}{
-				"uid": map[string]interface{}{
-					"type": "long",
-				},
-				"user_name": map[string]interface{}{
-					"type": "text",
-				}, "real_name": map[string]interface{}{
-					"type": "text",
-				}, "age": map[string]interface{}{
-					"type": "integer",
-				}, "gender": map[string]interface{}{
-					"type": "integer",
-				}, "status": map[string]interface{}{
-					"type": "integer",
-				},
-			},
-		},
-		"settings": map[string]interface{}{
-			"index.number_of_shards":   "1",
-			"index.number_of_replicas": "1",
-			"index.refresh_interval":   "1800s",
-		},
-	}
+	UerRebuildHandler = rebuild.Registry.RegisterSource(userRebuild{}, 500)
+	//切换别名前校验：文档数量扣除全量期间缓存的增量数据后与数据表一致，与当前索引相差不超过10%，不允许批量写入失败
+	UerRebuildHandler.AddValidator(rebuild.NewSourceCountValidator(userDao.Count, 0))
+	UerRebuildHandler.AddValidator(rebuild.NewCurrentIndexCountValidator(0.1))
+	UerRebuildHandler.AddValidator(rebuild.NewBulkFailureValidator(0))
+	//新索引的查询结果与当前索引差异过大时拒绝切换别名
+	UerRebuildHandler.AddValidator(rebuild.NewShadowQueryValidator(rebuild.ShadowConfig{MinOverlap: 0.8, MaxRankDistance: 0.3, Block: true}))
 }
 
 type userRebuild struct {
@@ -53,6 +34,10 @@ type userRebuild struct {
 
 type UserRecord struct {
 	Id int64
+	// Fields 局部更新的字段，仅OpUpdate使用
+	Fields map[string]interface{}
+	// Version 变更时的更新时间（毫秒），与poVersion一致，OpUpdate和OpDelete按该版本写入
+	Version int64
 }
 
 type UserEntity struct {
@@ -68,76 +53,85 @@ func (u userRebuild) GetAlias() string {
 	return alias
 }
 
-func (u userRebuild) GetIndexes() [2]string {
-	return indexes
+func (u userRebuild) GetRetainGenerations() int {
+	return retainGenerations
 }
 
-func (u userRebuild) Handle(currentSlice int, totalSlice int, indexName string, args map[string]interface{}) error {
+// NewReader 按id区间划分分片，同一任务的分片使用相同的id范围
+func (u userRebuild) NewReader(ctx context.Context, currentSlice int, totalSlice int, args map[string]interface{}) (rebuild.Reader, error) {
 
-	query := &userDao.UserQuery{
-		StartId: 0,
-		Limit:   100,
+	minId, maxId, err := rebuild.RangeBounds(args, userDao.IdRange)
+	if err != nil {
+		return nil, fmt.Errorf("UerRebuildHandler NewReader fail! get id range fail! error:%v", err)
 	}
+	return readUsers(rebuild.RangePartition(currentSlice, totalSlice, minId, maxId)), nil
+}
 
-	for {
-		pos, err := userDao.SearchByPage(query)
-		if err != nil {
-			log.Printf("UerRebuildHandler Handle fail! SearchByPage has error! index:%s, error:%v", indexName, err)
-			break
-		}
-
-		if pos == nil || len(pos) == 0 {
-			break
-		}
+// ConfigurePipeline 每页100条，转换和写入各2个协程
+func (u userRebuild) ConfigurePipeline(p *rebuild.Pipeline) {
+	p.PageSize = 100
+	p.Transformers = 2
+	p.Writers = 2
+}
 
-		var datas = make([]*es.DocumentEntity, 0, len(pos))
-		for i, po := range pos {
-			data := &es.DocumentEntity{
-				Id:   strconv.FormatInt(po.Id, 10),
-				Data: poToMap(po),
-			}
-			datas = append(datas, data)
+// readUsers 按id分页读取分片内的用户数据，位点为上一页最后一条数据的id
+func readUsers(partition rebuild.Partition) rebuild.Reader {
+	return func(ctx context.Context, position string, limit int) ([]interface{}, string, error) {
 
-			if i == (cap(datas) - 1) {
-				query.StartId = po.Id
+		var startId int64
+		if position != "" {
+			id, err := strconv.ParseInt(position, 10, 64)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid checkpoint! position:%s", position)
 			}
+			startId = id
 		}
 
-		err = es.Document.BatchSave(indexName, datas)
+		pos, err := userDao.SearchByPartition(&userDao.UserQuery{
+			StartId: startId,
+			Limit:   limit,
+		}, partition)
 		if err != nil {
-			log.Printf("UerRebuildHandler Handle fail! BatchSave has error! index:%s, error:%v", "user_01", err)
-			break
+			return nil, "", err
 		}
-	}
 
-	return nil
-}
+		if len(pos) == 0 {
+			return nil, position, nil
+		}
 
-func (u userRebuild) HandleCreateIndex(indexName string) error {
-	res := es.Index.Delete(indexName)
-	if !res {
-		return fmt.Errorf("UerRebuildHandler HandleCreateIndex fail! index:%s", indexName)
+		rows := make([]interface{}, 0, len(pos))
+		for _, po := range pos {
+			rows = append(rows, po)
+		}
+		return rows, strconv.FormatInt(pos[len(pos)-1].Id, 10), nil
 	}
+}
 
-	err := es.Index.Create(indexName, indexInfos)
-	if err != nil {
-		return fmt.Errorf("UerRebuildHandler HandleCreateIndex fail! index:%s", indexName)
+// BuildDocument 将用户数据转换为文档
+func (u userRebuild) BuildDocument(row interface{}) (*es.DocumentEntity, error) {
+
+	po, ok := row.(*userDao.UserBasic)
+	if !ok {
+		return nil, fmt.Errorf("row can not cast type UserBasic! row:%v", row)
 	}
-	return nil
-}
 
-func (u userRebuild) HandleDeleteIndex(newIndexName string, oldIndexName string) error {
-	es.Alias.DeleteAlias(oldIndexName, alias)
-	es.Alias.CreateAlias(alias, newIndexName)
-	es.Index.Close(oldIndexName)
-	return nil
+	return &es.DocumentEntity{
+		Id:      strconv.FormatInt(po.Id, 10),
+		Data:    poToMap(po),
+		Version: poVersion(po),
+	}, nil
 }
 
 func (u userRebuild) HandlePartImport(r rebuild.Record, indexes []string, args map[string]interface{}) error {
 
-	userRecord, ok := r.Data.(UserRecord)
-	if !ok {
-		return fmt.Errorf("HandlePartImport fail! record can not cast type UserRecord")
+	var userRecord UserRecord
+	if r.Data != nil {
+		if err := rebuild.DecodeRecordData(r, &userRecord); err != nil {
+			return fmt.Errorf("HandlePartImport fail! record can not cast type UserRecord! err:%v", err)
+		}
+	} else {
+		//只传了Id
+		userRecord.Id, _ = strconv.ParseInt(r.Id, 10, 64)
 	}
 
 	id := userRecord.Id
@@ -145,6 +139,19 @@ func (u userRebuild) HandlePartImport(r rebuild.Record, indexes []string, args m
 		return fmt.Errorf("HandlePartImport fail! invalid id")
 	}
 
+	switch r.GetOp() {
+	case rebuild.OpDelete:
+		return deleteUser(id, userRecord.Version, indexes)
+	case rebuild.OpUpdate:
+		return updateUser(id, userRecord.Fields, userRecord.Version, indexes)
+	default:
+		return indexUser(id, indexes)
+	}
+}
+
+// indexUser 重新读取用户数据并写入索引
+func indexUser(id int64, indexes []string) error {
+
 	userBasic, err := userDao.SearchById(id)
 	if err != nil {
 		return fmt.Errorf("HandlePartImport fail! invalid id! id:%d, err;%v", id, err)
@@ -153,8 +160,9 @@ func (u userRebuild) HandlePartImport(r rebuild.Record, indexes []string, args m
 	data := poToMap(userBasic)
 
 	entity := es.DocumentEntity{
-		Id:   strconv.FormatInt(userBasic.Id, 10),
-		Data: data,
+		Id:      strconv.FormatInt(userBasic.Id, 10),
+		Data:    data,
+		Version: poVersion(userBasic),
 	}
 
 	for _, index := range indexes {
@@ -167,35 +175,110 @@ func (u userRebuild) HandlePartImport(r rebuild.Record, indexes []string, args m
 	return nil
 }
 
-func (u userRebuild) HandleScheduleLoad() {
-}
+// updateUser 局部更新索引中的用户数据，version大于0时旧版本的更新不会覆盖新数据
+func updateUser(id int64, fields map[string]interface{}, version int64, indexes []string) error {
+
+	if len(fields) == 0 {
+		return fmt.Errorf("HandlePartImport update fail! fields is empty! id:%d", id)
+	}
+
+	entity := es.DocumentEntity{
+		Id:      strconv.FormatInt(id, 10),
+		Data:    &fields,
+		Version: version,
+	}
+
+	for _, index := range indexes {
+		if err := es.Document.Update(index, entity, false); err != nil {
+			return fmt.Errorf("HandlePartImport update fail! index:%s, id:%d, err:%v", index, id, err)
+		}
+	}
 
-func (u userRebuild) SyncAfterHandle(newIndexName string, oldIndexName string) error {
 	return nil
 }
 
-func (u userRebuild) NeedForceMergeEvent() bool {
-	return false
+// deleteUser 从索引中删除用户数据，删除按版本写入，回放或延迟写入的旧数据不会恢复已删除的文档
+// 记录没有版本时使用数据库中的更新时间，数据已物理删除时不使用版本
+func deleteUser(id int64, version int64, indexes []string) error {
+
+	if version <= 0 {
+		if userBasic, err := userDao.SearchById(id); err == nil && userBasic != nil {
+			version = poVersion(userBasic)
+		}
+	}
+
+	entity := es.DocumentEntity{
+		Id:      strconv.FormatInt(id, 10),
+		Version: version,
+	}
+
+	for _, index := range indexes {
+		if err := es.Document.Delete(index, entity); err != nil {
+			return fmt.Errorf("HandlePartImport delete fail! index:%s, id:%d, err:%v", index, id, err)
+		}
+	}
+
+	return nil
 }
 
-func (u userRebuild) UseCustomCache() bool {
-	return false
+// GetSchedules 每天凌晨3点全量索引
+func (u userRebuild) GetSchedules() []rebuild.Schedule {
+	return []rebuild.Schedule{
+		{
+			Name:       "nightly",
+			Spec:       "0 3 * * *",
+			Action:     rebuild.ScheduleFullRebuild,
+			TotalSlice: 4,
+		},
+	}
 }
 
 func (u userRebuild) GetTimeout() int64 {
 	return rebuild.OneHour
 }
 
-func (u userRebuild) CacheRecord(record *rebuild.Record) {
-
+// CaptureSearch 按采样率将用户搜索条件转换为ES相关性查询并异步捕获
+func CaptureSearch(q *userDao.UserQuery) {
+	rebuild.ShadowQueries.SampleCapture(alias, captureRate, searchBody(q))
 }
 
-func (u userRebuild) LoadRecords(id string) (records []*rebuild.Record, lastId string) {
-	return nil, ""
-}
+// searchBody 用户搜索条件对应的ES相关性查询，姓名参与打分，其他条件只过滤，按_score排序
+// 数据库查询的id游标只用于翻页，不加入查询；得分相同时按user_id排序，避免新旧索引的内部文档顺序影响比较
+func searchBody(q *userDao.UserQuery) map[string]interface{} {
 
-func (u userRebuild) TimeoutAlert() {
+	must := make([]interface{}, 0)
+	filter := make([]interface{}, 0)
 
+	if q.UserName != "" {
+		must = append(must, map[string]interface{}{"match": map[string]interface{}{"user_name": q.UserName}})
+	}
+	if q.RealName != "" {
+		must = append(must, map[string]interface{}{"match": map[string]interface{}{"real_name": q.RealName}})
+	}
+	if q.AgeMin != nil || q.AgeMax != nil {
+		age := make(map[string]interface{})
+		if q.AgeMin != nil {
+			age["gte"] = *q.AgeMin
+		}
+		if q.AgeMax != nil {
+			age["lte"] = *q.AgeMax
+		}
+		filter = append(filter, map[string]interface{}{"range": map[string]interface{}{"age": age}})
+	}
+	if q.Gender != nil {
+		filter = append(filter, map[string]interface{}{"term": map[string]interface{}{"gender": *q.Gender}})
+	}
+	if q.Status != nil {
+		filter = append(filter, map[string]interface{}{"term": map[string]interface{}{"status": *q.Status}})
+	}
+
+	return map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": must, "filter": filter}},
+		"sort": []interface{}{
+			map[string]interface{}{"_score": "desc"},
+			map[string]interface{}{"user_id": "asc"},
+		},
+	}
 }
 
 func poToMap(po *userDao.UserBasic) *map[string]interface{} {
@@ -210,3 +293,11 @@ func poToMap(po *userDao.UserBasic) *map[string]interface{} {
 
 	return &data
 }
+
+// poVersion 以更新时间作为文档的外部版本号，回放或延迟写入的旧数据不会覆盖新数据
+func poVersion(po *userDao.UserBasic) int64 {
+	if po.UpdateTime.IsZero() {
+		return 0
+	}
+	return po.UpdateTime.UnixMilli()
+}
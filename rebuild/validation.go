@@ -0,0 +1,214 @@
+package rebuild
+
+import (
+	"elasticsearch-data-import-go/es"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+)
+
+// Validation 切换别名前的校验信息
+type Validation struct {
+	Job              *Job
+	Alias            string
+	NewIndexName     string
+	CurrentIndexName string
+
+	newCount      *int64
+	bufferedCount *int64
+}
+
+// NewIndexCount 获取新索引的文档数量，多个校验共用一次查询
+func (v *Validation) NewIndexCount() (int64, error) {
+	if v.newCount != nil {
+		return *v.newCount, nil
+	}
+
+	count, err := es.Index.Count(v.NewIndexName)
+	if err != nil {
+		return 0, err
+	}
+	v.newCount = &count
+	return count, nil
+}
+
+// BufferedCount 获取全量期间缓存的增量数据数量，这些数据在切换别名后才回放到新索引
+// 只统计默认的增量数据缓存，自定义的缓存返回0
+func (v *Validation) BufferedCount() (int64, error) {
+	if v.bufferedCount != nil {
+		return *v.bufferedCount, nil
+	}
+
+	count, err := RecordBuffer.Size(v.Alias, v.Job.JobId)
+	if err != nil {
+		return 0, err
+	}
+	v.bufferedCount = &count
+	return count, nil
+}
+
+// Validator 切换别名前的校验，返回错误时拒绝切换别名并将任务标记为失败
+type Validator interface {
+	// Name 校验名称
+	Name() string
+	// Validate 校验逻辑
+	Validate(v *Validation) error
+}
+
+// AddValidator 添加切换别名前的校验
+func (r *RebuildHandler) AddValidator(validator Validator) {
+	r.validators = append(r.validators, validator)
+}
+
+// validate 执行所有校验，返回所有失败的校验信息
+func (r *RebuildHandler) validate(job *Job, newIndexName string, currentIndexName string) error {
+
+	if len(r.validators) == 0 {
+		return nil
+	}
+
+	//刷新新索引，保证文档数量准确
+	if err := es.Index.Refresh(newIndexName); err != nil {
+		return fmt.Errorf("validate refresh index fail! index:%s, error:%v", newIndexName, err)
+	}
+
+	v := &Validation{
+		Job:              job,
+		Alias:            job.Alias,
+		NewIndexName:     newIndexName,
+		CurrentIndexName: currentIndexName,
+	}
+
+	var messages []string
+	for _, validator := range r.validators {
+		if err := validator.Validate(v); err != nil {
+			messages = append(messages, fmt.Sprintf("%s: %v", validator.Name(), err))
+		} else {
+			log.Printf("validate pass! alias:%s, jobId:%s, validator:%s", job.Alias, job.JobId, validator.Name())
+		}
+	}
+
+	if len(messages) > 0 {
+		return fmt.Errorf("validate fail! %s", strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// WithinTolerance actual与expected的差值是否在允许的比例范围内，tolerance为0时要求完全相等
+func WithinTolerance(expected int64, actual int64, tolerance float64) bool {
+	diff := math.Abs(float64(actual - expected))
+	return diff <= tolerance*math.Max(float64(expected), 1)
+}
+
+// sourceCountValidator 比较数据源的数量与新索引的文档数量
+type sourceCountValidator struct {
+	count     func() (int64, error)
+	tolerance float64
+}
+
+// NewSourceCountValidator 创建数据源数量校验，count获取数据源的数量
+func NewSourceCountValidator(count func() (int64, error), tolerance float64) Validator {
+	return &sourceCountValidator{count, tolerance}
+}
+
+func (s *sourceCountValidator) Name() string {
+	return "source_count"
+}
+
+func (s *sourceCountValidator) Validate(v *Validation) error {
+
+	sourceCount, err := s.count()
+	if err != nil {
+		return fmt.Errorf("get source count fail! error:%v", err)
+	}
+
+	indexCount, err := v.NewIndexCount()
+	if err != nil {
+		return fmt.Errorf("get index count fail! index:%s, error:%v", v.NewIndexName, err)
+	}
+
+	//全量期间的写入缓存在增量数据中，切换别名后才回放，每条缓存的数据最多造成一条差异
+	buffered, err := v.BufferedCount()
+	if err != nil {
+		return fmt.Errorf("get buffered count fail! alias:%s, error:%v", v.Alias, err)
+	}
+
+	if !WithinTolerance(sourceCount, Towards(indexCount, sourceCount, buffered), s.tolerance) {
+		return fmt.Errorf("source count %d, index %s count %d, buffered %d, tolerance %v",
+			sourceCount, v.NewIndexName, indexCount, buffered, s.tolerance)
+	}
+	return nil
+}
+
+// Towards actual向expected靠近最多delta，用于扣除已知原因造成的差异
+func Towards(actual int64, expected int64, delta int64) int64 {
+	if actual < expected {
+		if actual+delta > expected {
+			return expected
+		}
+		return actual + delta
+	}
+	if actual-delta < expected {
+		return expected
+	}
+	return actual - delta
+}
+
+// currentIndexCountValidator 比较当前索引与新索引的文档数量
+type currentIndexCountValidator struct {
+	tolerance float64
+}
+
+// NewCurrentIndexCountValidator 创建当前索引数量校验，别名还没有索引时跳过
+func NewCurrentIndexCountValidator(tolerance float64) Validator {
+	return &currentIndexCountValidator{tolerance}
+}
+
+func (c *currentIndexCountValidator) Name() string {
+	return "current_index_count"
+}
+
+func (c *currentIndexCountValidator) Validate(v *Validation) error {
+
+	if v.CurrentIndexName == "" {
+		return nil
+	}
+
+	currentCount, err := es.Index.Count(v.CurrentIndexName)
+	if err != nil {
+		return fmt.Errorf("get index count fail! index:%s, error:%v", v.CurrentIndexName, err)
+	}
+
+	indexCount, err := v.NewIndexCount()
+	if err != nil {
+		return fmt.Errorf("get index count fail! index:%s, error:%v", v.NewIndexName, err)
+	}
+
+	if !WithinTolerance(currentCount, indexCount, c.tolerance) {
+		return fmt.Errorf("current index %s count %d, new index %s count %d, tolerance %v",
+			v.CurrentIndexName, currentCount, v.NewIndexName, indexCount, c.tolerance)
+	}
+	return nil
+}
+
+// bulkFailureValidator 校验批量写入失败的文档数量
+type bulkFailureValidator struct {
+	maxFailed int64
+}
+
+// NewBulkFailureValidator 创建批量写入失败校验，失败数量超过maxFailed时拒绝切换别名
+func NewBulkFailureValidator(maxFailed int64) Validator {
+	return &bulkFailureValidator{maxFailed}
+}
+
+func (b *bulkFailureValidator) Name() string {
+	return "bulk_failure"
+}
+
+func (b *bulkFailureValidator) Validate(v *Validation) error {
+	if v.Job.DocsFailed > b.maxFailed {
+		return fmt.Errorf("bulk failed %d docs, max %d", v.Job.DocsFailed, b.maxFailed)
+	}
+	return nil
+}
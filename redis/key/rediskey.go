@@ -10,6 +10,7 @@ import (
 const (
 	oneHour = time.Hour
 	halfDay = 12 * oneHour
+	oneWeek = 7 * 24 * oneHour
 )
 
 var (
@@ -18,6 +19,30 @@ var (
 	DeleteIndexLockRedisKey     = &RedisKey{"rebuild:delete_index_lock", oneHour}
 	ForceMergeEventLockRedisKey = &RedisKey{"rebuild:force_merge_event", oneHour}
 	FinishCountRedisKey         = &RedisKey{"rebuild:finish_count", 12 * oneHour}
+	FinishedSliceRedisKey       = &RedisKey{"rebuild:finished_slice", 12 * oneHour}
+	CheckpointRedisKey          = &RedisKey{"rebuild:checkpoint", 12 * oneHour}
+	CurrentJobRedisKey          = &RedisKey{"rebuild:current_job", 12 * oneHour}
+	JobRedisKey                 = &RedisKey{"rebuild:job", oneWeek}
+	JobHistoryRedisKey          = &RedisKey{"rebuild:job_history", oneWeek}
+	RebuildRequiredRedisKey     = &RedisKey{"rebuild:rebuild_required", oneWeek}
+	CancelFlagRedisKey          = &RedisKey{"rebuild:cancel_flag", 12 * oneHour}
+	CancelChannelRedisKey       = &RedisKey{"rebuild:cancel_channel", 0}
+	RecordBufferRedisKey        = &RedisKey{"rebuild:record_buffer", 12 * oneHour}
+	DeadLetterRedisKey          = &RedisKey{"rebuild:dead_letter", oneWeek}
+	SliceQueueRedisKey          = &RedisKey{"rebuild:slice_queue", 0}
+	SubmitLockRedisKey          = &RedisKey{"rebuild:submit_lock", oneHour}
+	SliceProcessingRedisKey     = &RedisKey{"rebuild:slice_processing", 0}
+	SliceLeaseRedisKey          = &RedisKey{"rebuild:slice_lease", 30 * time.Second}
+	SliceReaperLockRedisKey     = &RedisKey{"rebuild:slice_reaper_lock", 10 * time.Second}
+	SliceMissingRedisKey        = &RedisKey{"rebuild:slice_missing", oneHour}
+	ThrottleRedisKey            = &RedisKey{"rebuild:throttle", 0}
+	ThrottleChannelRedisKey     = &RedisKey{"rebuild:throttle_channel", 0}
+	ScheduleRedisKey            = &RedisKey{"rebuild:schedule", 0}
+	ScheduleRunningRedisKey     = &RedisKey{"rebuild:schedule_running", oneHour}
+	SchedulerLockRedisKey       = &RedisKey{"rebuild:scheduler_lock", 30 * time.Second}
+	ShadowQueryRedisKey         = &RedisKey{"rebuild:shadow_query", 0}
+	ShadowCaptureRedisKey       = &RedisKey{"rebuild:shadow_capture", oneWeek}
+	ShadowReportRedisKey        = &RedisKey{"rebuild:shadow_report", oneWeek}
 	MusicFullMaxId              = &RedisKey{"rebuild:music_full_max_id", 26 * oneHour}
 	MusicFullMaxIdLockKey       = &RedisKey{"rebuild:music_full_max_id_lock_key", oneHour}
 	RebuildTaskTimeoutLockKey   = &RedisKey{"rebuild:rebuild_task_timeout_lock_key", 2}
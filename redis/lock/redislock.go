@@ -2,6 +2,7 @@ package lock
 
 import (
 	"context"
+	"elasticsearch-data-import-go/metrics"
 	"elasticsearch-data-import-go/redis/client"
 	"github.com/go-redis/redis/v8"
 	uuid "github.com/satori/go.uuid"
@@ -31,8 +32,14 @@ func (r RedisLock) Lock(key string, id string, expire time.Duration) (lockResult
 
 	var lockStatus = false
 	var currentTime = time.Now().UnixMilli()
+	var startTime = time.Now()
+	lockName := metrics.LockName(key)
+	metrics.LockAttempts.WithLabelValues(lockName).Inc()
 	defer func(lockStatus *bool, key string, id string, currentTime int64) {
+		//统计获取锁的耗时和失败次数
+		metrics.LockWait.WithLabelValues(lockName).Observe(time.Since(startTime).Seconds())
 		if !*lockStatus {
+			metrics.LockFailures.WithLabelValues(lockName).Inc()
 			costTime := time.Now().UnixMilli() - currentTime
 			log.Printf("redis lock helper,lock fail,redis key:%s,requestId:%s,cost time:%d", key, id, costTime)
 		}
@@ -43,7 +50,7 @@ func (r RedisLock) Lock(key string, id string, expire time.Duration) (lockResult
 	var et = time.Now().Add(expire).UnixMilli()
 	ctx := context.Background()
 
-	value := id + "#" + string(et)
+	value := id + "#" + strconv.FormatInt(et, 10)
 	boolCmd := r.rdb.SetNX(ctx, key, value, expire)
 
 	result, err := boolCmd.Result()
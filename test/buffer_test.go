@@ -0,0 +1,40 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"testing"
+)
+
+func TestRecordBufferDrain(t *testing.T) {
+	resetRedis(t)
+
+	alias := "buffer_test"
+	jobId := "job_1"
+	rebuild.RecordBuffer.Append(alias, jobId, &rebuild.Record{Id: "1"})
+	rebuild.RecordBuffer.Append(alias, jobId, &rebuild.Record{Id: "2"})
+
+	//回放期间追加的数据在读取到空之前被回放
+	var replayed []string
+	handled, failed, err := rebuild.RecordBuffer.Drain(alias, jobId, 1, func(record rebuild.Record) error {
+		if len(replayed) == 0 {
+			rebuild.RecordBuffer.Append(alias, jobId, &rebuild.Record{Id: "3"})
+		}
+		replayed = append(replayed, record.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("drain fail! error:%v", err)
+	}
+	if handled != 3 || failed != 0 {
+		t.Errorf("handled:%d, failed:%d, want 3, 0", handled, failed)
+	}
+	if size, _ := rebuild.RecordBuffer.Size(alias, jobId); size != 0 {
+		t.Errorf("buffered:%d, want 0", size)
+	}
+
+	//回放结束后追加的数据保留到过期，不被删除
+	rebuild.RecordBuffer.Append(alias, jobId, &rebuild.Record{Id: "4"})
+	if size, _ := rebuild.RecordBuffer.Size(alias, jobId); size != 1 {
+		t.Errorf("buffered:%d, want 1", size)
+	}
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCancelCleanup(t *testing.T) {
+	resetRedis(t)
+
+	//未注册的别名，使用默认的增量数据缓存，ES不可用时只跳过删除新索引
+	alias := "cancel_test"
+	job, err := rebuild.Jobs.Start(alias, alias+"_1", 2)
+	if err != nil {
+		t.Fatalf("start job fail! error:%v", err)
+	}
+	rebuild.Checkpoint.Commit(alias, job.JobId, 0, 2, "", "10")
+	rebuild.RecordBuffer.Append(alias, job.JobId, &rebuild.Record{Id: "1"})
+
+	cancelled, err := rebuild.Cancel(alias)
+	if err != nil {
+		t.Fatalf("cancel fail! error:%v", err)
+	}
+	if cancelled.Status != rebuild.JobCancelled {
+		t.Errorf("status:%s, want %s", cancelled.Status, rebuild.JobCancelled)
+	}
+	if !rebuild.IsCancelled(job.JobId) {
+		t.Errorf("job should be cancelled")
+	}
+	if current, _ := rebuild.Jobs.Current(alias); current != nil {
+		t.Errorf("current job:%s, want nil", current.JobId)
+	}
+
+	//位点、缓存的增量数据和分片计数都被清除
+	if position, _ := rebuild.Checkpoint.Get(alias, job.JobId, 0, 2); position != "" {
+		t.Errorf("position:%s, want empty", position)
+	}
+	if size, _ := rebuild.RecordBuffer.Size(alias, job.JobId); size != 0 {
+		t.Errorf("buffered:%d, want 0", size)
+	}
+	if _, counted, _ := rebuild.Jobs.CountDownSlice(job.JobId, 0, ""); counted {
+		t.Errorf("slice of cancelled job should not be counted")
+	}
+
+	//没有运行中的任务时不能取消
+	if _, err := rebuild.Cancel(alias); err == nil {
+		t.Errorf("cancel without running job should fail")
+	}
+}
+
+func TestCancelWaitsRunningSlice(t *testing.T) {
+	resetRedis(t)
+
+	//PartRebuild和重新分配的分片不持有分片锁，以分片状态判断是否停止
+	alias := "cancel_wait_test"
+	job, err := rebuild.Jobs.Start(alias, alias+"_1", 1)
+	if err != nil {
+		t.Fatalf("start job fail! error:%v", err)
+	}
+	rebuild.Jobs.SliceRunning(job.JobId, 0)
+	rebuild.Jobs.ClaimSlice(job.JobId, 0, "owner")
+
+	stopped := make(chan struct{}, 1)
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		rebuild.Jobs.SliceFailed(job.JobId, 0, "owner", fmt.Errorf("cancelled"))
+		stopped <- struct{}{}
+	}()
+
+	if _, err := rebuild.Cancel(alias); err != nil {
+		t.Fatalf("cancel fail! error:%v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Errorf("cancel returned before the running slice stopped")
+	}
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/rebuild"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// redriveSource 记录重新导入的数据，id为bad的数据导入失败
+type redriveSource struct {
+	mu       *sync.Mutex
+	imported map[string]rebuild.RecordOp
+}
+
+func (s redriveSource) GetAlias() string { return "dead_letter_test" }
+func (s redriveSource) NewReader(ctx context.Context, currentSlice int, totalSlice int, args map[string]interface{}) (rebuild.Reader, error) {
+	return nil, errors.New("not supported")
+}
+func (s redriveSource) BuildDocument(row interface{}) (*es.DocumentEntity, error) { return nil, nil }
+func (s redriveSource) HandlePartImport(r rebuild.Record, indexes []string, args map[string]interface{}) error {
+	if r.Id == "bad" {
+		return errors.New("import fail")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.imported[r.Id] = r.GetOp()
+	return nil
+}
+
+func TestDeadLetterRedrive(t *testing.T) {
+	resetRedis(t)
+
+	source := redriveSource{mu: &sync.Mutex{}, imported: make(map[string]rebuild.RecordOp)}
+	alias := source.GetAlias()
+	rebuild.Registry.RegisterSource(source, 10)
+
+	//批次写入完成后，失败和没有加入批量写入的文档保存为死信
+	checkpointer := rebuild.NewCheckpointer(alias, "job", 0, 1, "")
+	checkpointer.Track("10")(&es.BatchResult{Index: alias, Fail: 3, Failed: []*es.FailedItem{
+		{Index: alias, Id: "1", Action: "index", ErrorType: "mapper_parsing_exception"},
+		{Index: alias, Id: "2", Action: "delete", ErrorType: "not_added"},
+		{Index: alias, Id: "bad", Action: "index", ErrorType: "not_added"},
+	}})
+	checkpointer.Wait()
+
+	letters, err := rebuild.DeadLetters.List(alias, 0)
+	if err != nil || len(letters) != 3 {
+		t.Fatalf("dead letters:%d, error:%v, want 3", len(letters), err)
+	}
+
+	result, err := rebuild.Redrive(alias, nil)
+	if err != nil {
+		t.Fatalf("redrive fail! error:%v", err)
+	}
+	if result.Redriven != 2 || result.Failed["bad"] == "" {
+		t.Errorf("redriven:%d, failed:%v", result.Redriven, result.Failed)
+	}
+	if source.imported["1"] != rebuild.OpIndex || source.imported["2"] != rebuild.OpDelete {
+		t.Errorf("imported:%v", source.imported)
+	}
+
+	//重新导入成功的死信被删除，失败的保留
+	letters, _ = rebuild.DeadLetters.List(alias, 0)
+	if len(letters) != 1 || letters[0].Id != "bad" {
+		t.Errorf("dead letters after redrive:%v", letters)
+	}
+}
@@ -0,0 +1,56 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"reflect"
+	"testing"
+)
+
+func TestLoadDefinitionFile(t *testing.T) {
+
+	definition, err := rebuild.LoadDefinitionFile("user", "../definitions/user.json")
+	if err != nil {
+		t.Fatalf("LoadDefinitionFile has error! %v", err)
+	}
+
+	body := definition.Body()
+	mappings := body["mappings"].(map[string]interface{})
+	meta, ok := mappings["_meta"].(map[string]interface{})
+	if !ok || meta["definition_hash"] != definition.Hash() {
+		t.Errorf("definition body should contain _meta hash, got:%v", mappings["_meta"])
+	}
+
+	if _, ok := definition.Mappings["_meta"]; ok {
+		t.Errorf("Body should not modify definition mappings")
+	}
+}
+
+func TestCompareMappings(t *testing.T) {
+
+	declared := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"user_id":   map[string]interface{}{"type": "long"},
+			"user_name": map[string]interface{}{"type": "text", "fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword"}}},
+			"age":       map[string]interface{}{"type": "integer"},
+		},
+	}
+	actual := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"uid":       map[string]interface{}{"type": "long"},
+			"user_name": map[string]interface{}{"type": "text", "fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword"}}},
+			"age":       map[string]interface{}{"type": "long"},
+			"address":   map[string]interface{}{"properties": map[string]interface{}{"city": map[string]interface{}{"type": "text"}}},
+		},
+	}
+
+	missing, changed, undeclared := rebuild.CompareMappings(declared, actual)
+	if !reflect.DeepEqual(missing, []string{"user_id"}) {
+		t.Errorf("missing should be [user_id], got:%v", missing)
+	}
+	if !reflect.DeepEqual(changed, []string{"age: declared integer, actual long"}) {
+		t.Errorf("changed should be [age], got:%v", changed)
+	}
+	if !reflect.DeepEqual(undeclared, []string{"address", "address.city", "uid"}) {
+		t.Errorf("undeclared should be [address address.city uid], got:%v", undeclared)
+	}
+}
@@ -0,0 +1,51 @@
+package test
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/rebuild"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"errors"
+	"testing"
+)
+
+// submitSource 只用于注册别名，不执行分片任务
+type submitSource struct{}
+
+func (s submitSource) GetAlias() string { return "submit_test" }
+func (s submitSource) NewReader(ctx context.Context, currentSlice int, totalSlice int, args map[string]interface{}) (rebuild.Reader, error) {
+	return nil, errors.New("not supported")
+}
+func (s submitSource) BuildDocument(row interface{}) (*es.DocumentEntity, error) { return nil, nil }
+
+func init() {
+	rebuild.Registry.RegisterSource(submitSource{}, 10)
+}
+
+func TestSubmitOnce(t *testing.T) {
+	resetRedis(t)
+
+	//任务创建前并发提交同一别名，只有一次提交成功
+	alias := submitSource{}.GetAlias()
+	results := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := rebuild.Dispatcher.Submit(alias, 2, nil)
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < 5; i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("succeeded:%d, want 1", succeeded)
+	}
+	queued, _ := client.RedisClient.LLen(context.Background(), key.SliceQueueRedisKey.GetKey()).Result()
+	if queued != 2 {
+		t.Errorf("queued tasks:%d, want 2", queued)
+	}
+}
@@ -0,0 +1,58 @@
+package test
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/rebuild"
+	"strconv"
+	"testing"
+)
+
+// dryRunSource 使用Reader流水线的数据源，偶数行跳过
+type dryRunSource struct{}
+
+func (s dryRunSource) GetAlias() string { return "dryrun" }
+func (s dryRunSource) NewReader(ctx context.Context, currentSlice int, totalSlice int, args map[string]interface{}) (rebuild.Reader, error) {
+	return pagedReader(95), nil
+}
+func (s dryRunSource) BuildDocument(row interface{}) (*es.DocumentEntity, error) {
+	if row.(int)%2 == 0 {
+		return nil, nil
+	}
+	data := map[string]interface{}{"id": row}
+	return &es.DocumentEntity{Id: strconv.Itoa(row.(int)), Data: &data}, nil
+}
+func (s dryRunSource) ConfigurePipeline(p *rebuild.Pipeline) { p.PageSize = 10 }
+
+func TestDryRunNoWrite(t *testing.T) {
+
+	handler := rebuild.NewSourceHandler(dryRunSource{}, 100)
+	report, err := handler.DryRun(0, 1, nil, rebuild.DryRunOptions{NoWrite: true, Samples: 3})
+	if err != nil {
+		t.Fatalf("dry run error:%v", err)
+	}
+
+	if report.IndexName != "" || report.Mapping != nil {
+		t.Errorf("no write dry run should not create index, index:%s", report.IndexName)
+	}
+	if report.Rows != 95 || report.Docs != 48 || report.Success != 48 || report.Fail != 0 {
+		t.Errorf("rows:%d, docs:%d, success:%d, fail:%d, want 95, 48, 48, 0", report.Rows, report.Docs, report.Success, report.Fail)
+	}
+	if len(report.Samples) != 3 || report.Samples[0].Source == nil {
+		t.Errorf("samples:%d, want 3", len(report.Samples))
+	}
+}
+
+func TestDryRunMaxRows(t *testing.T) {
+
+	handler := rebuild.NewSourceHandler(dryRunSource{}, 100)
+	report, err := handler.DryRun(0, 1, nil, rebuild.DryRunOptions{NoWrite: true, MaxRows: 25})
+	if err != nil {
+		t.Fatalf("dry run error:%v", err)
+	}
+
+	//按页读取，读满MaxRows的那一页处理完后停止
+	if !report.Truncated || report.Rows != 30 {
+		t.Errorf("truncated:%v, rows:%d, want true, 30", report.Truncated, report.Rows)
+	}
+}
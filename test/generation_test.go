@@ -0,0 +1,53 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNextGenerationName(t *testing.T) {
+
+	now := time.Date(2026, 10, 18, 8, 0, 0, 0, time.Local)
+
+	name := rebuild.NextGenerationName("user", now, nil)
+	if name != "user-20261018-0001" {
+		t.Errorf("NextGenerationName without index expect user-20261018-0001, actual %s", name)
+	}
+
+	indexes := []string{"user-20261017-0003", "user-20261018-0001", "user-20261018-0002", "user_01", "user-profile-20261018-0009"}
+	name = rebuild.NextGenerationName("user", now, indexes)
+	if name != "user-20261018-0003" {
+		t.Errorf("NextGenerationName expect user-20261018-0003, actual %s", name)
+	}
+}
+
+func TestParseGeneration(t *testing.T) {
+
+	date, sequence, ok := rebuild.ParseGeneration("user", "user-20261018-0012")
+	if !ok || date != "20261018" || sequence != 12 {
+		t.Errorf("ParseGeneration fail! date:%s, sequence:%d, ok:%t", date, sequence, ok)
+	}
+
+	for _, index := range []string{"user_01", "user-2026-0001", "user-20261018-01", "user-profile-20261018-0001", "user-20261018-0000"} {
+		if _, _, ok := rebuild.ParseGeneration("user", index); ok {
+			t.Errorf("ParseGeneration index %s should not be a generation of user", index)
+		}
+	}
+}
+
+func TestExpiredGenerations(t *testing.T) {
+
+	indexes := []string{"user-20261018-0002", "user-20261016-0001", "user-20261018-0001", "user-20261017-0001", "user_01"}
+
+	expired := rebuild.ExpiredGenerations("user", indexes, 1, "user-20261018-0002")
+	expect := []string{"user-20261016-0001", "user-20261017-0001"}
+	if !reflect.DeepEqual(expired, expect) {
+		t.Errorf("ExpiredGenerations expect %v, actual %v", expect, expired)
+	}
+
+	if expired := rebuild.ExpiredGenerations("user", indexes, 5); len(expired) != 0 {
+		t.Errorf("ExpiredGenerations expect nothing expired, actual %v", expired)
+	}
+}
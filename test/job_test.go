@@ -0,0 +1,146 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/rebuild"
+	"errors"
+	"testing"
+)
+
+func TestFinishCountLifecycle(t *testing.T) {
+	resetRedis(t)
+
+	alias := "finish_count_test"
+	job, err := rebuild.Jobs.Start(alias, alias+"_1", 2)
+	if err != nil {
+		t.Fatalf("start job fail! error:%v", err)
+	}
+	if remaining, _ := rebuild.Jobs.RemainingSlices(job.JobId); remaining != 2 {
+		t.Fatalf("remaining:%d, want 2", remaining)
+	}
+
+	//同一分片重复完成只计数一次
+	if remaining, counted, err := rebuild.Jobs.CountDownSlice(job.JobId, 0, ""); err != nil || !counted || remaining != 1 {
+		t.Fatalf("count down slice 0: remaining:%d, counted:%v, error:%v", remaining, counted, err)
+	}
+	if _, counted, _ := rebuild.Jobs.CountDownSlice(job.JobId, 0, ""); counted {
+		t.Fatalf("slice 0 should not be counted twice")
+	}
+
+	//任务失败后计数被删除，剩余分片不会触发切换
+	rebuild.Jobs.Finish(job.JobId, rebuild.JobFailed, errors.New("test"))
+	if _, counted, _ := rebuild.Jobs.CountDownSlice(job.JobId, 1, ""); counted {
+		t.Fatalf("slice of finished job should not be counted")
+	}
+
+	//下一次任务重新从总分片数开始计数
+	next, err := rebuild.Jobs.Start(alias, alias+"_2", 3)
+	if err != nil {
+		t.Fatalf("start next job fail! error:%v", err)
+	}
+	if next.JobId == job.JobId {
+		t.Fatalf("next job should be a new job")
+	}
+	for slice, want := range []int64{2, 1, 0} {
+		remaining, counted, err := rebuild.Jobs.CountDownSlice(next.JobId, slice, "")
+		if err != nil || !counted || remaining != want {
+			t.Fatalf("count down slice %d: remaining:%d, counted:%v, error:%v", slice, remaining, counted, err)
+		}
+	}
+
+	//成功结束同样删除计数
+	rebuild.Jobs.Finish(next.JobId, rebuild.JobSucceeded, nil)
+	if remaining, _ := rebuild.Jobs.RemainingSlices(next.JobId); remaining != 0 {
+		t.Fatalf("remaining after finish:%d, want 0", remaining)
+	}
+}
+
+func TestStaleOwnerFencing(t *testing.T) {
+	resetRedis(t)
+
+	alias := "stale_owner_test"
+	job, err := rebuild.Jobs.Start(alias, alias+"_1", 1)
+	if err != nil {
+		t.Fatalf("start job fail! error:%v", err)
+	}
+	rebuild.Jobs.SliceRunning(job.JobId, 0)
+	rebuild.Jobs.ClaimSlice(job.JobId, 0, "old")
+	if err := rebuild.Checkpoint.Commit(alias, job.JobId, 0, 1, "old", "10"); err != nil {
+		t.Fatalf("owner commit fail! error:%v", err)
+	}
+
+	//分片被重新分配给新的持有者
+	rebuild.Jobs.ReassignSlice(job.JobId, 0, errors.New("heartbeat lost"))
+	rebuild.Jobs.SliceRunning(job.JobId, 0)
+	rebuild.Jobs.ClaimSlice(job.JobId, 0, "new")
+
+	//旧持有者不能修改新持有者运行中的分片状态
+	rebuild.Jobs.SliceSucceeded(job.JobId, 0, "old")
+	if current, _ := rebuild.Jobs.Get(job.JobId); current.Slices[0].Status != rebuild.SliceRunning {
+		t.Errorf("slice status:%s after stale owner finished, want %s", current.Slices[0].Status, rebuild.SliceRunning)
+	}
+
+	//旧持有者进行中的批次不能再提交位点，也不能递减分片计数
+	if err := rebuild.Checkpoint.Commit(alias, job.JobId, 0, 1, "old", "20"); err == nil {
+		t.Errorf("stale owner commit should fail")
+	}
+	if position, _ := rebuild.Checkpoint.Get(alias, job.JobId, 0, 1); position != "10" {
+		t.Errorf("position:%s, want 10", position)
+	}
+	if _, counted, _ := rebuild.Jobs.CountDownSlice(job.JobId, 0, "old"); counted {
+		t.Errorf("stale owner should not count down")
+	}
+
+	if remaining, counted, err := rebuild.Jobs.CountDownSlice(job.JobId, 0, "new"); err != nil || !counted || remaining != 0 {
+		t.Errorf("new owner count down: remaining:%d, counted:%v, error:%v", remaining, counted, err)
+	}
+	rebuild.Jobs.SliceSucceeded(job.JobId, 0, "new")
+	if current, _ := rebuild.Jobs.Get(job.JobId); current.Slices[0].Status != rebuild.SliceSucceeded {
+		t.Errorf("slice status:%s, want %s", current.Slices[0].Status, rebuild.SliceSucceeded)
+	}
+}
+
+func TestDocsRead(t *testing.T) {
+	resetRedis(t)
+
+	alias := "docs_read_test"
+	job, err := rebuild.Jobs.Start(alias, alias+"_1", 1)
+	if err != nil {
+		t.Fatalf("start job fail! error:%v", err)
+	}
+
+	//读取100条，其中10条转换失败没有写入
+	checkpointer := rebuild.NewCheckpointer(alias, job.JobId, 0, 1, "")
+	checkpointer.Read(100)
+	rebuild.Jobs.AddStats(job.JobId, 0, &es.BatchResult{Success: 85, Fail: 3, Conflict: 2})
+
+	job, _ = rebuild.Jobs.Get(job.JobId)
+	if job.DocsRead != 100 || job.Slices[0].DocsRead != 100 {
+		t.Errorf("docsRead:%d, slice docsRead:%d, want 100", job.DocsRead, job.Slices[0].DocsRead)
+	}
+	if job.DocsWritten != 85 || job.DocsFailed != 3 || job.DocsConflict != 2 {
+		t.Errorf("docsWritten:%d, docsFailed:%d, docsConflict:%d", job.DocsWritten, job.DocsFailed, job.DocsConflict)
+	}
+}
+
+func TestRebuildRequired(t *testing.T) {
+	resetRedis(t)
+
+	alias := "rebuild_required_test"
+	//别名还没有任务时同样可以标记
+	if err := rebuild.Jobs.MarkRebuildRequired(alias, "definition changed"); err != nil {
+		t.Fatalf("mark fail! error:%v", err)
+	}
+
+	//其他任务的开始和结束不影响标记
+	job, _ := rebuild.Jobs.Start(alias, alias+"_1", 1)
+	rebuild.Jobs.Finish(job.JobId, rebuild.JobFailed, errors.New("test"))
+	if reason, _ := rebuild.Jobs.RebuildRequired(alias); reason != "definition changed" {
+		t.Errorf("reason:%s, want definition changed", reason)
+	}
+
+	rebuild.Jobs.ClearRebuildRequired(alias)
+	if reason, _ := rebuild.Jobs.RebuildRequired(alias); reason != "" {
+		t.Errorf("reason:%s, want empty", reason)
+	}
+}
@@ -0,0 +1,130 @@
+package test
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/rebuild"
+	"elasticsearch-data-import-go/redis/client"
+	"elasticsearch-data-import-go/redis/key"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// leaseSource 只用于注册别名，不执行分片任务
+type leaseSource struct{}
+
+func (s leaseSource) GetAlias() string { return "lease_test" }
+func (s leaseSource) NewReader(ctx context.Context, currentSlice int, totalSlice int, args map[string]interface{}) (rebuild.Reader, error) {
+	return nil, errors.New("not supported")
+}
+func (s leaseSource) BuildDocument(row interface{}) (*es.DocumentEntity, error) { return nil, nil }
+
+func init() {
+	rebuild.Registry.RegisterSource(leaseSource{}, 10)
+}
+
+// queuedTasks 获取队列中的分片任务
+func queuedTasks(t *testing.T) []*rebuild.SliceTask {
+	t.Helper()
+	items, err := client.RedisClient.LRange(context.Background(), key.SliceQueueRedisKey.GetKey(), 0, -1).Result()
+	if err != nil {
+		t.Fatalf("get queue fail! error:%v", err)
+	}
+	tasks := make([]*rebuild.SliceTask, 0, len(items))
+	for _, data := range items {
+		var task rebuild.SliceTask
+		json.Unmarshal([]byte(data), &task)
+		tasks = append(tasks, &task)
+	}
+	return tasks
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	resetRedis(t)
+
+	ctx := context.Background()
+	task := &rebuild.SliceTask{TaskId: "task", Type: rebuild.TaskFullRebuild, Alias: leaseSource{}.GetAlias(), CurrentSlice: 1, TotalSlice: 2}
+	data, _ := json.Marshal(task)
+	//任务已被领取，但领取的节点宕机，没有租约
+	client.RedisClient.LPush(ctx, key.SliceProcessingRedisKey.GetKey(), string(data))
+
+	//第一次检查只记录没有租约的时间
+	if !rebuild.Dispatcher.ReapOnce() {
+		t.Fatalf("reap should acquire lock")
+	}
+	if tasks := queuedTasks(t); len(tasks) != 0 {
+		t.Fatalf("task should not be requeued on first check")
+	}
+	missingKey := key.SliceMissingRedisKey.GetKey()
+	if exists, _ := client.RedisClient.HExists(ctx, missingKey, string(data)).Result(); !exists {
+		t.Fatalf("missing lease should be kept in redis")
+	}
+
+	//其他节点在租约时间之前已经发现没有租约，检查的节点变化后任务仍然会重新入队
+	since := time.Now().Add(-key.SliceLeaseRedisKey.GetExpire() - time.Second).UnixMilli()
+	client.RedisClient.HSet(ctx, missingKey, string(data), strconv.FormatInt(since, 10))
+	rebuild.Dispatcher.ReapOnce()
+
+	tasks := queuedTasks(t)
+	if len(tasks) != 1 || tasks[0].Type != rebuild.TaskPartRebuild || tasks[0].Attempts != 1 || tasks[0].CurrentSlice != 1 {
+		t.Fatalf("requeued tasks:%v", tasks)
+	}
+	if count, _ := client.RedisClient.LLen(ctx, key.SliceProcessingRedisKey.GetKey()).Result(); count != 0 {
+		t.Errorf("processing:%d, want 0", count)
+	}
+	if exists, _ := client.RedisClient.HExists(ctx, missingKey, string(data)).Result(); exists {
+		t.Errorf("requeued task should be removed from missing leases")
+	}
+}
+
+func TestStaleSliceReassign(t *testing.T) {
+	resetRedis(t)
+
+	ctx := context.Background()
+	alias := leaseSource{}.GetAlias()
+	job, err := rebuild.Jobs.Start(alias, alias+"_1", 2)
+	if err != nil {
+		t.Fatalf("start job fail! error:%v", err)
+	}
+	rebuild.Jobs.ClaimSlice(job.JobId, 0, "old")
+
+	//分片0运行中，心跳已超时
+	last := time.Now().Add(-time.Minute).UnixMilli()
+	state, _ := json.Marshal(&rebuild.SliceState{Slice: 0, Status: rebuild.SliceRunning, StartTime: last})
+	client.RedisClient.HSet(ctx, key.JobRedisKey.MakeRedisKey(job.JobId), "slice#0", string(state), "slice#0#heartbeat", last)
+
+	rebuild.Dispatcher.ReapOnce()
+
+	//分片解除持有，原持有者不能再续租、提交位点和递减分片计数
+	if owned, _ := rebuild.Jobs.OwnsSlice(job.JobId, 0, "old"); owned {
+		t.Errorf("old owner should lose the slice")
+	}
+	if owned, _ := rebuild.Jobs.SliceHeartbeat(job.JobId, 0, "old"); owned {
+		t.Errorf("old owner heartbeat should fail")
+	}
+	if err := rebuild.Checkpoint.Commit(alias, job.JobId, 0, 2, "old", "10"); err == nil {
+		t.Errorf("old owner commit should fail")
+	}
+
+	job, _ = rebuild.Jobs.Get(job.JobId)
+	if job.Slices[0].Status != rebuild.SliceFailed || job.Slices[0].Attempts != 1 {
+		t.Errorf("slice status:%s, attempts:%d", job.Slices[0].Status, job.Slices[0].Attempts)
+	}
+	if job.Slices[1].Status != rebuild.SlicePending {
+		t.Errorf("slice 1 status:%s, want pending", job.Slices[1].Status)
+	}
+
+	tasks := queuedTasks(t)
+	if len(tasks) != 1 || tasks[0].Type != rebuild.TaskPartRebuild || tasks[0].CurrentSlice != 0 || tasks[0].Attempts != 1 {
+		t.Fatalf("requeued tasks:%v", tasks)
+	}
+
+	//新的持有者领取分片后继续
+	rebuild.Jobs.ClaimSlice(job.JobId, 0, "new")
+	if err := rebuild.Checkpoint.Commit(alias, job.JobId, 0, 2, "new", "10"); err != nil {
+		t.Errorf("new owner commit fail! error:%v", err)
+	}
+}
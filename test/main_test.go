@@ -0,0 +1,35 @@
+package test
+
+import (
+	"context"
+	"elasticsearch-data-import-go/redis/client"
+	"github.com/alicebob/miniredis/v2"
+	"log"
+	"os"
+	"testing"
+)
+
+var miniRedis *miniredis.Miniredis
+
+func TestMain(m *testing.M) {
+
+	var err error
+	miniRedis, err = miniredis.Run()
+	if err != nil {
+		log.Fatalf("start miniredis fail! error:%v", err)
+	}
+	//所有store共用client.RedisClient，连接在首次执行命令时建立，这里在执行命令前替换地址
+	client.RedisClient.Options().Addr = miniRedis.Addr()
+
+	code := m.Run()
+	miniRedis.Close()
+	os.Exit(code)
+}
+
+// resetRedis 清空miniredis，避免测试之间互相影响
+func resetRedis(t *testing.T) {
+	t.Helper()
+	if err := client.RedisClient.FlushAll(context.Background()).Err(); err != nil {
+		t.Fatalf("flush redis fail! error:%v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLockName(t *testing.T) {
+	if name := metrics.LockName("rebuild:rebuild_task_lockuser#0#4"); name != "rebuild:rebuild_task_lockuser" {
+		t.Errorf("lock name:%s", name)
+	}
+	if name := metrics.LockName("rebuild:scheduler_lock"); name != "rebuild:scheduler_lock" {
+		t.Errorf("lock name:%s", name)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+
+	handler := metrics.Instrument("/test/instrument", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/test/instrument", nil))
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+
+	want := `data_import_http_request_duration_seconds_count{code="418",method="POST",route="/test/instrument"} 1`
+	if !strings.Contains(body, want) {
+		t.Errorf("metrics should contain %s", want)
+	}
+}
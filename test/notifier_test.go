@@ -0,0 +1,64 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+
+	var calls int32
+	var received rebuild.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//第一次返回503，之后成功
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Token") != "token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	notifier := rebuild.NewWebhookNotifier(server.URL)
+	notifier.Backoff = 10 * time.Millisecond
+	notifier.Headers = map[string]string{"X-Token": "token"}
+
+	event := &rebuild.Event{Type: rebuild.EventAliasSwapped, Alias: "user", JobId: "job", Slice: -1, Message: "swapped"}
+	if err := notifier.Notify(event); err != nil {
+		t.Fatalf("notify error:%v", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls:%d, want 2", calls)
+	}
+	if received.Type != rebuild.EventAliasSwapped || received.Alias != "user" || received.JobId != "job" {
+		t.Errorf("received:%+v", received)
+	}
+}
+
+func TestWebhookNotifierNotRetryable(t *testing.T) {
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	notifier := rebuild.NewWebhookNotifier(server.URL)
+	notifier.Backoff = 10 * time.Millisecond
+	if err := notifier.Notify(&rebuild.Event{Type: rebuild.EventTimeout, Alias: "user"}); err == nil {
+		t.Errorf("notify should fail on 400")
+	}
+	if calls != 1 {
+		t.Errorf("calls:%d, want 1, 4xx should not be retried", calls)
+	}
+}
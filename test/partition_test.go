@@ -0,0 +1,60 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"testing"
+)
+
+// assertDisjointAndComplete 每个id恰好属于一个分片
+func assertDisjointAndComplete(t *testing.T, name string, totalSlice int, partition func(currentSlice int) rebuild.Partition) {
+	for id := int64(-20); id <= 200; id++ {
+		count := 0
+		for i := 0; i < totalSlice; i++ {
+			if partition(i).Contains(id) {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("%s totalSlice:%d, id %d belongs to %d slices", name, totalSlice, id, count)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+
+	for totalSlice := 1; totalSlice <= 7; totalSlice++ {
+		total := totalSlice
+		assertDisjointAndComplete(t, "modulo", total, func(currentSlice int) rebuild.Partition {
+			return rebuild.ModuloPartition(currentSlice, total)
+		})
+		assertDisjointAndComplete(t, "hash", total, func(currentSlice int) rebuild.Partition {
+			return rebuild.HashPartition(currentSlice, total)
+		})
+		assertDisjointAndComplete(t, "range", total, func(currentSlice int) rebuild.Partition {
+			return rebuild.RangePartition(currentSlice, total, 1, 100)
+		})
+		assertDisjointAndComplete(t, "empty range", total, func(currentSlice int) rebuild.Partition {
+			return rebuild.RangePartition(currentSlice, total, 0, 0)
+		})
+	}
+}
+
+func TestRangePartitionSQL(t *testing.T) {
+
+	cases := []struct {
+		currentSlice int
+		sql          string
+		args         int
+	}{
+		{0, "id < ?", 1},
+		{1, "id >= ? AND id < ?", 2},
+		{2, "id >= ?", 1},
+	}
+
+	for _, c := range cases {
+		sql, args := rebuild.RangePartition(c.currentSlice, 3, 1, 90).SQL("id")
+		if sql != c.sql || len(args) != c.args {
+			t.Errorf("slice %d sql should be %q with %d args, got %q %v", c.currentSlice, c.sql, c.args, sql, args)
+		}
+	}
+}
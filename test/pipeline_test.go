@@ -0,0 +1,72 @@
+package test
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/rebuild"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// pagedReader 按位点分页返回total条数据
+func pagedReader(total int) rebuild.Reader {
+	return func(ctx context.Context, position string, limit int) ([]interface{}, string, error) {
+		start := 0
+		if position != "" {
+			start, _ = strconv.Atoi(position)
+		}
+		var rows []interface{}
+		for i := start + 1; i <= total && len(rows) < limit; i++ {
+			rows = append(rows, i)
+		}
+		if len(rows) == 0 {
+			return nil, position, nil
+		}
+		return rows, strconv.Itoa(rows[len(rows)-1].(int)), nil
+	}
+}
+
+func TestPipelineRun(t *testing.T) {
+
+	var transformed int64
+	pipeline := &rebuild.Pipeline{
+		Reader: pagedReader(95),
+		//跳过所有数据，不写入ES
+		Transformer: func(row interface{}) (*es.DocumentEntity, error) {
+			atomic.AddInt64(&transformed, 1)
+			return nil, nil
+		},
+		PageSize:     10,
+		Transformers: 3,
+		Writers:      2,
+		Buffer:       1,
+	}
+
+	if err := pipeline.Run(context.Background(), "test", nil); err != nil {
+		t.Fatalf("pipeline run has error! %v", err)
+	}
+	if transformed != 95 {
+		t.Errorf("pipeline should transform 95 rows, got:%d", transformed)
+	}
+}
+
+func TestPipelineTransformError(t *testing.T) {
+
+	pipeline := &rebuild.Pipeline{
+		Reader: pagedReader(1000),
+		Transformer: func(row interface{}) (*es.DocumentEntity, error) {
+			if row.(int) == 25 {
+				return nil, fmt.Errorf("bad row")
+			}
+			return nil, nil
+		},
+		PageSize:     10,
+		Transformers: 2,
+	}
+
+	if err := pipeline.Run(context.Background(), "test", nil); err == nil {
+		t.Errorf("pipeline run should return transform error")
+	}
+}
@@ -0,0 +1,42 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"errors"
+	"testing"
+)
+
+func TestRollbackTarget(t *testing.T) {
+	resetRedis(t)
+
+	alias := "rollback_test"
+	//第一代成功切换：无 -> 1
+	first, _ := rebuild.Jobs.Start(alias, alias+"_1", 1)
+	rebuild.Jobs.Swapped(first.JobId, "")
+	rebuild.Jobs.Finish(first.JobId, rebuild.JobSucceeded, nil)
+	//第二代成功切换：1 -> 2
+	second, _ := rebuild.Jobs.Start(alias, alias+"_2", 1)
+	rebuild.Jobs.Swapped(second.JobId, alias+"_1")
+	rebuild.Jobs.Finish(second.JobId, rebuild.JobSucceeded, nil)
+	//第三代未通过校验，索引保留但没有切换别名
+	third, _ := rebuild.Jobs.Start(alias, alias+"_3", 1)
+	rebuild.Jobs.Finish(third.JobId, rebuild.JobFailed, errors.New("validate fail"))
+
+	history, err := rebuild.Jobs.History(alias, 0)
+	if err != nil {
+		t.Fatalf("history fail! error:%v", err)
+	}
+
+	//按名称排序时3在2之后，回滚目标不能是未通过校验的3
+	if target := rebuild.RollbackTarget(alias+"_2", history); target != alias+"_1" {
+		t.Errorf("target:%s, want %s", target, alias+"_1")
+	}
+	//第一代切换前没有索引，不能回滚
+	if target := rebuild.RollbackTarget(alias+"_1", history); target != "" {
+		t.Errorf("target:%s, want empty", target)
+	}
+	//失败任务的索引从未挂载别名
+	if target := rebuild.RollbackTarget(alias+"_3", history); target != "" {
+		t.Errorf("target:%s, want empty", target)
+	}
+}
@@ -0,0 +1,30 @@
+package test
+
+import (
+	rebuildController "elasticsearch-data-import-go/web/controller/rebuild"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteMethodNotAllowed(t *testing.T) {
+
+	//修改状态的操作只允许POST
+	for _, action := range []string{"start", "fullRebuild", "cancel", "rollback", "redrive"} {
+		recorder := httptest.NewRecorder()
+		rebuildController.Route(recorder, httptest.NewRequest(http.MethodGet, "/rebuild/user/"+action, nil))
+		if recorder.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s code:%d, want %d", action, recorder.Code, http.StatusMethodNotAllowed)
+		}
+		if allow := recorder.Header().Get("Allow"); allow != http.MethodPost {
+			t.Errorf("GET %s allow:%s, want %s", action, allow, http.MethodPost)
+		}
+	}
+
+	//未知的操作返回404
+	recorder := httptest.NewRecorder()
+	rebuildController.Route(recorder, httptest.NewRequest(http.MethodPost, "/rebuild/user/unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown action code:%d, want %d", recorder.Code, http.StatusNotFound)
+	}
+}
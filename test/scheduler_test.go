@@ -0,0 +1,57 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"testing"
+	"time"
+)
+
+func TestScheduleDue(t *testing.T) {
+
+	nightly := rebuild.Schedule{Name: "nightly", Spec: "0 3 * * *", Action: rebuild.ScheduleFullRebuild}
+	last := time.Date(2026, 10, 17, 3, 0, 0, 0, time.Local)
+
+	//未到触发时间
+	if tick, _, err := nightly.Due(last, time.Date(2026, 10, 18, 2, 59, 0, 0, time.Local)); err != nil || !tick.IsZero() {
+		t.Errorf("due before tick, tick:%v, error:%v", tick, err)
+	}
+
+	//刚到触发时间
+	want := time.Date(2026, 10, 18, 3, 0, 0, 0, time.Local)
+	if tick, fire, err := nightly.Due(last, want.Add(5*time.Second)); err != nil || !fire || !tick.Equal(want) {
+		t.Errorf("due on tick, tick:%v, fire:%v, error:%v", tick, fire, err)
+	}
+
+	//错过多次触发，默认跳过，返回最近一次触发时间
+	now := time.Date(2026, 10, 20, 12, 0, 0, 0, time.Local)
+	want = time.Date(2026, 10, 20, 3, 0, 0, 0, time.Local)
+	if tick, fire, err := nightly.Due(last, now); err != nil || fire || !tick.Equal(want) {
+		t.Errorf("due missed skip, tick:%v, fire:%v, error:%v", tick, fire, err)
+	}
+
+	//错过的触发合并为一次执行
+	nightly.Missed = rebuild.MissedRunOnce
+	if tick, fire, err := nightly.Due(last, now); err != nil || !fire || !tick.Equal(want) {
+		t.Errorf("due missed run once, tick:%v, fire:%v, error:%v", tick, fire, err)
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+
+	cases := []struct {
+		schedule rebuild.Schedule
+		valid    bool
+	}{
+		{rebuild.Schedule{Name: "catchUp", Spec: "* * * * *", Action: rebuild.ScheduleLoad}, true},
+		{rebuild.Schedule{Name: "every", Spec: "@every 30s", Action: rebuild.ScheduleLoad}, true},
+		{rebuild.Schedule{Spec: "* * * * *", Action: rebuild.ScheduleLoad}, false},
+		{rebuild.Schedule{Name: "bad", Spec: "61 * * * *", Action: rebuild.ScheduleLoad}, false},
+		{rebuild.Schedule{Name: "action", Spec: "* * * * *", Action: "unknown"}, false},
+	}
+
+	for _, c := range cases {
+		if err := c.schedule.Validate(); (err == nil) != c.valid {
+			t.Errorf("validate schedule:%+v, valid:%v, error:%v", c.schedule, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCompareHits(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		current      []string
+		candidate    []string
+		overlap      float64
+		rankDistance float64
+	}{
+		{"empty", nil, nil, 1, 0},
+		{"same", []string{"a", "b", "c"}, []string{"a", "b", "c"}, 1, 0},
+		{"disjoint", []string{"a", "b"}, []string{"c", "d"}, 0, 1},
+		//a、b互换：|0-1|+|1-0| / (3+2+1)*2
+		{"swapped", []string{"a", "b", "c"}, []string{"b", "a", "c"}, 1, 2.0 / 12},
+		//c不在新结果中，记为排名3：|2-3| + 新结果中d的3-2 / 12
+		{"replaced", []string{"a", "b", "c"}, []string{"a", "b", "d"}, 2.0 / 3, 2.0 / 12},
+		{"new empty", []string{"a", "b"}, nil, 0, 1},
+	}
+
+	for _, test := range tests {
+		overlap, rankDistance := rebuild.CompareHits(test.current, test.candidate)
+		if math.Abs(overlap-test.overlap) > 1e-9 || math.Abs(rankDistance-test.rankDistance) > 1e-9 {
+			t.Errorf("%s: overlap:%v, rankDistance:%v, want %v, %v", test.name, overlap, rankDistance, test.overlap, test.rankDistance)
+		}
+	}
+}
+
+func TestShadowSampleCapture(t *testing.T) {
+	resetRedis(t)
+
+	alias := "shadow_capture_test"
+	body := map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}}
+	//采样比例为0时不捕获
+	rebuild.ShadowQueries.SampleCapture(alias, 0, body)
+	//采样比例为1时异步捕获
+	rebuild.ShadowQueries.SampleCapture(alias, 1, body)
+
+	for i := 0; i < 100; i++ {
+		queries, err := rebuild.ShadowQueries.List(alias)
+		if err != nil {
+			t.Fatalf("list fail! error:%v", err)
+		}
+		if len(queries) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("captured query not found")
+}
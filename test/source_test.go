@@ -0,0 +1,74 @@
+package test
+
+import (
+	"context"
+	"elasticsearch-data-import-go/rebuild"
+	"errors"
+	"testing"
+)
+
+// legacyRebuild 只实现旧的Rebuild接口
+type legacyRebuild struct {
+	syncErr error
+}
+
+func (l legacyRebuild) GetAlias() string          { return "legacy" }
+func (l legacyRebuild) GetRetainGenerations() int { return 1 }
+func (l legacyRebuild) Handle(ctx context.Context, currentSlice int, totalSlice int, indexName string, args map[string]interface{}) error {
+	return nil
+}
+func (l legacyRebuild) HandleCreateIndex(indexName string) error { return nil }
+func (l legacyRebuild) HandleDeleteIndex(newIndexName string, oldIndexName string) error {
+	return nil
+}
+func (l legacyRebuild) HandlePartImport(r rebuild.Record, indexes []string, args map[string]interface{}) error {
+	return nil
+}
+func (l legacyRebuild) HandleScheduleLoad()                  {}
+func (l legacyRebuild) GetSchedules() []rebuild.Schedule     { return nil }
+func (l legacyRebuild) SyncAfterHandle(string, string) error { return l.syncErr }
+func (l legacyRebuild) NeedForceMergeEvent() bool            { return true }
+func (l legacyRebuild) GetTimeout() int64                    { return rebuild.OneHour }
+func (l legacyRebuild) TimeoutAlert()                        {}
+
+func TestAdaptRebuild(t *testing.T) {
+
+	syncErr := errors.New("sync fail")
+	source := rebuild.AdaptRebuild(legacyRebuild{syncErr: syncErr})
+
+	if source.GetAlias() != "legacy" {
+		t.Errorf("alias:%s, want legacy", source.GetAlias())
+	}
+	if _, err := source.NewReader(context.Background(), 0, 1, nil); err == nil {
+		t.Errorf("adapted rebuild should not provide a reader")
+	}
+
+	//旧接口的方法同时满足对应的能力接口
+	if _, ok := source.(rebuild.Handler); !ok {
+		t.Errorf("adapted rebuild should implement Handler")
+	}
+	if _, ok := source.(rebuild.PartImporter); !ok {
+		t.Errorf("adapted rebuild should implement PartImporter")
+	}
+	if _, ok := source.(rebuild.IndexCreator); !ok {
+		t.Errorf("adapted rebuild should implement IndexCreator")
+	}
+	if _, ok := source.(rebuild.ScheduleLoader); !ok {
+		t.Errorf("adapted rebuild should implement ScheduleLoader")
+	}
+	if merger, ok := source.(rebuild.ForceMerger); !ok || !merger.NeedForceMergeEvent() {
+		t.Errorf("adapted rebuild should implement ForceMerger")
+	}
+	if _, ok := source.(rebuild.RecordCache); ok {
+		t.Errorf("adapted rebuild should use the default record cache")
+	}
+
+	//SyncAfterHandle作为BeforeSwapHook
+	hook, ok := source.(rebuild.BeforeSwapHook)
+	if !ok {
+		t.Fatalf("adapted rebuild should implement BeforeSwapHook")
+	}
+	if err := hook.BeforeSwap("legacy-20261018-0002", "legacy-20261018-0001"); err != syncErr {
+		t.Errorf("before swap error:%v, want %v", err, syncErr)
+	}
+}
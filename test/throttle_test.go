@@ -0,0 +1,119 @@
+package test
+
+import (
+	"context"
+	"elasticsearch-data-import-go/es"
+	"elasticsearch-data-import-go/rebuild"
+	"testing"
+	"time"
+)
+
+func TestThrottleWait(t *testing.T) {
+
+	throttle := rebuild.NewThrottle("user", rebuild.ThrottleConfig{DocsPerSecond: 100})
+	docs := make([]*es.DocumentEntity, 50)
+
+	//令牌桶初始容量为1秒的速度，前100个文档不等待，之后每50个文档等待0.5秒
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := throttle.WaitWrite(context.Background(), docs); err != nil {
+			t.Fatalf("wait write error:%v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("wait write elapsed:%v, want about 500ms", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := throttle.WaitWrite(ctx, make([]*es.DocumentEntity, 1000)); err == nil {
+		t.Errorf("wait write should stop when ctx is done")
+	}
+
+	//没有配置读取速度时不等待
+	start = time.Now()
+	if err := throttle.WaitRead(context.Background(), 100000); err != nil || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("wait read should not wait without limit, error:%v", err)
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+
+	throttle := rebuild.NewThrottle("user", rebuild.ThrottleConfig{DocsPerSecond: 100, LatencyThresholdMs: 100})
+
+	//其他别名的索引被拒绝时不降速
+	throttle.OnRejected("music-20261018-0001")
+	if factor := throttle.Status().Factor; factor != 1 {
+		t.Errorf("factor:%v after other alias rejected, want 1", factor)
+	}
+	//只包含其他别名索引的批量请求变慢时不降速
+	throttle.OnFlush([]string{"music-20261018-0001"}, time.Second)
+	if factor := throttle.Status().Factor; factor != 1 {
+		t.Errorf("factor:%v after other alias slow flush, want 1", factor)
+	}
+
+	throttle.OnRejected("user-20261018-0001")
+	if factor := throttle.Status().Factor; factor != 0.5 {
+		t.Errorf("factor:%v after rejected, want 0.5", factor)
+	}
+
+	//一秒内只降速一次
+	throttle.OnFlush([]string{"user-20261018-0001"}, time.Second)
+	if factor := throttle.Status().Factor; factor != 0.5 {
+		t.Errorf("factor:%v after slow flush within backoff interval, want 0.5", factor)
+	}
+
+	//正常的批量请求逐渐恢复
+	for i := 0; i < 20; i++ {
+		throttle.OnFlush([]string{"user-20261018-0001"}, 10*time.Millisecond)
+	}
+	if factor := throttle.Status().Factor; factor != 1 {
+		t.Errorf("factor:%v after recovering, want 1", factor)
+	}
+}
+
+func TestThrottleObservedBaseline(t *testing.T) {
+
+	//没有配置速度，降速时以降速前的实际速度为基准
+	throttle := rebuild.NewThrottle("user", rebuild.ThrottleConfig{})
+	docs := make([]*es.DocumentEntity, 1000)
+	throttle.WaitWrite(context.Background(), docs)
+	time.Sleep(time.Second)
+	throttle.WaitWrite(context.Background(), docs)
+
+	//实际速度约为1000/s，降速后约为500/s，写入1000个文档约等待1秒
+	throttle.OnRejected("user-20261018-0001")
+	start := time.Now()
+	if err := throttle.WaitWrite(context.Background(), docs); err != nil {
+		t.Fatalf("wait write error:%v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("wait write elapsed:%v, want about 1s", elapsed)
+	}
+}
+
+func TestThrottleLatencyBaseline(t *testing.T) {
+
+	//没有配置耗时阈值，耗时超过基线的2倍时降速
+	throttle := rebuild.NewThrottle("user", rebuild.ThrottleConfig{})
+	index := []string{"user-20261018-0001"}
+
+	//基线样本不足时不降速
+	empty := rebuild.NewThrottle("user", rebuild.ThrottleConfig{})
+	empty.OnFlush(index, time.Second)
+	if factor := empty.Status().Factor; factor != 1 {
+		t.Errorf("factor:%v without baseline, want 1", factor)
+	}
+
+	for i := 0; i < 10; i++ {
+		throttle.OnFlush(index, 10*time.Millisecond)
+	}
+	throttle.OnFlush(index, 15*time.Millisecond)
+	if factor := throttle.Status().Factor; factor != 1 {
+		t.Errorf("factor:%v below baseline ratio, want 1", factor)
+	}
+	throttle.OnFlush(index, 500*time.Millisecond)
+	if factor := throttle.Status().Factor; factor != 0.8 {
+		t.Errorf("factor:%v after latency rising, want 0.8", factor)
+	}
+}
@@ -0,0 +1,53 @@
+package test
+
+import (
+	"elasticsearch-data-import-go/rebuild"
+	"testing"
+)
+
+func TestWithinTolerance(t *testing.T) {
+
+	cases := []struct {
+		expected  int64
+		actual    int64
+		tolerance float64
+		result    bool
+	}{
+		{100, 100, 0, true},
+		{100, 99, 0, false},
+		{100, 90, 0.1, true},
+		{100, 111, 0.1, false},
+		{0, 0, 0, true},
+		{0, 1, 0, false},
+	}
+
+	for _, c := range cases {
+		if rebuild.WithinTolerance(c.expected, c.actual, c.tolerance) != c.result {
+			t.Errorf("WithinTolerance expected:%d, actual:%d, tolerance:%v should be %t", c.expected, c.actual, c.tolerance, c.result)
+		}
+	}
+}
+
+func TestTowards(t *testing.T) {
+
+	cases := []struct {
+		actual   int64
+		expected int64
+		delta    int64
+		result   int64
+	}{
+		//全量期间新增的3条数据缓存未回放
+		{97, 100, 3, 100},
+		{95, 100, 3, 98},
+		//全量期间删除的数据缓存未回放
+		{102, 100, 5, 100},
+		{100, 100, 5, 100},
+		{90, 100, 0, 90},
+	}
+
+	for _, c := range cases {
+		if result := rebuild.Towards(c.actual, c.expected, c.delta); result != c.result {
+			t.Errorf("Towards actual:%d, expected:%d, delta:%d is %d, should be %d", c.actual, c.expected, c.delta, result, c.result)
+		}
+	}
+}
@@ -0,0 +1,595 @@
+package rebuild
+
+import (
+	"elasticsearch-data-import-go/metrics"
+	"elasticsearch-data-import-go/rebuild"
+	httpHelper "elasticsearch-data-import-go/util/httputil"
+	"elasticsearch-data-import-go/util/resutil"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// RoutePath 已注册别名列表接口
+	RoutePath = "/rebuild"
+	// RoutePrefix 全量索引接口前缀，路径格式为 /rebuild/{alias}/{action}
+	RoutePrefix = "/rebuild/"
+)
+
+type RebuildReq struct {
+	CurrentSlice int                    `json:"currentSlice"`
+	TotalSlice   int                    `json:"totalSlice"`
+	Args         map[string]interface{} `json:"args"`
+	// DryRun 为true时试运行，不创建任务，不切换别名，返回试运行报告
+	DryRun        bool                  `json:"dryRun"`
+	DryRunOptions rebuild.DryRunOptions `json:"dryRunOptions"`
+}
+
+// aliasHandler 以索引别名为维度的接口处理函数
+type aliasHandler func(w http.ResponseWriter, r *http.Request, alias string)
+
+// StartReq 分布式全量索引请求
+type StartReq struct {
+	TotalSlice int                    `json:"totalSlice"`
+	Args       map[string]interface{} `json:"args"`
+}
+
+// RedriveReq 死信重新导入请求，ids为空时重新导入全部死信
+type RedriveReq struct {
+	Ids []string `json:"ids"`
+}
+
+// route 别名接口的处理函数和允许的请求方法
+type route struct {
+	handler aliasHandler
+	methods []string
+}
+
+var (
+	get    = []string{http.MethodGet}
+	post   = []string{http.MethodPost}
+	getSet = []string{http.MethodGet, http.MethodPost}
+)
+
+var routes = map[string]route{
+	"start":         {Start, post},
+	"fullRebuild":   {FullRebuild, post},
+	"partRebuild":   {PartRebuild, post},
+	"partReload":    {PartReload, post},
+	"partImport":    {PartImport, post},
+	"status":        {Status, get},
+	"history":       {History, get},
+	"cancel":        {Cancel, post},
+	"rollback":      {Rollback, post},
+	"drift":         {Drift, get},
+	"deadLetters":   {DeadLetters, get},
+	"deadLetter":    {DeadLetter, get},
+	"redrive":       {Redrive, post},
+	"throttle":      {Throttle, getSet},
+	"schedules":     {Schedules, get},
+	"shadowQueries": {ShadowQueries, []string{http.MethodGet, http.MethodPost, http.MethodDelete}},
+	"shadowReport":  {ShadowReport, get},
+}
+
+// allows 请求方法是否允许
+func (rt route) allows(method string) bool {
+	for _, m := range rt.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Route 解析路径中的索引别名和操作，分发到对应的处理函数
+func Route(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, RoutePrefix), "/")
+	if path == "" {
+		List(w, r)
+		return
+	}
+
+	paths := strings.Split(path, "/")
+	if len(paths) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	rt, ok := routes[paths[1]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !rt.allows(r.Method) {
+		w.Header().Set("Allow", strings.Join(rt.methods, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	//别名未注册
+	if _, ok := rebuild.Registry.Get(paths[0]); !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	//按操作统计接口耗时，别名使用占位符避免路由标签随别名增长
+	alias := paths[0]
+	metrics.Instrument(RoutePrefix+"{alias}/"+paths[1], func(w http.ResponseWriter, r *http.Request) {
+		rt.handler(w, r, alias)
+	})(w, r)
+}
+
+// List 查询所有已注册的别名及其当前索引和正在构建的新索引
+func List(w http.ResponseWriter, r *http.Request) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	res = resutil.Success(rebuild.Registry.List())
+}
+
+// Start 将全量索引按分片放入任务队列，由各节点的worker领取执行
+func Start(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	var vo StartReq
+	if err := json.NewDecoder(r.Body).Decode(&vo); err != nil {
+		log.Printf("Start handle fail! env:%v error: %v", env, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "request param must json!")
+		return
+	}
+
+	tasks, err := rebuild.Dispatcher.Submit(alias, vo.TotalSlice, vo.Args)
+	if err != nil {
+		log.Printf("Start handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, err.Error())
+		return
+	}
+
+	res = resutil.Success(tasks)
+}
+
+func FullRebuild(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	var vo RebuildReq
+	if err := json.NewDecoder(r.Body).Decode(&vo); err != nil {
+		log.Printf("FullRebuild handle fai!l env:%v error: %v", env, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "request param must json!")
+		return
+	}
+
+	handler, _ := rebuild.Registry.Get(alias)
+	if vo.DryRun {
+		report, err := handler.DryRun(vo.CurrentSlice, vo.TotalSlice, vo.Args, vo.DryRunOptions)
+		if err != nil {
+			log.Printf("FullRebuild dry run error! env:%v alias:%s error: %v", env, alias, err)
+			res = resutil.Error(resutil.SYSTEM_ERROR, "dry run fail!")
+			return
+		}
+		res = resutil.Success(report)
+		return
+	}
+
+	err := handler.FullRebuild(vo.CurrentSlice, vo.TotalSlice, vo.Args)
+	if err != nil {
+		log.Printf("FullRebuild handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	} else {
+		res = resutil.Success(nil)
+	}
+
+}
+
+func PartRebuild(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	var vo RebuildReq
+	if err := json.NewDecoder(r.Body).Decode(&vo); err != nil {
+		log.Printf("PartRebuild handle fai!l env:%v error: %v", env, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "request param must json!")
+		return
+	}
+
+	handler, _ := rebuild.Registry.Get(alias)
+	err := handler.PartRebuild(vo.CurrentSlice, vo.TotalSlice, vo.Args)
+	if err != nil {
+		log.Printf("PartRebuild handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	} else {
+		res = resutil.Success(nil)
+	}
+
+}
+
+func PartReload(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	var vo RebuildReq
+	if err := json.NewDecoder(r.Body).Decode(&vo); err != nil {
+		log.Printf("PartReload handle fai!l env:%v error: %v", env, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "request param must json!")
+		return
+	}
+
+	handler, _ := rebuild.Registry.Get(alias)
+	err := handler.PartReload(vo.CurrentSlice, vo.TotalSlice, vo.Args)
+	if err != nil {
+		log.Printf("PartReload handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	} else {
+		res = resutil.Success(nil)
+	}
+
+}
+
+// PartImport 增量数据，请求体为rebuild.Record，Data由别名对应的Rebuild实现解析
+func PartImport(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	var record rebuild.Record
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		log.Printf("PartImport handle fail! env:%v error: %v", env, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "request param must json!")
+		return
+	}
+
+	handler, _ := rebuild.Registry.Get(alias)
+	err := handler.PartImport(record, make(map[string]interface{}))
+	if err != nil {
+		log.Printf("PartImport handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	} else {
+		res = resutil.Success(nil)
+	}
+
+}
+
+// Status 查询别名当前运行中的任务，没有运行中的任务时返回最近一次任务
+func Status(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	job, err := rebuild.Jobs.Current(alias)
+	if err == nil && job == nil {
+		job, err = rebuild.Jobs.Latest(alias)
+	}
+
+	if err != nil {
+		log.Printf("Status handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(job)
+}
+
+// History 查询别名的任务历史，limit参数控制返回数量
+func History(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	var limit int
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			res = resutil.Error(resutil.BUSINESS_ERROR, "limit must be number!")
+			return
+		}
+	}
+
+	jobs, err := rebuild.Jobs.History(alias, limit)
+	if err != nil {
+		log.Printf("History handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(jobs)
+}
+
+// Cancel 取消别名下运行中的全量任务
+func Cancel(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	job, err := rebuild.Cancel(alias)
+	if err != nil {
+		log.Printf("Cancel handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(job)
+}
+
+// Rollback 将别名回滚到最近一次切换前的索引
+func Rollback(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	job, err := rebuild.Rollback(alias)
+	if err != nil {
+		log.Printf("Rollback handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(job)
+}
+
+// Drift 比较别名当前索引的mapping与索引定义文件
+func Drift(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	drift, err := rebuild.CheckDrift(alias)
+	if err != nil {
+		log.Printf("Drift handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, err.Error())
+		return
+	}
+
+	res = resutil.Success(drift)
+}
+
+// DeadLetters 查询别名的死信，limit参数控制返回数量
+func DeadLetters(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	var limit int
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			res = resutil.Error(resutil.BUSINESS_ERROR, "limit must be number!")
+			return
+		}
+	}
+
+	letters, err := rebuild.DeadLetters.List(alias, limit)
+	if err != nil {
+		log.Printf("DeadLetters handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(letters)
+}
+
+// DeadLetter 查询文档的死信，包括失败原因和写入的文档内容
+func DeadLetter(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		res = resutil.Error(resutil.BUSINESS_ERROR, "id can not be empty!")
+		return
+	}
+
+	letter, err := rebuild.DeadLetters.Get(alias, id)
+	if err != nil {
+		log.Printf("DeadLetter handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(letter)
+}
+
+// Redrive 通过PartImport重新导入死信
+func Redrive(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	var vo RedriveReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&vo); err != nil {
+			log.Printf("Redrive handle fail! env:%v error: %v", env, err)
+			res = resutil.Error(resutil.SYSTEM_ERROR, "request param must json!")
+			return
+		}
+	}
+
+	result, err := rebuild.Redrive(alias, vo.Ids)
+	if err != nil {
+		log.Printf("Redrive handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(result)
+}
+
+// Throttle GET返回别名的限速状态，POST修改限速配置并广播到所有节点
+func Throttle(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	if _, ok := rebuild.Registry.Get(alias); !ok {
+		log.Printf("Throttle handle error! env:%v alias:%s is not registered", env, alias)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "alias is not registered!")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		res = resutil.Success(rebuild.Throttles.Get(alias).Status())
+		return
+	}
+
+	var vo rebuild.ThrottleConfig
+	if err := json.NewDecoder(r.Body).Decode(&vo); err != nil {
+		log.Printf("Throttle handle fail! env:%v error: %v", env, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "request param must json!")
+		return
+	}
+
+	status, err := rebuild.SetThrottle(alias, vo)
+	if err != nil {
+		log.Printf("Throttle handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(status)
+}
+
+// Schedules 查询别名的定时任务及其最近一次和下一次触发时间
+func Schedules(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	statuses, err := rebuild.Scheduler.List(alias)
+	if err != nil {
+		log.Printf("Schedules handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(statuses)
+}
+
+// ShadowQueries 查询、保存、删除切换别名前重放的查询，GET返回保存和捕获的查询，POST保存查询，DELETE按name删除
+func ShadowQueries(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	switch r.Method {
+	case http.MethodPost:
+		var vo rebuild.ShadowQuery
+		if err := json.NewDecoder(r.Body).Decode(&vo); err != nil {
+			log.Printf("ShadowQueries handle fail! env:%v error: %v", env, err)
+			res = resutil.Error(resutil.SYSTEM_ERROR, "request param must json!")
+			return
+		}
+		if err := rebuild.ShadowQueries.Save(alias, &vo); err != nil {
+			log.Printf("ShadowQueries handle error! env:%v alias:%s error: %v", env, alias, err)
+			res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+			return
+		}
+		res = resutil.Success(nil)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			res = resutil.Error(resutil.BUSINESS_ERROR, "name can not be empty!")
+			return
+		}
+		if err := rebuild.ShadowQueries.Delete(alias, name); err != nil {
+			log.Printf("ShadowQueries handle error! env:%v alias:%s error: %v", env, alias, err)
+			res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+			return
+		}
+		res = resutil.Success(nil)
+	default:
+		queries, err := rebuild.ShadowQueries.List(alias)
+		if err != nil {
+			log.Printf("ShadowQueries handle error! env:%v alias:%s error: %v", env, alias, err)
+			res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+			return
+		}
+		res = resutil.Success(queries)
+	}
+}
+
+// ShadowReport 查询任务切换别名前的查询比较报告，jobId为空时查询运行中或最近一次任务
+func ShadowReport(w http.ResponseWriter, r *http.Request, alias string) {
+
+	env := httpHelper.GetEnvironment(r)
+	var res *resutil.ResponseEntity
+	defer finallyHandle(w, env, &res)
+
+	jobId := r.URL.Query().Get("jobId")
+	if jobId == "" {
+		job, err := rebuild.Jobs.Current(alias)
+		if err == nil && job == nil {
+			job, err = rebuild.Jobs.Latest(alias)
+		}
+		if err != nil {
+			log.Printf("ShadowReport handle error! env:%v alias:%s error: %v", env, alias, err)
+			res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+			return
+		}
+		if job == nil {
+			res = resutil.Success(nil)
+			return
+		}
+		jobId = job.JobId
+	}
+
+	report, err := rebuild.ShadowQueries.GetReport(jobId)
+	if err != nil {
+		log.Printf("ShadowReport handle error! env:%v alias:%s error: %v", env, alias, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "handle fail!")
+		return
+	}
+
+	res = resutil.Success(report)
+}
+
+func finallyHandle(w http.ResponseWriter, env *httpHelper.Environment, resAd **resutil.ResponseEntity) {
+
+	var res *resutil.ResponseEntity
+	err := recover()
+	if err != nil {
+		//异常捕获
+		log.Printf("controller has exception! env:%v, error:%v", env, err)
+		res = resutil.Error(resutil.SYSTEM_ERROR, "")
+	} else {
+		//resAd为保存指针的地址（**resutil.ResponseEntity），方便判断controller是否返回了响应体，如果没有返回，ctxRes的值为nil
+		if *resAd == nil {
+			log.Printf("controller response pointer is empty! please check wether or not it setted ! env:%v", env)
+			res = resutil.Error(resutil.RESPONSE_ERROR, "response handle fail! please connect system master")
+		} else {
+			res = *resAd
+		}
+	}
+	//默认写入一个响应
+	resutil.WriteJson(w, res)
+}
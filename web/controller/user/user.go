@@ -1,6 +1,7 @@
 package user
 
 import (
+	userRebuild "elasticsearch-data-import-go/rebuild/user"
 	httpHelper "elasticsearch-data-import-go/util/httputil"
 	"elasticsearch-data-import-go/util/resutil"
 	"elasticsearch-data-import-go/web/dao/user"
@@ -110,6 +111,9 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//采样捕获线上查询，切换别名前在新旧索引上重放比较
+	userRebuild.CaptureSearch(&q)
+
 	dtos, err := userService.SearchByPage(&q)
 	if err != nil {
 		log.Printf("Search handle fail! env:%v error:%v", env, err)
@@ -121,7 +125,6 @@ func Search(w http.ResponseWriter, r *http.Request) {
 			vo := dtoToVo(dto)
 			vos = append(vos, vo)
 		}
-		panic("test error")
 		res = resutil.Success(vos)
 	}
 
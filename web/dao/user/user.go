@@ -133,3 +133,50 @@ func SearchByPage(query *UserQuery) ([]*UserBasic, error) {
 
 	return user, nil
 }
+
+func Count() (int64, error) {
+
+	count, err := database.Engine.Count(new(UserBasic))
+	if err != nil {
+		log.Printf("UserBasic Count has error! error:%v", err)
+		return 0, fmt.Errorf("UserBasic Count has error! error:%v", err)
+	}
+
+	return count, nil
+}
+
+// Partition 分片查询条件，由rebuild.Partition实现
+type Partition interface {
+	SQL(column string) (string, []interface{})
+}
+
+// SearchByPartition 按id分页查询分片内的数据
+func SearchByPartition(query *UserQuery, partition Partition) ([]*UserBasic, error) {
+
+	condition, args := partition.SQL("id")
+	session := database.Engine.Where("id > ?", query.StartId).And(condition, args...)
+	session.Limit(query.Limit)
+	session.OrderBy("id")
+
+	var user []*UserBasic
+	err := session.Find(&user)
+	if err != nil {
+		log.Printf("UserBasic SearchByPartition has error! param:%v, error:%v", query, err)
+		return nil, fmt.Errorf("UserBasic SearchByPartition has error! param:%v", query)
+	}
+
+	return user, nil
+}
+
+// IdRange 查询最小和最大的id，没有数据时返回0
+func IdRange() (int64, int64, error) {
+
+	var minId, maxId int64
+	_, err := database.Engine.Table(new(UserBasic)).Select("COALESCE(MIN(id), 0), COALESCE(MAX(id), 0)").Get(&minId, &maxId)
+	if err != nil {
+		log.Printf("UserBasic IdRange has error! error:%v", err)
+		return 0, 0, fmt.Errorf("UserBasic IdRange has error! error:%v", err)
+	}
+
+	return minId, maxId, nil
+}